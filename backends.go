@@ -0,0 +1,96 @@
+/*
+Copyright 2016 Tuenti Technologies S.L. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"strconv"
+)
+
+// BackendServer is a server of a backend in the backends file
+type BackendServer struct {
+	Name     string `json:"name"`
+	Address  string `json:"address"`
+	Ready    bool   `json:"ready"`
+	Draining bool   `json:"draining,omitempty"`
+}
+
+// Backend describes the servers of a service in the backends file, its name
+// is the label of the service, as generated by String()
+type Backend struct {
+	Name      string          `json:"name"`
+	Cluster   string          `json:"cluster,omitempty"`
+	Service   string          `json:"service"`
+	Namespace string          `json:"namespace"`
+	Port      int32           `json:"port"`
+	Mode      string          `json:"mode"`
+	Servers   []BackendServer `json:"servers"`
+}
+
+type BackendsList struct {
+	Backends []Backend `json:"backends"`
+}
+
+// backendsList returns the backends of the services, servers have the same
+// names as in ServerLines
+func backendsList(info *ClusterInformation) BackendsList {
+	list := BackendsList{Backends: make([]Backend, 0, len(info.Services))}
+	for _, s := range info.Services {
+		backend := Backend{
+			Name:      s.String(),
+			Cluster:   s.Cluster,
+			Service:   s.Name,
+			Namespace: s.Namespace,
+			Port:      s.Port.Port,
+			Mode:      s.Port.Mode,
+			Servers:   make([]BackendServer, 0, s.TotalCount()),
+		}
+		for _, endpoints := range [][]ServiceEndpoint{s.Endpoints, s.NotReady} {
+			for _, e := range endpoints {
+				backend.Servers = append(backend.Servers, BackendServer{
+					Name:     e.ServerName(),
+					Address:  net.JoinHostPort(e.IP, strconv.Itoa(int(e.Port))),
+					Ready:    e.Ready,
+					Draining: e.Draining,
+				})
+			}
+		}
+		list.Backends = append(list.Backends, backend)
+	}
+	return list
+}
+
+// backendsFile writes a JSON list of the backends of the services, so tools
+// can apply changes in servers without reloading the load balancer, its
+// output never triggers notifications
+type backendsFile struct {
+	Path string
+}
+
+func NewBackendsFile(path string) Template {
+	return &backendsFile{Path: path}
+}
+
+func (t *backendsFile) Execute(info *ClusterInformation) (bool, error) {
+	content, err := json.MarshalIndent(backendsList(info), "", "  ")
+	if err != nil {
+		return false, err
+	}
+	_, err = writeConfigFile(t.Path, append(content, '\n'))
+	return false, err
+}
@@ -0,0 +1,99 @@
+/*
+Copyright 2016 Tuenti Technologies S.L. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackendsFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kube2lb-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	info := &ClusterInformation{
+		Services: []ServiceInformation{
+			{
+				Name:      "service1",
+				Namespace: "test",
+				Port:      PortSpec{IP: net.ParseIP("127.0.0.1"), Port: 80, Protocol: "tcp", Mode: "http"},
+				Endpoints: []ServiceEndpoint{
+					{Name: "pod-a", IP: "10.0.0.1", Port: 8080, Ready: true},
+					{Name: "pod-b", IP: "10.0.0.2", Port: 8080, Ready: true, Draining: true},
+				},
+				NotReady: []ServiceEndpoint{{Name: "pod-c", IP: "fd00::3", Port: 8080}},
+			},
+			{
+				Name:      "service2",
+				Namespace: "test",
+				Port:      PortSpec{IP: net.ParseIP("127.0.0.1"), Port: 5432, Protocol: "tcp", Mode: "tcp"},
+			},
+		},
+	}
+
+	backendsPath := path.Join(dir, "backends.json")
+	template := NewBackendsFile(backendsPath)
+	changed, err := template.Execute(info)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.False(t, changed, "backends file shouldn't trigger notifications")
+
+	data, err := ioutil.ReadFile(backendsPath)
+	if !assert.NoError(t, err) {
+		return
+	}
+	var list BackendsList
+	if !assert.NoError(t, json.Unmarshal(data, &list), "valid JSON expected: %s", data) {
+		return
+	}
+	expected := BackendsList{Backends: []Backend{
+		{
+			Name:      info.Services[0].String(),
+			Service:   "service1",
+			Namespace: "test",
+			Port:      80,
+			Mode:      "http",
+			Servers: []BackendServer{
+				{Name: "pod-a", Address: "10.0.0.1:8080", Ready: true},
+				{Name: "pod-b", Address: "10.0.0.2:8080", Ready: true, Draining: true},
+				{Name: "pod-c", Address: "[fd00::3]:8080"},
+			},
+		},
+		{
+			Name:      info.Services[1].String(),
+			Service:   "service2",
+			Namespace: "test",
+			Port:      5432,
+			Mode:      "tcp",
+			Servers:   []BackendServer{},
+		},
+	}}
+	assert.Equal(t, expected, list)
+
+	// Services without endpoints have an empty list of servers
+	assert.Contains(t, string(data), `"servers": []`)
+}
@@ -0,0 +1,138 @@
+/*
+Copyright 2016 Tuenti Technologies S.L. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"strings"
+)
+
+// maxDiffCells limits the size of the table used to compare lines, so large
+// configurations with many differences don't need huge amounts of memory
+const maxDiffCells = 1 << 20
+
+// canaryTemplate renders an alternative template into a side path and logs
+// the differences with the configuration generated by the primary template,
+// its output never triggers notifications
+type canaryTemplate struct {
+	templateFile
+	PrimaryPath string
+
+	// Replaced in tests
+	logf func(format string, v ...interface{})
+}
+
+// NewCanaryTemplate creates a template that writes into path and compares
+// its output with the content of primaryPath, it must be added after the
+// template writing into primaryPath
+func NewCanaryTemplate(source, path, partials, primaryPath string) Template {
+	return &canaryTemplate{
+		templateFile: templateFile{
+			Source:   source,
+			Path:     path,
+			Partials: partials,
+		},
+		PrimaryPath: primaryPath,
+		logf:        log.Printf,
+	}
+}
+
+// Canary templates read the output of the primary template
+func (t *canaryTemplate) executeAfterPrevious() {}
+
+func (t *canaryTemplate) Execute(info *ClusterInformation) (bool, error) {
+	if _, err := t.templateFile.Execute(info); err != nil {
+		return false, err
+	}
+
+	primary, err := ioutil.ReadFile(t.PrimaryPath)
+	if err != nil {
+		return false, err
+	}
+	canary, err := ioutil.ReadFile(t.Path)
+	if err != nil {
+		return false, err
+	}
+	if equalConfigs(primary, canary) {
+		t.logf("Canary configuration %s matches %s", t.Path, t.PrimaryPath)
+		return false, nil
+	}
+	diff := diffLines(splitLines(withoutIgnoredRegions(primary)), splitLines(withoutIgnoredRegions(canary)))
+	t.logf("Canary configuration %s differs from %s:\n%s", t.Path, t.PrimaryPath, strings.Join(diff, "\n"))
+	return false, nil
+}
+
+func splitLines(content []byte) []string {
+	return strings.Split(strings.TrimSuffix(string(content), "\n"), "\n")
+}
+
+// diffLines returns the lines removed from a, prefixed with "-", and the
+// lines added in b, prefixed with "+", using their longest common subsequence.
+// Common leading and trailing lines are not compared, if the rest is too large
+// to compare, only a summary is returned.
+func diffLines(a, b []string) []string {
+	for len(a) > 0 && len(b) > 0 && a[0] == b[0] {
+		a, b = a[1:], b[1:]
+	}
+	for len(a) > 0 && len(b) > 0 && a[len(a)-1] == b[len(b)-1] {
+		a, b = a[:len(a)-1], b[:len(b)-1]
+	}
+	if (len(a)+1)*(len(b)+1) > maxDiffCells {
+		return []string{fmt.Sprintf("%d lines replaced by %d lines, too many differences to compare", len(a), len(b))}
+	}
+
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	var diff []string
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] == b[j]:
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			diff = append(diff, "-"+a[i])
+			i++
+		default:
+			diff = append(diff, "+"+b[j])
+			j++
+		}
+	}
+	for ; i < len(a); i++ {
+		diff = append(diff, "-"+a[i])
+	}
+	for ; j < len(b); j++ {
+		diff = append(diff, "+"+b[j])
+	}
+	return diff
+}
@@ -0,0 +1,107 @@
+/*
+Copyright 2016 Tuenti Technologies S.L. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiffLines(t *testing.T) {
+	a := []string{"global", "backend a", "server a1", "backend b"}
+	b := []string{"global", "backend a", "server a1 check", "backend b", "server b1"}
+	assert.Equal(t, []string{"-server a1", "+server a1 check", "+server b1"}, diffLines(a, b))
+	assert.Empty(t, diffLines(a, a))
+
+	// Large differences are summarized
+	var large, other []string
+	for i := 0; i < 5000; i++ {
+		large = append(large, fmt.Sprintf("server a%d", i))
+		other = append(other, fmt.Sprintf("server b%d", i))
+	}
+	large = append([]string{"global"}, large...)
+	other = append([]string{"global"}, other...)
+	assert.Equal(t, []string{"5000 lines replaced by 5000 lines, too many differences to compare"}, diffLines(large, other))
+
+	// Only differing lines are compared
+	changed := append([]string(nil), large...)
+	changed[2500] = "server c"
+	assert.Equal(t, []string{"-server a2499", "+server c"}, diffLines(large, changed))
+}
+
+func TestCanaryTemplate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kube2lb-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	write := func(name, content string) string {
+		p := path.Join(dir, name)
+		if err := ioutil.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+	primarySource := write("primary.tmpl", "{{ range .Services }}backend {{ .Name }}\n{{ end }}")
+	canarySource := write("canary.tmpl", "{{ range .Services }}backend {{ .Name }}\n  balance {{ .Balance }}\n{{ end }}")
+	primaryPath := path.Join(dir, "primary.cfg")
+	canaryPath := path.Join(dir, "canary.cfg")
+
+	var logs []string
+	primary := NewTemplate(primarySource, primaryPath, "")
+	canary := NewCanaryTemplate(canarySource, canaryPath, "", primaryPath)
+	canary.(*canaryTemplate).logf = func(format string, v ...interface{}) {
+		logs = append(logs, fmt.Sprintf(format, v...))
+	}
+
+	info := &ClusterInformation{
+		Services: []ServiceInformation{{Name: "service1", Balance: "roundrobin"}},
+	}
+	changed, err := primary.Execute(info)
+	assert.NoError(t, err)
+	assert.True(t, changed)
+	changed, err = canary.Execute(info)
+	assert.NoError(t, err)
+	assert.False(t, changed, "canary template shouldn't trigger notifications")
+
+	content, err := ioutil.ReadFile(primaryPath)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "backend service1\n", string(content))
+	}
+	content, err = ioutil.ReadFile(canaryPath)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "backend service1\n  balance roundrobin\n", string(content))
+	}
+	if assert.Equal(t, 1, len(logs)) {
+		assert.Contains(t, logs[0], "differs")
+		assert.Contains(t, logs[0], "+  balance roundrobin")
+	}
+
+	// Same output
+	write("canary.tmpl", "{{ range .Services }}backend {{ .Name }}\n{{ end }}")
+	_, err = canary.Execute(info)
+	assert.NoError(t, err)
+	if assert.Equal(t, 2, len(logs)) {
+		assert.Contains(t, logs[1], "matches")
+	}
+}
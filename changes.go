@@ -0,0 +1,143 @@
+/*
+Copyright 2017 Tuenti Technologies S.L. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+)
+
+// Key identifies a service port in the cluster information
+func (s ServiceInformation) Key() string {
+	return fmt.Sprintf("%s/%s:%d", s.Namespace, s.Name, s.Port.Port)
+}
+
+// ClusterChanges contains the services that changed between two versions of
+// the cluster information, modified services contain the new version
+type ClusterChanges struct {
+	Added    []ServiceInformation
+	Removed  []ServiceInformation
+	Modified []ServiceInformation
+}
+
+// Empty returns true if no service has changed
+func (c ClusterChanges) Empty() bool {
+	return len(c.Added) == 0 && len(c.Removed) == 0 && len(c.Modified) == 0
+}
+
+func servicesKeys(services []ServiceInformation) []string {
+	keys := make([]string, len(services))
+	for i, s := range services {
+		keys[i] = s.Key()
+	}
+	return keys
+}
+
+// DiffClusterInformation computes the services changes from old to new,
+// if old is nil all services are considered as added
+func DiffClusterInformation(old, new *ClusterInformation) ClusterChanges {
+	oldServices := make(map[string]ServiceInformation)
+	if old != nil {
+		for _, s := range old.Services {
+			oldServices[s.Key()] = s
+		}
+	}
+
+	var changes ClusterChanges
+	seen := make(map[string]bool)
+	for _, s := range new.Services {
+		key := s.Key()
+		seen[key] = true
+		o, found := oldServices[key]
+		switch {
+		case !found:
+			changes.Added = append(changes.Added, s)
+		case !reflect.DeepEqual(o, s):
+			changes.Modified = append(changes.Modified, s)
+		}
+	}
+	for key, s := range oldServices {
+		if !seen[key] {
+			changes.Removed = append(changes.Removed, s)
+		}
+	}
+	// Map iteration order is random
+	sort.Slice(changes.Removed, func(i, j int) bool {
+		return changes.Removed[i].Key() < changes.Removed[j].Key()
+	})
+	return changes
+}
+
+// mergeChanges combines consecutive changes, a and then b, in a single set
+// of changes
+func mergeChanges(a, b ClusterChanges) ClusterChanges {
+	const (
+		added = iota
+		removed
+		modified
+	)
+	type change struct {
+		kind    int
+		service ServiceInformation
+	}
+	var keys []string
+	merged := make(map[string]change)
+	apply := func(kind int, services []ServiceInformation) {
+		for _, s := range services {
+			key := s.Key()
+			previous, found := merged[key]
+			if !found {
+				keys = append(keys, key)
+				merged[key] = change{kind, s}
+				continue
+			}
+			switch {
+			case previous.kind == added && kind == removed:
+				delete(merged, key)
+			case previous.kind == added:
+				merged[key] = change{added, s}
+			case previous.kind == removed && kind == added:
+				merged[key] = change{modified, s}
+			default:
+				merged[key] = change{kind, s}
+			}
+		}
+	}
+	for _, c := range []ClusterChanges{a, b} {
+		apply(added, c.Added)
+		apply(removed, c.Removed)
+		apply(modified, c.Modified)
+	}
+
+	var changes ClusterChanges
+	for _, key := range keys {
+		c, found := merged[key]
+		if !found {
+			continue
+		}
+		switch c.kind {
+		case added:
+			changes.Added = append(changes.Added, c.service)
+		case removed:
+			changes.Removed = append(changes.Removed, c.service)
+		case modified:
+			changes.Modified = append(changes.Modified, c.service)
+		}
+	}
+	return changes
+}
@@ -0,0 +1,83 @@
+/*
+Copyright 2017 Tuenti Technologies S.L. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiffClusterInformation(t *testing.T) {
+	old := &ClusterInformation{
+		Services: []ServiceInformation{
+			{Name: "service1", Namespace: "test", Port: PortSpec{Port: 80}, Endpoints: []ServiceEndpoint{{IP: "10.0.0.1"}}},
+			{Name: "service1", Namespace: "test", Port: PortSpec{Port: 443}, Endpoints: []ServiceEndpoint{{IP: "10.0.0.1"}}},
+			{Name: "service2", Namespace: "test", Port: PortSpec{Port: 80}},
+			{Name: "service3", Namespace: "test", Port: PortSpec{Port: 80}},
+		},
+	}
+	new := &ClusterInformation{
+		Services: []ServiceInformation{
+			{Name: "service1", Namespace: "test", Port: PortSpec{Port: 80}, Endpoints: []ServiceEndpoint{{IP: "10.0.0.1"}, {IP: "10.0.0.2"}}},
+			{Name: "service1", Namespace: "test", Port: PortSpec{Port: 443}, Endpoints: []ServiceEndpoint{{IP: "10.0.0.1"}}},
+			{Name: "service3", Namespace: "test", Port: PortSpec{Port: 80}},
+			{Name: "service4", Namespace: "test", Port: PortSpec{Port: 80}},
+		},
+	}
+
+	changes := DiffClusterInformation(old, new)
+	assert.Equal(t, []string{"test/service4:80"}, servicesKeys(changes.Added))
+	assert.Equal(t, []string{"test/service2:80"}, servicesKeys(changes.Removed))
+	if assert.Equal(t, []string{"test/service1:80"}, servicesKeys(changes.Modified)) {
+		assert.Equal(t, 2, len(changes.Modified[0].Endpoints), "new version expected in modified services")
+	}
+
+	assert.True(t, DiffClusterInformation(new, new).Empty(), "no changes expected with same information")
+
+	changes = DiffClusterInformation(nil, old)
+	assert.Equal(t, len(old.Services), len(changes.Added), "all services should be added without previous information")
+	assert.Empty(t, changes.Removed)
+	assert.Empty(t, changes.Modified)
+}
+
+func TestMergeChanges(t *testing.T) {
+	service := func(name string, endpoints ...string) ServiceInformation {
+		s := ServiceInformation{Name: name, Namespace: "test", Port: PortSpec{Port: 80}}
+		for _, ip := range endpoints {
+			s.Endpoints = append(s.Endpoints, ServiceEndpoint{IP: ip})
+		}
+		return s
+	}
+
+	a := ClusterChanges{
+		Added:    []ServiceInformation{service("added-removed"), service("added-modified", "10.0.0.1")},
+		Removed:  []ServiceInformation{service("removed-added")},
+		Modified: []ServiceInformation{service("modified-removed"), service("modified")},
+	}
+	b := ClusterChanges{
+		Added:    []ServiceInformation{service("removed-added"), service("added")},
+		Removed:  []ServiceInformation{service("added-removed"), service("modified-removed")},
+		Modified: []ServiceInformation{service("added-modified", "10.0.0.2")},
+	}
+
+	changes := mergeChanges(a, b)
+	assert.Equal(t, []string{"test/added-modified:80", "test/added:80"}, servicesKeys(changes.Added))
+	assert.Equal(t, []string{"test/modified-removed:80"}, servicesKeys(changes.Removed))
+	assert.Equal(t, []string{"test/removed-added:80", "test/modified:80"}, servicesKeys(changes.Modified))
+	assert.Equal(t, "10.0.0.2", changes.Added[0].Endpoints[0].IP, "last version of services expected")
+}
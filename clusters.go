@@ -0,0 +1,119 @@
+/*
+Copyright 2017 Tuenti Technologies S.L. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+)
+
+// SetCluster sets the identifier of the cluster, names of its services are
+// prefixed with it
+func (c *KubernetesClient) SetCluster(id string) {
+	c.cluster = id
+}
+
+// AddCluster adds other cluster whose services are merged with the services
+// of this one
+func (c *KubernetesClient) AddCluster(id string, cluster *KubernetesClient) error {
+	if id == "" {
+		return fmt.Errorf("additional clusters need an identifier")
+	}
+	if id == c.cluster {
+		return fmt.Errorf("duplicated cluster identifier %s", id)
+	}
+	for _, other := range c.clusters {
+		if other.cluster == id {
+			return fmt.Errorf("duplicated cluster identifier %s", id)
+		}
+	}
+	cluster.SetCluster(id)
+	c.clusters = append(c.clusters, cluster)
+	return nil
+}
+
+// ParseClusters parses a comma-separated list of clusters definitions, as
+// ID=KUBECONFIG, and returns a map from identifiers to kubeconfig paths
+func ParseClusters(definitions string) (map[string]string, error) {
+	clusters := make(map[string]string)
+	for _, definition := range strings.Split(definitions, ",") {
+		definition = strings.TrimSpace(definition)
+		if definition == "" {
+			continue
+		}
+		ds := strings.SplitN(definition, "=", 2)
+		if len(ds) < 2 || ds[0] == "" || ds[1] == "" {
+			return nil, fmt.Errorf("Cluster definition expected as ID=KUBECONFIG, found '%s'", definition)
+		}
+		if _, found := clusters[ds[0]]; found {
+			return nil, fmt.Errorf("duplicated cluster identifier %s", ds[0])
+		}
+		clusters[ds[0]] = ds[1]
+	}
+	return clusters, nil
+}
+
+// nodeNames returns the names of the nodes of the cluster
+func (c *KubernetesClient) nodeNames() []string {
+	c.storesLock.RLock()
+	defer c.storesLock.RUnlock()
+	return c.nodeStore.GetNames()
+}
+
+func (c *KubernetesClient) clustersNodeNames() []string {
+	nodeNames := c.nodeNames()
+	for _, cluster := range c.clusters {
+		nodeNames = append(nodeNames, cluster.nodeNames()...)
+	}
+	// Nodes are sorted so generated configurations are stable
+	sort.Strings(nodeNames)
+	return nodeNames
+}
+
+// clustersServices merges the services of all clusters, if different
+// clusters have services with the same names, only the first one is used
+func (c *KubernetesClient) clustersServices() ([]ServiceInformation, error) {
+	services, err := c.getServices()
+	if err != nil {
+		return nil, err
+	}
+	if len(c.clusters) == 0 {
+		return services, nil
+	}
+
+	seen := make(map[string]string)
+	for _, s := range services {
+		seen[s.Key()] = s.Cluster
+	}
+	for _, cluster := range c.clusters {
+		clusterServices, err := cluster.getServices()
+		if err != nil {
+			return nil, fmt.Errorf("cluster %s: %v", cluster.cluster, err)
+		}
+		for _, s := range clusterServices {
+			if other, found := seen[s.Key()]; found {
+				log.Printf("Skipping %s from cluster %s, already defined in cluster '%s'", s.Key(), s.Cluster, other)
+				continue
+			}
+			seen[s.Key()] = s.Cluster
+			services = append(services, s)
+		}
+	}
+	return services, nil
+}
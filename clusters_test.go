@@ -0,0 +1,194 @@
+/*
+Copyright 2017 Tuenti Technologies S.L. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+func servicesNames(services []ServiceInformation) []string {
+	var names []string
+	for _, s := range services {
+		names = append(names, s.Name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestMergeClusters(t *testing.T) {
+	service1, endpoints1 := newTestService("service1", nil)
+	node1 := &v1.Node{ObjectMeta: meta_v1.ObjectMeta{SelfLink: "/node/1", Name: "node1"}}
+	client := newTestStoresClient(service1, endpoints1, node1)
+	client.SetCluster("c1")
+
+	// Same name in other cluster
+	otherService1, otherEndpoints1 := newTestService("service1", nil)
+	service2, endpoints2 := newTestService("service2", nil)
+	node2 := &v1.Node{ObjectMeta: meta_v1.ObjectMeta{SelfLink: "/node/2", Name: "node2"}}
+	other := newTestStoresClient(otherService1, otherEndpoints1, service2, endpoints2, node2)
+	if err := client.AddCluster("c2", other); err != nil {
+		t.Fatal(err)
+	}
+
+	services, err := client.clustersServices()
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{"c1-service1", "c2-service1", "c2-service2"}, servicesNames(services))
+		for _, s := range services {
+			assert.Equal(t, s.Name[:2], s.Cluster)
+		}
+	}
+
+	nodes := client.clustersNodeNames()
+	sort.Strings(nodes)
+	assert.Equal(t, []string{"node1", "node2"}, nodes)
+
+	assert.Error(t, client.AddCluster("c2", newTestStoresClient()), "duplicated identifiers shouldn't be allowed")
+	assert.Error(t, client.AddCluster("c1", newTestStoresClient()), "duplicated identifiers shouldn't be allowed")
+	assert.Error(t, client.AddCluster("", newTestStoresClient()), "identifiers should be required")
+}
+
+func TestMergeClustersCollisions(t *testing.T) {
+	// Main cluster without identifier can have services colliding with
+	// prefixed services of other clusters
+	service, endpoints := newTestService("c2-service1", nil)
+	client := newTestStoresClient(service, endpoints)
+
+	otherService, otherEndpoints := newTestService("service1", nil)
+	other := newTestStoresClient(otherService, otherEndpoints)
+	if err := client.AddCluster("c2", other); err != nil {
+		t.Fatal(err)
+	}
+
+	services, err := client.clustersServices()
+	if assert.NoError(t, err) && assert.Equal(t, 1, len(services)) {
+		assert.Equal(t, "", services[0].Cluster, "service of the main cluster should be kept")
+		assert.Equal(t, "c2-service1", services[0].Name)
+	}
+}
+
+func TestParseClusters(t *testing.T) {
+	clusters, err := ParseClusters("c2=/etc/kube2lb/c2.yaml, c3=/etc/kube2lb/c3.yaml")
+	if assert.NoError(t, err) {
+		assert.Equal(t, map[string]string{"c2": "/etc/kube2lb/c2.yaml", "c3": "/etc/kube2lb/c3.yaml"}, clusters)
+	}
+
+	clusters, err = ParseClusters("")
+	if assert.NoError(t, err) {
+		assert.Empty(t, clusters)
+	}
+
+	for _, definitions := range []string{"c2", "=config", "c2=", "c2=a,c2=b"} {
+		_, err := ParseClusters(definitions)
+		assert.Error(t, err, "definitions %q should be invalid", definitions)
+	}
+}
+
+// signalUpdater runs the update function on each signal
+type signalUpdater struct {
+	signals chan struct{}
+	f       UpdaterFunc
+}
+
+func (u *signalUpdater) Build(f UpdaterFunc) Updater {
+	u.f = f
+	return u
+}
+
+func (u *signalUpdater) Run(ctx context.Context) {
+	for {
+		select {
+		case <-u.signals:
+			u.f(ctx)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (u *signalUpdater) Signal() {
+	select {
+	case u.signals <- struct{}{}:
+	default:
+	}
+}
+
+// servicesCountTemplate keeps the number of services of the last execution
+type servicesCountTemplate struct {
+	count int32
+}
+
+func (t *servicesCountTemplate) Execute(info *ClusterInformation) (bool, error) {
+	atomic.StoreInt32(&t.count, int32(len(info.Services)))
+	return false, nil
+}
+
+func TestWatchClusters(t *testing.T) {
+	notifier := newTestNotifier()
+	updater := &signalUpdater{signals: make(chan struct{}, 1)}
+	newWatchedClient := func() (*KubernetesClient, *testWatcher, *testWatcher) {
+		serviceWatcher := newTestWatcher()
+		endpointsWatcher := newTestWatcher()
+		return &KubernetesClient{
+			nodeWatcher:      newTestWatcher(),
+			serviceWatcher:   serviceWatcher,
+			endpointsWatcher: endpointsWatcher,
+			updaterBuilder:   updater.Build,
+			seenEndpoints:    make(map[string]map[string]seenEndpoint),
+			now:              time.Now,
+			notifiers:        []Notifier{notifier},
+		}, serviceWatcher, endpointsWatcher
+	}
+	client, serviceWatcher, endpointsWatcher := newWatchedClient()
+	other, otherServiceWatcher, otherEndpointsWatcher := newWatchedClient()
+	if err := client.AddCluster("c2", other); err != nil {
+		t.Fatal(err)
+	}
+	template := &servicesCountTemplate{}
+	client.AddTemplate(template)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go client.Watch(ctx)
+
+	for i := 0; i < 10; i++ {
+		service, endpoints := newTestService(fmt.Sprintf("service%d", i), nil)
+		otherService, otherEndpoints := newTestService(fmt.Sprintf("service%d", i), nil)
+		serviceWatcher.resultChan <- watch.Event{Type: watch.Added, Object: service}
+		otherServiceWatcher.resultChan <- watch.Event{Type: watch.Added, Object: otherService}
+		endpointsWatcher.resultChan <- watch.Event{Type: watch.Added, Object: endpoints}
+		otherEndpointsWatcher.resultChan <- watch.Event{Type: watch.Added, Object: otherEndpoints}
+	}
+
+	eventually(t, func() bool {
+		if atomic.LoadInt32(&template.count) == 20 {
+			return true
+		}
+		updater.Signal()
+		return false
+	}, "services of both clusters expected")
+}
@@ -56,12 +56,31 @@ func EqualResourceVersions(a, b runtime.Object) (bool, error) {
 	return versionA == versionB, nil
 }
 
+// endpointUID identifies an address on a port with the attributes used to
+// generate configurations, so changes in other attributes are ignored
+func endpointUID(address v1.EndpointAddress, port v1.EndpointPort) string {
+	uid := fmt.Sprintf("%s:%d/%s/%s", address.IP, port.Port, port.Name, port.Protocol)
+	if address.Hostname != "" {
+		uid += "/hostname=" + address.Hostname
+	}
+	if address.NodeName != nil {
+		uid += "/node=" + *address.NodeName
+	}
+	if address.TargetRef != nil {
+		uid += fmt.Sprintf("/target=%s/%s/%s", address.TargetRef.Kind, address.TargetRef.Namespace, address.TargetRef.Name)
+	}
+	return uid
+}
+
 func getEndpointsUIDs(e *v1.Endpoints) map[string]bool {
 	uids := make(map[string]bool)
 	for _, subset := range e.Subsets {
 		for _, port := range subset.Ports {
 			for _, address := range subset.Addresses {
-				uids[fmt.Sprintf("%s:%d", address.IP, port.Port)] = true
+				uids[endpointUID(address, port)] = true
+			}
+			for _, address := range subset.NotReadyAddresses {
+				uids["notready/"+endpointUID(address, port)] = true
 			}
 		}
 	}
@@ -83,18 +102,57 @@ func EqualEndpoints(a, b runtime.Object) (bool, error) {
 		return true, nil
 	}
 
-	uidsA := getEndpointsUIDs(endpointsA)
-	uidsB := getEndpointsUIDs(endpointsB)
+	return equalUIDs(getEndpointsUIDs(endpointsA), getEndpointsUIDs(endpointsB)), nil
+}
 
+func equalUIDs(uidsA, uidsB map[string]bool) bool {
 	if len(uidsA) != len(uidsB) {
-		return false, nil
+		return false
 	}
 
 	for uid := range uidsA {
 		if _, found := uidsB[uid]; !found {
-			return false, nil
+			return false
 		}
 	}
 
-	return true, nil
+	return true
+}
+
+func EqualEndpointSlices(a, b runtime.Object) (bool, error) {
+	sliceA, ok := a.(*EndpointSlice)
+	if !ok {
+		return false, fmt.Errorf("couldn't convert object to endpoint slice")
+	}
+
+	sliceB, ok := b.(*EndpointSlice)
+	if !ok {
+		return false, fmt.Errorf("couldn't convert object to endpoint slice")
+	}
+
+	if sliceA.UID == sliceB.UID && sliceA.ResourceVersion == sliceB.ResourceVersion {
+		return true, nil
+	}
+
+	endpointsA := &v1.Endpoints{Subsets: []v1.EndpointSubset{sliceA.subset()}}
+	endpointsB := &v1.Endpoints{Subsets: []v1.EndpointSubset{sliceB.subset()}}
+	return equalUIDs(getEndpointsUIDs(endpointsA), getEndpointsUIDs(endpointsB)), nil
+}
+
+func EqualAnnotations(a, b runtime.Object, key string) (bool, error) {
+	accessor := meta.NewAccessor()
+
+	annotationsA, err := accessor.Annotations(a)
+	if err != nil {
+		return false, err
+	}
+
+	annotationsB, err := accessor.Annotations(b)
+	if err != nil {
+		return false, err
+	}
+
+	valueA, foundA := annotationsA[key]
+	valueB, foundB := annotationsB[key]
+	return valueA == valueB && foundA == foundB, nil
 }
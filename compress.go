@@ -0,0 +1,81 @@
+/*
+Copyright 2016 Tuenti Technologies S.L. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"flag"
+	"io/ioutil"
+)
+
+var compressOutput = false
+
+func init() {
+	flag.BoolVar(&compressOutput, "compress-output", compressOutput, "Compress configurations written in config maps with gzip and base64-encode them, generated files are not compressed")
+}
+
+// compressConfig compresses a configuration with gzip, the output only
+// depends on the content
+func compressConfig(content []byte) ([]byte, error) {
+	var b bytes.Buffer
+	w := gzip.NewWriter(&b)
+	if _, err := w.Write(content); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+func decompressConfig(data []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+// encodeConfigMapData prepares a configuration to be stored in a config map,
+// it is compressed if needed, and base64-encoded as config maps only store
+// strings
+func encodeConfigMapData(content []byte) (string, error) {
+	if !compressOutput {
+		return string(content), nil
+	}
+	data, err := compressConfig(content)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(data), nil
+}
+
+// decodeConfigMapData returns the original content of a configuration stored
+// in a config map
+func decodeConfigMapData(data string) ([]byte, error) {
+	if !compressOutput {
+		return []byte(data), nil
+	}
+	decoded, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return nil, err
+	}
+	return decompressConfig(decoded)
+}
@@ -0,0 +1,102 @@
+/*
+Copyright 2016 Tuenti Technologies S.L. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompressConfig(t *testing.T) {
+	content := bytes.Repeat([]byte("backend service1\n  server s1 10.0.0.1:80 check\n"), 100)
+	compressed, err := compressConfig(content)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.True(t, len(compressed) < len(content), "compressed content should be smaller")
+
+	again, err := compressConfig(content)
+	if assert.NoError(t, err) {
+		assert.Equal(t, compressed, again, "compression should be deterministic")
+	}
+
+	decompressed, err := decompressConfig(compressed)
+	if assert.NoError(t, err) {
+		assert.Equal(t, content, decompressed)
+	}
+
+	_, err = decompressConfig(content)
+	assert.Error(t, err, "uncompressed content shouldn't be decompressed")
+}
+
+func TestCompressOutput(t *testing.T) {
+	defer func(compress bool) { compressOutput = compress }(compressOutput)
+	compressOutput = true
+
+	dir, err := ioutil.TempDir("", "kube2lb-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sourcePath := path.Join(dir, "test.tpl")
+	if err := ioutil.WriteFile(sourcePath, []byte("{{ range .Services }}{{ .Name }}\n{{ end }}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	info := &ClusterInformation{Services: []ServiceInformation{{Name: "service1"}}}
+
+	configPath := path.Join(dir, "test.cfg")
+	template := NewTemplate(sourcePath, configPath, "")
+	changed, err := template.Execute(info)
+	if assert.NoError(t, err) && assert.True(t, changed) {
+		data, err := ioutil.ReadFile(configPath)
+		if assert.NoError(t, err) {
+			assert.Equal(t, "service1\n", string(data), "files shouldn't be compressed")
+		}
+	}
+
+	client := newFakeConfigMapClient()
+	configMapTemplate := NewConfigMapTemplate(client, sourcePath, "", "lb", "haproxy.cfg.gz")
+	changed, err = configMapTemplate.Execute(info)
+	if assert.NoError(t, err) && assert.True(t, changed) {
+		data, err := base64.StdEncoding.DecodeString(client.configMaps["lb"].Data["haproxy.cfg.gz"])
+		if assert.NoError(t, err) {
+			content, err := decompressConfig(data)
+			if assert.NoError(t, err) {
+				assert.Equal(t, "service1\n", string(content))
+			}
+		}
+	}
+	changed, err = configMapTemplate.Execute(info)
+	if assert.NoError(t, err) {
+		assert.False(t, changed, "compressed config map shouldn't change with same information")
+		assert.Equal(t, 1, client.updates)
+	}
+
+	// Compressed content is replaced when compression is disabled
+	compressOutput = false
+	changed, err = configMapTemplate.Execute(info)
+	if assert.NoError(t, err) && assert.True(t, changed) {
+		assert.Equal(t, "service1\n", client.configMaps["lb"].Data["haproxy.cfg.gz"])
+	}
+}
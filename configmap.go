@@ -0,0 +1,239 @@
+/*
+Copyright 2017 Tuenti Technologies S.L. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/pkg/api/v1"
+	"k8s.io/client-go/rest"
+)
+
+// ConfigHashAnnotation is set in the pod template of the rollout deployment,
+// its value changes every time the config map is updated
+const ConfigHashAnnotation = "kube2lb/config-hash"
+
+// Subset of the config maps client used by kube2lb
+type configMapClient interface {
+	Get(name string, options meta_v1.GetOptions) (*v1.ConfigMap, error)
+	Create(*v1.ConfigMap) (*v1.ConfigMap, error)
+	Update(*v1.ConfigMap) (*v1.ConfigMap, error)
+}
+
+// deploymentPatcher applies strategic merge patches to deployments
+type deploymentPatcher interface {
+	Patch(name string, data []byte) error
+}
+
+// restDeploymentPatcher uses apps/v1 paths, not available in the client
+// libraries in use
+type restDeploymentPatcher struct {
+	client    rest.Interface
+	namespace string
+}
+
+func (p *restDeploymentPatcher) Patch(name string, data []byte) error {
+	return p.client.Patch(types.StrategicMergePatchType).
+		AbsPath("/apis/apps/v1/namespaces", p.namespace, "deployments", name).
+		Body(data).
+		Do().
+		Error()
+}
+
+func parseNamespacedName(definition string) (namespace, name string, err error) {
+	ds := strings.SplitN(definition, "/", 2)
+	if len(ds) < 2 || ds[0] == "" || ds[1] == "" {
+		return "", "", fmt.Errorf("Definition expected as NAMESPACE/NAME, found '%s'", definition)
+	}
+	return ds[0], ds[1], nil
+}
+
+// configMapTemplate writes the generated configuration into a key of a
+// config map instead of a local file
+type configMapTemplate struct {
+	Source, Partials string
+	Name, Key        string
+
+	// Deployment to roll out when the config map changes, if any
+	Deployment string
+
+	client  configMapClient
+	patcher deploymentPatcher
+
+	// Data of the key before the last execution, for rollbacks
+	changed  bool
+	previous *string
+
+	// Size of the last rendered configuration
+	size int
+}
+
+func NewConfigMapTemplate(client configMapClient, source, partials, name, key string) Template {
+	return &configMapTemplate{
+		Source:   source,
+		Partials: partials,
+		Name:     name,
+		Key:      key,
+		client:   client,
+	}
+}
+
+func (t *configMapTemplate) renderedSize() (string, int) {
+	return "configmap:" + t.Name + "/" + t.Key, t.size
+}
+
+func (t *configMapTemplate) Execute(info *ClusterInformation) (bool, error) {
+	t.changed, t.previous = false, nil
+	content, err := renderTemplate(t.Source, t.Partials, info)
+	if err != nil {
+		return false, err
+	}
+
+	t.size = len(content)
+
+	data, err := encodeConfigMapData(content)
+	if err != nil {
+		return false, err
+	}
+	if err := checkConfigSize(fmt.Sprintf("config map %s", t.Name), []byte(data)); err != nil {
+		return false, err
+	}
+
+	configMap, err := t.client.Get(t.Name, meta_v1.GetOptions{})
+	if errors.IsNotFound(err) {
+		_, err = t.client.Create(&v1.ConfigMap{
+			ObjectMeta: meta_v1.ObjectMeta{Name: t.Name},
+			Data:       map[string]string{t.Key: data},
+		})
+		if err != nil {
+			return false, fmt.Errorf("couldn't create config map %s: %v", t.Name, err)
+		}
+		t.changed = true
+		return true, t.rollout(content)
+	}
+	if err != nil {
+		return false, fmt.Errorf("couldn't get config map %s: %v", t.Name, err)
+	}
+
+	current, found := configMap.Data[t.Key]
+	if found {
+		// Content written with other encoding is considered as changed
+		if decoded, err := decodeConfigMapData(current); err == nil && equalConfigs(decoded, content) {
+			return false, nil
+		}
+	}
+
+	if configMap.Data == nil {
+		configMap.Data = make(map[string]string)
+	}
+	configMap.Data[t.Key] = data
+	if _, err := t.client.Update(configMap); err != nil {
+		return false, fmt.Errorf("couldn't update config map %s: %v", t.Name, err)
+	}
+	t.changed = true
+	if found {
+		t.previous = &current
+	}
+	return true, t.rollout(content)
+}
+
+// Rollback restores the data the key had before the last execution, if it
+// was changed, and rolls out the deployment again. Keys that didn't exist
+// before are removed.
+func (t *configMapTemplate) Rollback() error {
+	if !t.changed {
+		return nil
+	}
+	var content []byte
+	if t.previous != nil {
+		var err error
+		content, err = decodeConfigMapData(*t.previous)
+		if err != nil {
+			return fmt.Errorf("couldn't decode previous configuration of config map %s: %v", t.Name, err)
+		}
+	}
+
+	configMap, err := t.client.Get(t.Name, meta_v1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("couldn't get config map %s: %v", t.Name, err)
+	}
+	if configMap.Data == nil {
+		configMap.Data = make(map[string]string)
+	}
+	if t.previous != nil {
+		configMap.Data[t.Key] = *t.previous
+	} else {
+		delete(configMap.Data, t.Key)
+	}
+	if _, err := t.client.Update(configMap); err != nil {
+		return fmt.Errorf("couldn't update config map %s: %v", t.Name, err)
+	}
+	t.changed, t.previous = false, nil
+	return t.rollout(content)
+}
+
+// rollout annotates the pod template of the deployment with the hash of the
+// content, so a rolling restart is triggered only if the content changes
+func (t *configMapTemplate) rollout(content []byte) error {
+	if t.Deployment == "" || t.patcher == nil {
+		return nil
+	}
+	patch := map[string]interface{}{
+		"spec": map[string]interface{}{
+			"template": map[string]interface{}{
+				"metadata": map[string]interface{}{
+					"annotations": map[string]string{
+						ConfigHashAnnotation: fmt.Sprintf("%x", sha256.Sum256(content)),
+					},
+				},
+			},
+		},
+	}
+	data, err := json.Marshal(patch)
+	if err != nil {
+		return err
+	}
+	if err := t.patcher.Patch(t.Deployment, data); err != nil {
+		return fmt.Errorf("couldn't roll out deployment %s: %v", t.Deployment, err)
+	}
+	return nil
+}
+
+// NewConfigMapTemplate creates a template that writes into a config map,
+// defined as NAMESPACE/NAME, if deployment is not empty, the deployment with
+// this name in the same namespace is rolled out when the config map changes
+func (c *KubernetesClient) NewConfigMapTemplate(source, partials, definition, key, deployment string) (Template, error) {
+	namespace, name, err := parseNamespacedName(definition)
+	if err != nil {
+		return nil, err
+	}
+	return &configMapTemplate{
+		Source:     source,
+		Partials:   partials,
+		Name:       name,
+		Key:        key,
+		Deployment: deployment,
+		client:     c.clientset.Core().ConfigMaps(namespace),
+		patcher:    &restDeploymentPatcher{c.clientset.Core().RESTClient(), namespace},
+	}, nil
+}
@@ -0,0 +1,286 @@
+/*
+Copyright 2017 Tuenti Technologies S.L. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+type fakeConfigMapClient struct {
+	configMaps map[string]*v1.ConfigMap
+	updates    int
+}
+
+func newFakeConfigMapClient() *fakeConfigMapClient {
+	return &fakeConfigMapClient{configMaps: make(map[string]*v1.ConfigMap)}
+}
+
+func (c *fakeConfigMapClient) Get(name string, options meta_v1.GetOptions) (*v1.ConfigMap, error) {
+	configMap, found := c.configMaps[name]
+	if !found {
+		return nil, errors.NewNotFound(schema.GroupResource{Resource: "configmaps"}, name)
+	}
+	copied := *configMap
+	copied.Data = make(map[string]string)
+	for k, v := range configMap.Data {
+		copied.Data[k] = v
+	}
+	return &copied, nil
+}
+
+func (c *fakeConfigMapClient) Create(configMap *v1.ConfigMap) (*v1.ConfigMap, error) {
+	if _, found := c.configMaps[configMap.Name]; found {
+		return nil, errors.NewAlreadyExists(schema.GroupResource{Resource: "configmaps"}, configMap.Name)
+	}
+	c.configMaps[configMap.Name] = configMap
+	c.updates++
+	return configMap, nil
+}
+
+func (c *fakeConfigMapClient) Update(configMap *v1.ConfigMap) (*v1.ConfigMap, error) {
+	if _, found := c.configMaps[configMap.Name]; !found {
+		return nil, errors.NewNotFound(schema.GroupResource{Resource: "configmaps"}, configMap.Name)
+	}
+	c.configMaps[configMap.Name] = configMap
+	c.updates++
+	return configMap, nil
+}
+
+func TestConfigMapTemplate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kube2lb-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sourcePath := path.Join(dir, "test.tpl")
+	source := "{{ range .Services }}{{ .Name }}\n{{ end }}"
+	if err := ioutil.WriteFile(sourcePath, []byte(source), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	client := newFakeConfigMapClient()
+	template := NewConfigMapTemplate(client, sourcePath, "", "lb", "haproxy.cfg")
+	info := &ClusterInformation{Services: []ServiceInformation{{Name: "service1"}}}
+
+	changed, err := template.Execute(info)
+	if assert.NoError(t, err) && assert.True(t, changed, "config map should be created") {
+		assert.Equal(t, "service1\n", client.configMaps["lb"].Data["haproxy.cfg"])
+	}
+
+	changed, err = template.Execute(info)
+	if assert.NoError(t, err) {
+		assert.False(t, changed, "config map shouldn't change with same information")
+		assert.Equal(t, 1, client.updates, "config map shouldn't be updated if nothing changes")
+	}
+
+	// Other keys are kept
+	client.configMaps["lb"].Data["other"] = "foo"
+	info.Services = append(info.Services, ServiceInformation{Name: "service2"})
+	changed, err = template.Execute(info)
+	if assert.NoError(t, err) && assert.True(t, changed, "config map should be updated") {
+		assert.Equal(t, "service1\nservice2\n", client.configMaps["lb"].Data["haproxy.cfg"])
+		assert.Equal(t, "foo", client.configMaps["lb"].Data["other"])
+		assert.Equal(t, 2, client.updates)
+	}
+}
+
+type fakeDeploymentPatcher struct {
+	patches map[string][]string
+}
+
+func (p *fakeDeploymentPatcher) Patch(name string, data []byte) error {
+	var patch struct {
+		Spec struct {
+			Template struct {
+				Metadata struct {
+					Annotations map[string]string `json:"annotations"`
+				} `json:"metadata"`
+			} `json:"template"`
+		} `json:"spec"`
+	}
+	if err := json.Unmarshal(data, &patch); err != nil {
+		return err
+	}
+	p.patches[name] = append(p.patches[name], patch.Spec.Template.Metadata.Annotations[ConfigHashAnnotation])
+	return nil
+}
+
+func TestConfigMapTemplateRollout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kube2lb-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sourcePath := path.Join(dir, "test.tpl")
+	source := "{{ range .Services }}{{ .Name }}\n{{ end }}"
+	if err := ioutil.WriteFile(sourcePath, []byte(source), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	patcher := &fakeDeploymentPatcher{patches: make(map[string][]string)}
+	template := &configMapTemplate{
+		Source:     sourcePath,
+		Name:       "lb",
+		Key:        "haproxy.cfg",
+		Deployment: "haproxy",
+		client:     newFakeConfigMapClient(),
+		patcher:    patcher,
+	}
+	info := &ClusterInformation{Services: []ServiceInformation{{Name: "service1"}}}
+
+	for i := 0; i < 2; i++ {
+		_, err := template.Execute(info)
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, 1, len(patcher.patches["haproxy"]), "deployment should be rolled out only on changes")
+
+	info.Services = append(info.Services, ServiceInformation{Name: "service2"})
+	for i := 0; i < 2; i++ {
+		_, err := template.Execute(info)
+		assert.NoError(t, err)
+	}
+	if assert.Equal(t, 2, len(patcher.patches["haproxy"]), "deployment should be rolled out after change") {
+		hashes := patcher.patches["haproxy"]
+		assert.NotEmpty(t, hashes[0])
+		assert.NotEqual(t, hashes[0], hashes[1], "hash annotation should change with the content")
+	}
+}
+
+func TestConfigMapTemplateRollback(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kube2lb-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sourcePath := path.Join(dir, "test.tpl")
+	source := "{{ range .Services }}{{ .Name }}\n{{ end }}"
+	if err := ioutil.WriteFile(sourcePath, []byte(source), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	client := newFakeConfigMapClient()
+	patcher := &fakeDeploymentPatcher{patches: make(map[string][]string)}
+	template := &configMapTemplate{
+		Source:     sourcePath,
+		Name:       "lb",
+		Key:        "haproxy.cfg",
+		Deployment: "haproxy",
+		client:     client,
+		patcher:    patcher,
+	}
+
+	info := &ClusterInformation{Services: []ServiceInformation{{Name: "service1"}}}
+	if _, err := template.Execute(info); !assert.NoError(t, err) {
+		return
+	}
+	if assert.NoError(t, template.Rollback()) {
+		_, found := client.configMaps["lb"].Data["haproxy.cfg"]
+		assert.False(t, found, "key shouldn't exist after rolling back the config map that created it")
+		if hashes := patcher.patches["haproxy"]; assert.Equal(t, 2, len(hashes)) {
+			assert.NotEqual(t, hashes[0], hashes[1], "deployment should be rolled out without the configuration")
+		}
+	}
+
+	// Key added to an existing config map
+	client.configMaps["lb"].Data = map[string]string{"other": "other"}
+	if _, err := template.Execute(info); !assert.NoError(t, err) {
+		return
+	}
+	if assert.NoError(t, template.Rollback()) {
+		assert.Equal(t, map[string]string{"other": "other"}, client.configMaps["lb"].Data, "only the added key should be removed")
+	}
+	delete(patcher.patches, "haproxy")
+
+	if _, err := template.Execute(info); !assert.NoError(t, err) {
+		return
+	}
+
+	info.Services = append(info.Services, ServiceInformation{Name: "service2"})
+	if changed, err := template.Execute(info); assert.NoError(t, err) && assert.True(t, changed) {
+		assert.Equal(t, "service1\nservice2\n", client.configMaps["lb"].Data["haproxy.cfg"])
+	}
+	if assert.NoError(t, template.Rollback()) {
+		assert.Equal(t, "service1\n", client.configMaps["lb"].Data["haproxy.cfg"])
+		if hashes := patcher.patches["haproxy"]; assert.Equal(t, 3, len(hashes)) {
+			assert.Equal(t, hashes[0], hashes[2], "deployment should be rolled out with the previous configuration")
+		}
+	}
+	assert.NoError(t, template.Rollback(), "nothing to roll back after a rollback")
+	assert.Equal(t, 3, len(patcher.patches["haproxy"]))
+}
+
+func TestConfigMapRolloutUnchangedUpdates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kube2lb-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sourcePath := path.Join(dir, "test.tpl")
+	source := `{{ range .Ports }}port {{ . }}
+{{ end }}{{ range $service := .Services }}service {{ $service }}{{ range ServerNames $service $.Domain }} {{ . }}{{ end }}
+{{ end }}`
+	if err := ioutil.WriteFile(sourcePath, []byte(source), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	patcher := &fakeDeploymentPatcher{patches: make(map[string][]string)}
+	configMaps := newFakeConfigMapClient()
+	client := newTestStoresClient(newTestMultiPortServices(8)...)
+	client.AddTemplate(&configMapTemplate{
+		Source:     sourcePath,
+		Name:       "lb",
+		Key:        "haproxy.cfg",
+		Deployment: "haproxy",
+		client:     configMaps,
+		patcher:    patcher,
+	})
+
+	for i := 0; i < 10; i++ {
+		assert.NoError(t, client.Update(context.Background()))
+	}
+	assert.Equal(t, 1, configMaps.updates, "config map should be updated only once")
+	assert.Equal(t, 1, len(patcher.patches["haproxy"]), "deployment should be rolled out only once")
+}
+
+func TestParseNamespacedName(t *testing.T) {
+	namespace, name, err := parseNamespacedName("kube-system/kube2lb")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "kube-system", namespace)
+		assert.Equal(t, "kube2lb", name)
+	}
+
+	for _, definition := range []string{"", "kube2lb", "/kube2lb", "kube-system/"} {
+		_, _, err := parseNamespacedName(definition)
+		assert.Error(t, err, "definition %q should be invalid", definition)
+	}
+}
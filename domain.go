@@ -0,0 +1,72 @@
+/*
+Copyright 2016 Tuenti Technologies S.L. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"io"
+	"log"
+	"os"
+	"strings"
+)
+
+// defaultDomain is used if the cluster domain cannot be detected
+const defaultDomain = "local"
+
+// Replaced in tests
+var resolvConfPath = "/etc/resolv.conf"
+
+// clusterDomainFromResolvConf looks for the cluster domain in the search
+// domains of a resolv.conf file, in pods they include svc.CLUSTER_DOMAIN
+func clusterDomainFromResolvConf(r io.Reader) (string, bool) {
+	domain := ""
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || fields[0] != "search" {
+			continue
+		}
+		// The last search line is the one used by the resolver
+		domain = ""
+		for _, search := range fields[1:] {
+			search = strings.TrimSuffix(search, ".")
+			if strings.HasPrefix(search, "svc.") && len(search) > len("svc.") {
+				domain = strings.TrimPrefix(search, "svc.")
+				break
+			}
+		}
+	}
+	return domain, domain != ""
+}
+
+// detectClusterDomain returns the cluster domain found in the resolv.conf
+// file, or the default domain if not found
+func detectClusterDomain() string {
+	f, err := os.Open(resolvConfPath)
+	if err != nil {
+		log.Printf("Couldn't detect cluster domain, using %s: %s", defaultDomain, err)
+		return defaultDomain
+	}
+	defer f.Close()
+	domain, found := clusterDomainFromResolvConf(f)
+	if !found {
+		log.Printf("Couldn't find cluster domain in %s, using %s", resolvConfPath, defaultDomain)
+		return defaultDomain
+	}
+	log.Printf("Using detected cluster domain %s", domain)
+	return domain
+}
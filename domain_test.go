@@ -0,0 +1,67 @@
+/*
+Copyright 2016 Tuenti Technologies S.L. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClusterDomainFromResolvConf(t *testing.T) {
+	cases := []struct {
+		ResolvConf string
+		Domain     string
+		Found      bool
+	}{
+		{"nameserver 10.96.0.10\nsearch kube-system.svc.cluster.local svc.cluster.local cluster.local\noptions ndots:5\n", "cluster.local", true},
+		{"search default.svc.k8s.example.com. svc.k8s.example.com. k8s.example.com.\n", "k8s.example.com", true},
+		{"search example.com\nsearch test.svc.cluster.local svc.cluster.local\n", "cluster.local", true},
+		{"search svc.cluster.local\nsearch example.com\n", "", false},
+		{"nameserver 8.8.8.8\nsearch example.com\n", "", false},
+		{"# search svc.cluster.local\nsearch svc.\n", "", false},
+		{"", "", false},
+	}
+
+	for _, c := range cases {
+		domain, found := clusterDomainFromResolvConf(strings.NewReader(c.ResolvConf))
+		assert.Equal(t, c.Found, found, c.ResolvConf)
+		assert.Equal(t, c.Domain, domain, c.ResolvConf)
+	}
+}
+
+func TestDetectClusterDomain(t *testing.T) {
+	defer func(path string) { resolvConfPath = path }(resolvConfPath)
+
+	dir, err := ioutil.TempDir("", "kube2lb-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	resolvConfPath = path.Join(dir, "resolv.conf")
+	assert.Equal(t, defaultDomain, detectClusterDomain(), "default domain expected if resolv.conf doesn't exist")
+
+	if err := ioutil.WriteFile(resolvConfPath, []byte("search test.svc.cluster.local svc.cluster.local cluster.local\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "cluster.local", detectClusterDomain())
+}
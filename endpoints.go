@@ -17,22 +17,248 @@ limitations under the License.
 package main
 
 import (
+	"bytes"
+	"encoding/hex"
+	"flag"
 	"fmt"
+	"hash/fnv"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"time"
 
 	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
 	"k8s.io/client-go/pkg/api/v1"
 )
 
+const (
+	IPFamilyAll = "all"
+	IPFamilyV4  = "v4"
+	IPFamilyV6  = "v6"
+)
+
+const (
+	ServerNameFormatName     = "name"
+	ServerNameFormatIP       = "ip"
+	ServerNameFormatHostname = "hostname"
+)
+
+const (
+	EndpointsOrderNone = "none"
+	EndpointsOrderIP   = "ip"
+	EndpointsOrderName = "name"
+)
+
+var endpointIPFamily = IPFamilyAll
+var defaultEndpointsOrder = EndpointsOrderNone
+var endpointRemoveGrace time.Duration
+var serverNameFormat = ServerNameFormatName
+var maxEndpointsPerService = 0
+
+func init() {
+	flag.StringVar(&endpointIPFamily, "endpoint-ip-family", endpointIPFamily, "Family of the endpoint addresses to use, v4, v6 or all")
+	flag.DurationVar(&endpointRemoveGrace, "endpoint-remove-grace", endpointRemoveGrace, "Time to keep removed endpoints as draining before removing them from the configuration, to smooth churn")
+	flag.StringVar(&serverNameFormat, "server-name-format", serverNameFormat, "Format of the names of servers generated for endpoints, name of the pod, ip and port, or hostname, falling back to the pod name")
+	flag.IntVar(&maxEndpointsPerService, "max-endpoints-per-service", maxEndpointsPerService, "Maximum number of ready endpoints of each service port, the same endpoints are selected on each update, 0 for no limit")
+	flag.StringVar(&defaultEndpointsOrder, "default-endpoints-order", defaultEndpointsOrder, "Default order of service endpoints, none, ip or name")
+}
+
+func validIPFamily(family string) bool {
+	switch family {
+	case IPFamilyAll, IPFamilyV4, IPFamilyV6:
+		return true
+	}
+	return false
+}
+
+// matchesIPFamily checks if an address belongs to the given family
+func matchesIPFamily(address, family string) bool {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return false
+	}
+	switch family {
+	case IPFamilyV4:
+		return ip.To4() != nil
+	case IPFamilyV6:
+		return ip.To4() == nil
+	}
+	return true
+}
+
+func validServerNameFormat(format string) bool {
+	switch format {
+	case ServerNameFormatName, ServerNameFormatIP, ServerNameFormatHostname:
+		return true
+	}
+	return false
+}
+
+func validEndpointsOrder(order string) bool {
+	switch order {
+	case EndpointsOrderNone, EndpointsOrderIP, EndpointsOrderName:
+		return true
+	}
+	return false
+}
+
+// compareIPs compares addresses numerically, IPv4 addresses go first
+func compareIPs(a, b string) int {
+	ipA, ipB := net.ParseIP(a), net.ParseIP(b)
+	if ipA == nil || ipB == nil {
+		return strings.Compare(a, b)
+	}
+	if (ipA.To4() == nil) != (ipB.To4() == nil) {
+		if ipA.To4() != nil {
+			return -1
+		}
+		return 1
+	}
+	return bytes.Compare(ipA.To16(), ipB.To16())
+}
+
+// sortEndpoints sorts the endpoints in place so they keep the same order
+// between updates, ties are resolved by IP and port
+func sortEndpoints(endpoints []ServiceEndpoint, order string) {
+	if order != EndpointsOrderIP && order != EndpointsOrderName {
+		return
+	}
+	sort.SliceStable(endpoints, func(i, j int) bool {
+		a, b := endpoints[i], endpoints[j]
+		if order == EndpointsOrderName && a.Name != b.Name {
+			return a.Name < b.Name
+		}
+		if c := compareIPs(a.IP, b.IP); c != 0 {
+			return c < 0
+		}
+		return a.Port < b.Port
+	})
+}
+
+// limitEndpoints returns at most max endpoints, keeping their order. Endpoints
+// are selected by rendezvous hashing with the key, so the same ones are
+// selected on each update and changes in other endpoints don't replace them.
+// Draining endpoints are only selected if there are not enough other ones.
+func limitEndpoints(key string, endpoints []ServiceEndpoint, max int) []ServiceEndpoint {
+	if max <= 0 || len(endpoints) <= max {
+		return endpoints
+	}
+
+	scores := make(map[string]uint64, len(endpoints))
+	for _, e := range endpoints {
+		h := fnv.New64a()
+		fmt.Fprintf(h, "%s/%s", key, e.String())
+		scores[e.String()] = h.Sum64()
+	}
+	candidates := make([]ServiceEndpoint, len(endpoints))
+	copy(candidates, endpoints)
+	sort.SliceStable(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+		if a.Draining != b.Draining {
+			return !a.Draining
+		}
+		return scores[a.String()] > scores[b.String()]
+	})
+
+	selected := make(map[string]bool, max)
+	for _, e := range candidates[:max] {
+		selected[e.String()] = true
+	}
+	limited := make([]ServiceEndpoint, 0, max)
+	for _, e := range endpoints {
+		if selected[e.String()] {
+			limited = append(limited, e)
+		}
+	}
+	log.Printf("Limiting endpoints of %s to %d of %d", key, len(limited), len(endpoints))
+	return limited
+}
+
 type ServiceEndpoint struct {
-	Name string
-	IP   string
-	Port int32
+	Name     string
+	IP       string
+	Port     int32
+	Ready    bool
+	NodeName string
+
+	// Hostname of the endpoint if set, as in pods of StatefulSets behind
+	// headless services
+	Hostname string
+
+	// Draining endpoints have been removed, but are kept during the
+	// grace period set with -endpoint-remove-grace
+	Draining bool
+
+	// serverName is set when the formatted name is used by other endpoints of
+	// the same backend
+	serverName string
 }
 
 func (e *ServiceEndpoint) String() string {
 	return fmt.Sprintf("%s:%d", e.IP, e.Port)
 }
 
+// ServerName returns an identifier for the endpoint in the format set with
+// -server-name-format, it doesn't depend on the position of the endpoint so
+// it is kept between updates, as needed by server state persistence
+func (e ServiceEndpoint) ServerName() string {
+	if e.serverName != "" {
+		return e.serverName
+	}
+	switch serverNameFormat {
+	case ServerNameFormatIP:
+		return fmt.Sprintf("%s-%d", addressName(e.IP), e.Port)
+	case ServerNameFormatHostname:
+		if e.Hostname != "" {
+			return slug(e.Hostname)
+		}
+	}
+	if net.ParseIP(e.Name) != nil {
+		// Endpoints not backed by pods are named after their addresses
+		return addressName(e.Name)
+	}
+	return slug(e.Name)
+}
+
+// addressName returns an identifier for an IP address that only contains
+// ASCII alphanumeric characters and dashes. IPv6 groups are not compressed,
+// so different addresses always have different names.
+func addressName(address string) string {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return slug(address)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return strings.Replace(ip4.String(), ".", "-", -1)
+	}
+	groups := make([]string, 0, net.IPv6len/2)
+	for i := 0; i < net.IPv6len; i += 2 {
+		groups = append(groups, hex.EncodeToString(ip[i:i+2]))
+	}
+	return strings.Join(groups, "-")
+}
+
+// uniqueServerNames renames in place the endpoints of a backend whose server
+// names are used by other endpoints, as pods with several addresses, adding
+// their addresses and ports to their names
+func uniqueServerNames(endpoints ...[]ServiceEndpoint) {
+	count := make(map[string]int)
+	for _, es := range endpoints {
+		for _, e := range es {
+			count[e.ServerName()]++
+		}
+	}
+	for _, es := range endpoints {
+		for i := range es {
+			if name := es[i].ServerName(); count[name] > 1 {
+				es[i].serverName = fmt.Sprintf("%s-%s-%d", name, addressName(es[i].IP), es[i].Port)
+			}
+		}
+	}
+}
+
 type EndpointsHelper struct {
 	endpointsMap map[string]*v1.Endpoints
 }
@@ -49,7 +275,17 @@ func NewEndpointsHelper(endpoints []*v1.Endpoints) *EndpointsHelper {
 	return &EndpointsHelper{endpointsMap}
 }
 
+// ServicePortsMap returns the ready endpoints of a service by port
 func (h *EndpointsHelper) ServicePortsMap(s *v1.Service) map[int32][]ServiceEndpoint {
+	return h.servicePortsMap(s, true)
+}
+
+// ServiceNotReadyPortsMap returns the endpoints of a service that are not ready by port
+func (h *EndpointsHelper) ServiceNotReadyPortsMap(s *v1.Service) map[int32][]ServiceEndpoint {
+	return h.servicePortsMap(s, false)
+}
+
+func (h *EndpointsHelper) servicePortsMap(s *v1.Service, ready bool) map[int32][]ServiceEndpoint {
 	endpoints, found := h.endpointsMap[metaKey(s.ObjectMeta)]
 	if !found {
 		return nil
@@ -57,23 +293,95 @@ func (h *EndpointsHelper) ServicePortsMap(s *v1.Service) map[int32][]ServiceEndp
 	m := make(map[int32][]ServiceEndpoint)
 	for _, subset := range endpoints.Subsets {
 		for _, port := range subset.Ports {
-			var addresses []ServiceEndpoint
-			for _, address := range subset.Addresses {
-				if address.IP == "" {
-					continue
-				}
-				name := address.IP
-				if address.TargetRef != nil {
-					name = address.TargetRef.Name
-				}
-				addresses = append(addresses, ServiceEndpoint{
-					Name: name,
-					IP:   address.IP,
-					Port: port.Port,
-				})
-			}
-			m[port.Port] = addresses
+			m[port.Port] = append(m[port.Port], subsetEndpoints(subset, port, ready)...)
 		}
 	}
 	return m
 }
+
+// ServicePortEndpoints returns the ready and not ready endpoints of a port of
+// a service. Endpoint ports are matched by the name of the service port, as
+// different service ports can have the same target port, and named target
+// ports can have a different number in each endpoint. Ports of manually
+// managed endpoints not matching any name are matched by number.
+func (h *EndpointsHelper) ServicePortEndpoints(s *v1.Service, servicePort v1.ServicePort) (ready, notReady []ServiceEndpoint) {
+	endpoints, found := h.endpointsMap[metaKey(s.ObjectMeta)]
+	if !found {
+		return nil, nil
+	}
+	matched := false
+	for _, subset := range endpoints.Subsets {
+		for _, port := range subset.Ports {
+			if port.Name != servicePort.Name {
+				continue
+			}
+			matched = true
+			if servicePort.TargetPort.Type == intstr.Int && port.Port != servicePort.TargetPort.IntVal {
+				continue
+			}
+			ready = append(ready, subsetEndpoints(subset, port, true)...)
+			notReady = append(notReady, subsetEndpoints(subset, port, false)...)
+		}
+	}
+	if !matched && servicePort.TargetPort.Type == intstr.Int {
+		return h.ServicePortsMap(s)[servicePort.TargetPort.IntVal], h.ServiceNotReadyPortsMap(s)[servicePort.TargetPort.IntVal]
+	}
+	return ready, notReady
+}
+
+func subsetEndpoints(subset v1.EndpointSubset, port v1.EndpointPort, ready bool) []ServiceEndpoint {
+	subsetAddresses := subset.Addresses
+	if !ready {
+		subsetAddresses = subset.NotReadyAddresses
+	}
+	var addresses []ServiceEndpoint
+	for _, address := range subsetAddresses {
+		if address.IP == "" || !matchesIPFamily(address.IP, endpointIPFamily) {
+			continue
+		}
+		name := address.IP
+		if address.TargetRef != nil {
+			name = address.TargetRef.Name
+		}
+		var nodeName string
+		if address.NodeName != nil {
+			nodeName = *address.NodeName
+		}
+		addresses = append(addresses, ServiceEndpoint{
+			Name:     name,
+			IP:       address.IP,
+			Port:     port.Port,
+			Ready:    ready,
+			NodeName: nodeName,
+			Hostname: address.Hostname,
+		})
+	}
+	return addresses
+}
+
+// endpointsNodes returns the names of the nodes with endpoints not draining,
+// sorted and without duplicates
+func endpointsNodes(endpoints []ServiceEndpoint) []string {
+	var nodes []string
+	for _, e := range endpoints {
+		if e.NodeName != "" && !e.Draining {
+			nodes = append(nodes, e.NodeName)
+		}
+	}
+	nodes = removeDuplicated(nodes)
+	sort.Strings(nodes)
+	return nodes
+}
+
+// endpointsWithPort returns a copy of the endpoints using a different port
+func endpointsWithPort(endpoints []ServiceEndpoint, port int32) []ServiceEndpoint {
+	if endpoints == nil {
+		return nil
+	}
+	withPort := make([]ServiceEndpoint, len(endpoints))
+	for i, e := range endpoints {
+		e.Port = port
+		withPort[i] = e
+	}
+	return withPort
+}
@@ -0,0 +1,214 @@
+/*
+Copyright 2017 Tuenti Technologies S.L. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"sort"
+
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/pkg/api/v1"
+	"k8s.io/client-go/rest"
+)
+
+const (
+	endpointSlicesGroupPath   = "/apis/discovery.k8s.io/v1"
+	endpointSliceServiceLabel = "kubernetes.io/service-name"
+)
+
+var useEndpointSlices = false
+
+func init() {
+	flag.BoolVar(&useEndpointSlices, "endpoint-slices", useEndpointSlices, "Read endpoints from EndpointSlices (discovery.k8s.io/v1) instead of Endpoints")
+}
+
+// Client libraries in use don't support EndpointSlices, these types contain
+// the subset of discovery.k8s.io/v1 fields used by kube2lb.
+type EndpointSlice struct {
+	meta_v1.TypeMeta   `json:",inline"`
+	meta_v1.ObjectMeta `json:"metadata,omitempty"`
+
+	AddressType string                  `json:"addressType"`
+	Endpoints   []EndpointSliceEndpoint `json:"endpoints"`
+	Ports       []EndpointSlicePort     `json:"ports"`
+}
+
+type EndpointSliceEndpoint struct {
+	Addresses  []string                `json:"addresses"`
+	Conditions EndpointSliceConditions `json:"conditions,omitempty"`
+	Hostname   *string                 `json:"hostname,omitempty"`
+	TargetRef  *v1.ObjectReference     `json:"targetRef,omitempty"`
+	NodeName   *string                 `json:"nodeName,omitempty"`
+}
+
+type EndpointSliceConditions struct {
+	Ready *bool `json:"ready,omitempty"`
+}
+
+type EndpointSlicePort struct {
+	Name     *string      `json:"name,omitempty"`
+	Protocol *v1.Protocol `json:"protocol,omitempty"`
+	Port     *int32       `json:"port,omitempty"`
+}
+
+// subset converts the slice to an equivalent subset of legacy Endpoints
+func (s *EndpointSlice) subset() v1.EndpointSubset {
+	var subset v1.EndpointSubset
+	for _, port := range s.Ports {
+		if port.Port == nil {
+			continue
+		}
+		endpointPort := v1.EndpointPort{Port: *port.Port}
+		if port.Name != nil {
+			endpointPort.Name = *port.Name
+		}
+		if port.Protocol != nil {
+			endpointPort.Protocol = *port.Protocol
+		}
+		subset.Ports = append(subset.Ports, endpointPort)
+	}
+	for _, endpoint := range s.Endpoints {
+		for _, ip := range endpoint.Addresses {
+			address := v1.EndpointAddress{
+				IP:        ip,
+				TargetRef: endpoint.TargetRef,
+				NodeName:  endpoint.NodeName,
+			}
+			if endpoint.Hostname != nil {
+				address.Hostname = *endpoint.Hostname
+			}
+			// Unknown readiness must be interpreted as ready
+			if endpoint.Conditions.Ready == nil || *endpoint.Conditions.Ready {
+				subset.Addresses = append(subset.Addresses, address)
+			} else {
+				subset.NotReadyAddresses = append(subset.NotReadyAddresses, address)
+			}
+		}
+	}
+	return subset
+}
+
+// endpointSlicesToEndpoints merges the slices of each service in
+// legacy Endpoints objects
+func endpointSlicesToEndpoints(slices []*EndpointSlice) []*v1.Endpoints {
+	endpointsMap := make(map[string]*v1.Endpoints)
+	var endpoints []*v1.Endpoints
+	for _, slice := range slices {
+		if slice.AddressType != "IPv4" && slice.AddressType != "IPv6" {
+			continue
+		}
+		service, found := slice.Labels[endpointSliceServiceLabel]
+		if !found {
+			continue
+		}
+		meta := meta_v1.ObjectMeta{Name: service, Namespace: slice.Namespace}
+		e, found := endpointsMap[metaKey(meta)]
+		if !found {
+			e = &v1.Endpoints{ObjectMeta: meta}
+			endpointsMap[metaKey(meta)] = e
+			endpoints = append(endpoints, e)
+		}
+		e.Subsets = append(e.Subsets, slice.subset())
+	}
+	return endpoints
+}
+
+type EndpointSlicesStore struct {
+	*LocalStore
+}
+
+func (s EndpointSlicesStore) Equal(o runtime.Object, n runtime.Object) (bool, error) {
+	return EqualEndpointSlices(o, n)
+}
+
+func (s *EndpointSlicesStore) List() ([]*v1.Endpoints, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	var slices []*EndpointSlice
+	for _, o := range s.Objects {
+		slice, ok := o.(*EndpointSlice)
+		if !ok {
+			return nil, fmt.Errorf("couldn't convert endpoint slice")
+		}
+		slices = append(slices, slice)
+	}
+	// Subsets are merged in the same order on every update
+	sort.Slice(slices, func(i, j int) bool {
+		return storeKey(slices[i]) < storeKey(slices[j])
+	})
+	return endpointSlicesToEndpoints(slices), nil
+}
+
+type endpointSlicesDecoder struct {
+	stream  io.ReadCloser
+	decoder *json.Decoder
+}
+
+func (d *endpointSlicesDecoder) Decode() (watch.EventType, runtime.Object, error) {
+	var event struct {
+		Type   watch.EventType `json:"type"`
+		Object json.RawMessage `json:"object"`
+	}
+	if err := d.decoder.Decode(&event); err != nil {
+		return "", nil, err
+	}
+
+	var object runtime.Object
+	switch event.Type {
+	case watch.Added, watch.Modified, watch.Deleted:
+		object = &EndpointSlice{}
+	case watch.Error:
+		object = &meta_v1.Status{}
+	default:
+		return "", nil, fmt.Errorf("unexpected event type on endpoint slices: %s", event.Type)
+	}
+	if err := json.Unmarshal(event.Object, object); err != nil {
+		return "", nil, err
+	}
+	return event.Type, object, nil
+}
+
+func (d *endpointSlicesDecoder) Close() {
+	d.stream.Close()
+}
+
+// endpointSlicesPath returns the path of the endpoint slices in a namespace,
+// or in all namespaces if empty
+func endpointSlicesPath(namespace string) string {
+	if namespace == "" {
+		return endpointSlicesGroupPath + "/endpointslices"
+	}
+	return endpointSlicesGroupPath + "/namespaces/" + namespace + "/endpointslices"
+}
+
+func watchEndpointSlices(client rest.Interface, namespace string, options meta_v1.ListOptions) (watch.Interface, error) {
+	request := client.Get().AbsPath(endpointSlicesPath(namespace)).Param("watch", "true")
+	if options.ResourceVersion != "" {
+		request = request.Param("resourceVersion", options.ResourceVersion)
+	}
+	stream, err := request.Stream()
+	if err != nil {
+		return nil, err
+	}
+	return watch.NewStreamWatcher(&endpointSlicesDecoder{stream, json.NewDecoder(stream)}), nil
+}
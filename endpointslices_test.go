@@ -0,0 +1,142 @@
+/*
+Copyright 2017 Tuenti Technologies S.L. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+func newTestEndpointSlice(name, service string, port int32, ready []string, notReady []string) *EndpointSlice {
+	portName := "http"
+	slice := &EndpointSlice{
+		ObjectMeta: meta_v1.ObjectMeta{
+			Name:      name,
+			Namespace: "test",
+			Labels:    map[string]string{endpointSliceServiceLabel: service},
+		},
+		AddressType: "IPv4",
+		Ports:       []EndpointSlicePort{{Name: &portName, Port: &port}},
+	}
+	readyCondition, notReadyCondition := true, false
+	for _, ip := range ready {
+		slice.Endpoints = append(slice.Endpoints, EndpointSliceEndpoint{
+			Addresses:  []string{ip},
+			Conditions: EndpointSliceConditions{Ready: &readyCondition},
+		})
+	}
+	for _, ip := range notReady {
+		slice.Endpoints = append(slice.Endpoints, EndpointSliceEndpoint{
+			Addresses:  []string{ip},
+			Conditions: EndpointSliceConditions{Ready: &notReadyCondition},
+		})
+	}
+	return slice
+}
+
+func endpointsIPs(endpoints []ServiceEndpoint) []string {
+	var ips []string
+	for _, e := range endpoints {
+		ips = append(ips, e.IP)
+	}
+	sort.Strings(ips)
+	return ips
+}
+
+func TestEndpointsFromMultipleSlices(t *testing.T) {
+	service, _ := newTestService("service1", nil)
+	slices := []*EndpointSlice{
+		newTestEndpointSlice("service1-abc", "service1", 80, []string{"10.0.0.1", "10.0.0.2"}, nil),
+		newTestEndpointSlice("service1-def", "service1", 80, []string{"10.0.0.3"}, []string{"10.0.0.4"}),
+		newTestEndpointSlice("service2-abc", "service2", 80, []string{"10.0.1.1"}, nil),
+	}
+
+	store := &EndpointSlicesStore{NewLocalStore()}
+	for _, slice := range slices {
+		store.Update(slice)
+	}
+	assert.Equal(t, len(slices), len(store.Objects), "slices without self link should be stored with different keys")
+
+	client := newTestStoresClient(service)
+	client.endpointsStore = store
+	services, err := client.getServices()
+	if assert.NoError(t, err) && assert.Equal(t, 1, len(services)) {
+		assert.Equal(t, []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"}, endpointsIPs(services[0].Endpoints))
+		assert.Equal(t, []string{"10.0.0.4"}, endpointsIPs(services[0].NotReady))
+	}
+}
+
+func TestEqualEndpointSlices(t *testing.T) {
+	a := newTestEndpointSlice("service1-abc", "service1", 80, []string{"10.0.0.1"}, []string{"10.0.0.2"})
+	a.ResourceVersion = "1"
+	b := newTestEndpointSlice("service1-abc", "service1", 80, []string{"10.0.0.1"}, []string{"10.0.0.2"})
+	b.ResourceVersion = "2"
+	c := newTestEndpointSlice("service1-abc", "service1", 80, []string{"10.0.0.1", "10.0.0.2"}, nil)
+	c.ResourceVersion = "3"
+
+	eq, err := EqualEndpointSlices(a, b)
+	if assert.NoError(t, err) {
+		assert.True(t, eq, "slices with same endpoints should be equal")
+	}
+	eq, err = EqualEndpointSlices(a, c)
+	if assert.NoError(t, err) {
+		assert.False(t, eq, "slices with different readiness shouldn't be equal")
+	}
+	_, err = EqualEndpointSlices(a, &v1.Endpoints{})
+	assert.Error(t, err)
+}
+
+func TestEndpointSlicesDecoder(t *testing.T) {
+	stream := `{"type":"ADDED","object":{"metadata":{"name":"service1-abc","namespace":"test","labels":{"kubernetes.io/service-name":"service1"}},"addressType":"IPv4","endpoints":[{"addresses":["10.0.0.1"],"conditions":{"ready":true}}],"ports":[{"name":"http","port":80,"protocol":"TCP"}]}}
+{"type":"ERROR","object":{"kind":"Status","message":"too old resource version"}}
+`
+	decoder := &endpointSlicesDecoder{ioutil.NopCloser(strings.NewReader(stream)), nil}
+	decoder.decoder = json.NewDecoder(decoder.stream)
+
+	eventType, object, err := decoder.Decode()
+	if assert.NoError(t, err) && assert.Equal(t, watch.Added, eventType) {
+		slice, ok := object.(*EndpointSlice)
+		if assert.True(t, ok, "endpoint slice expected") {
+			assert.Equal(t, "service1-abc", slice.Name)
+			if assert.Equal(t, 1, len(endpointSlicesToEndpoints([]*EndpointSlice{slice}))) {
+				subset := slice.subset()
+				assert.Equal(t, []v1.EndpointPort{{Name: "http", Port: 80, Protocol: v1.ProtocolTCP}}, subset.Ports)
+				assert.Equal(t, 1, len(subset.Addresses))
+			}
+		}
+	}
+
+	eventType, object, err = decoder.Decode()
+	if assert.NoError(t, err) && assert.Equal(t, watch.Error, eventType) {
+		status, ok := object.(*meta_v1.Status)
+		if assert.True(t, ok, "status expected") {
+			assert.Equal(t, "too old resource version", status.Message)
+		}
+	}
+
+	_, _, err = decoder.Decode()
+	assert.Error(t, err, "end of stream expected")
+}
@@ -29,7 +29,7 @@ defaults
 
 {{ range $i, $port := $ports }}
 frontend frontend_{{ $port }}
-	bind {{ $port.IP }}:{{ $port.Port }}
+	bind {{ $port.Address }}
 	maxconn __HAPROXY_FRONTEND_MAXCONN__
 {{- if eq $port.Mode "http" }}
 	option httplog
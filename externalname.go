@@ -0,0 +1,122 @@
+/*
+Copyright 2017 Tuenti Technologies S.L. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+var externalNameServices = false
+var externalNameRefresh = 30 * time.Second
+
+func init() {
+	flag.BoolVar(&externalNameServices, "external-name-services", externalNameServices, "Include ExternalName services, with an endpoint for each address their external name resolves to")
+	flag.DurationVar(&externalNameRefresh, "external-name-refresh", externalNameRefresh, "Interval to resolve again the external names of ExternalName services")
+}
+
+// Resolver looks up the addresses of a host, implemented by net.Resolver
+type Resolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+type resolvedName struct {
+	ips      []string
+	resolved time.Time
+}
+
+// ExternalNameResolver caches resolved external names during the refresh
+// interval, if resolution fails previously resolved addresses are kept
+type ExternalNameResolver struct {
+	sync.Mutex
+
+	resolver Resolver
+	refresh  time.Duration
+	names    map[string]resolvedName
+
+	// Replaced in tests
+	now func() time.Time
+}
+
+func NewExternalNameResolver(resolver Resolver, refresh time.Duration) *ExternalNameResolver {
+	return &ExternalNameResolver{
+		resolver: resolver,
+		refresh:  refresh,
+		names:    make(map[string]resolvedName),
+		now:      time.Now,
+	}
+}
+
+// Resolve returns the sorted list of addresses of a name
+func (r *ExternalNameResolver) Resolve(name string) []string {
+	r.Lock()
+	defer r.Unlock()
+
+	now := r.now()
+	cached, found := r.names[name]
+	if found && now.Sub(cached.resolved) < r.refresh {
+		return cached.ips
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	addrs, err := r.resolver.LookupIPAddr(ctx, name)
+	if err == nil && len(addrs) == 0 {
+		// Nothing to balance to, handled as a failure
+		err = &net.DNSError{Err: "no addresses found", Name: name}
+	}
+	if err != nil {
+		log.Printf("Couldn't resolve %s, keeping %d previously resolved addresses: %s", name, len(cached.ips), err)
+		// Retry on next refresh
+		cached.resolved = now
+		r.names[name] = cached
+		return cached.ips
+	}
+
+	ips := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		ips = append(ips, addr.IP.String())
+	}
+	sort.Strings(ips)
+	r.names[name] = resolvedName{ips: ips, resolved: now}
+	return ips
+}
+
+func (c *KubernetesClient) externalNameResolver() *ExternalNameResolver {
+	if c.externalNames == nil {
+		c.externalNames = NewExternalNameResolver(net.DefaultResolver, externalNameRefresh)
+	}
+	return c.externalNames
+}
+
+// externalNameEndpoints returns an endpoint for each address the external
+// name resolves to, named after the external name and the address
+func (c *KubernetesClient) externalNameEndpoints(name string, port int32) []ServiceEndpoint {
+	var endpoints []ServiceEndpoint
+	for _, ip := range c.externalNameResolver().Resolve(name) {
+		if !matchesIPFamily(ip, endpointIPFamily) {
+			continue
+		}
+		endpoints = append(endpoints, ServiceEndpoint{Name: name + "-" + addressName(ip), IP: ip, Port: port, Ready: true})
+	}
+	return endpoints
+}
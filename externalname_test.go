@@ -0,0 +1,163 @@
+/*
+Copyright 2017 Tuenti Technologies S.L. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+type testResolver struct {
+	addresses map[string][]string
+	lookups   int
+}
+
+func (r *testResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	r.lookups++
+	ips, found := r.addresses[host]
+	if !found {
+		return nil, fmt.Errorf("%s not found", host)
+	}
+	var addrs []net.IPAddr
+	for _, ip := range ips {
+		addrs = append(addrs, net.IPAddr{IP: net.ParseIP(ip)})
+	}
+	return addrs, nil
+}
+
+func TestExternalNameResolver(t *testing.T) {
+	resolver := &testResolver{addresses: map[string][]string{
+		"db.example.com": {"10.0.0.2", "10.0.0.1"},
+	}}
+	now := time.Now()
+	r := NewExternalNameResolver(resolver, 30*time.Second)
+	r.now = func() time.Time { return now }
+
+	assert.Equal(t, []string{"10.0.0.1", "10.0.0.2"}, r.Resolve("db.example.com"))
+
+	// Cached during the refresh interval
+	resolver.addresses["db.example.com"] = []string{"10.0.0.3"}
+	assert.Equal(t, []string{"10.0.0.1", "10.0.0.2"}, r.Resolve("db.example.com"))
+	assert.Equal(t, 1, resolver.lookups)
+
+	now = now.Add(time.Minute)
+	assert.Equal(t, []string{"10.0.0.3"}, r.Resolve("db.example.com"))
+
+	// Previous addresses are kept on failures
+	delete(resolver.addresses, "db.example.com")
+	now = now.Add(time.Minute)
+	assert.Equal(t, []string{"10.0.0.3"}, r.Resolve("db.example.com"))
+
+	assert.Empty(t, r.Resolve("unknown.example.com"))
+}
+
+func TestExternalNameServices(t *testing.T) {
+	defer func(enabled bool) { externalNameServices = enabled }(externalNameServices)
+
+	service := &v1.Service{
+		ObjectMeta: meta_v1.ObjectMeta{
+			SelfLink:    "/service/db",
+			Name:        "db",
+			Namespace:   "test",
+			Annotations: map[string]string{BackendPortAnnotation: `{"mysql-admin": 33062}`},
+		},
+		Spec: v1.ServiceSpec{
+			Type:         v1.ServiceTypeExternalName,
+			ExternalName: "db.example.com",
+			Ports: []v1.ServicePort{
+				{Name: "mysql", Port: 3306},
+				{Name: "mysql-admin", Port: 33060},
+			},
+		},
+	}
+	client := newTestStoresClient(service)
+	client.externalNames = NewExternalNameResolver(&testResolver{addresses: map[string][]string{
+		"db.example.com": {"10.0.0.1", "10.0.0.2", "10.0.0.3"},
+	}}, time.Minute)
+
+	externalNameServices = false
+	services, err := client.getServices()
+	if assert.NoError(t, err) {
+		assert.Empty(t, services, "external name services shouldn't be included by default")
+	}
+
+	externalNameServices = true
+	services, err = client.getServices()
+	if assert.NoError(t, err) && assert.Equal(t, 2, len(services)) {
+		for i, expectedPort := range []int32{3306, 33062} {
+			assert.Equal(t, []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"}, endpointsIPs(services[i].Endpoints))
+			assert.Equal(t, expectedPort, services[i].BackendPort)
+			for _, e := range services[i].Endpoints {
+				assert.Equal(t, expectedPort, e.Port)
+				assert.True(t, e.Ready)
+			}
+		}
+	}
+}
+
+func TestExternalNameServerNames(t *testing.T) {
+	defer func(enabled bool, format string) {
+		externalNameServices, serverNameFormat = enabled, format
+	}(externalNameServices, serverNameFormat)
+	externalNameServices = true
+
+	service := &v1.Service{
+		ObjectMeta: meta_v1.ObjectMeta{SelfLink: "/service/db", Name: "db", Namespace: "test"},
+		Spec: v1.ServiceSpec{
+			Type:         v1.ServiceTypeExternalName,
+			ExternalName: "db.example.com",
+			Ports:        []v1.ServicePort{{Name: "mysql", Port: 3306}},
+		},
+	}
+	client := newTestStoresClient(service)
+	client.externalNames = NewExternalNameResolver(&testResolver{addresses: map[string][]string{
+		"db.example.com": {"10.0.0.1", "fd00::1"},
+	}}, time.Minute)
+
+	cases := []struct {
+		Format   string
+		Expected []string
+	}{
+		{ServerNameFormatName, []string{
+			"server db-example-com-10-0-0-1 10.0.0.1:3306",
+			"server db-example-com-fd00-0000-0000-0000-0000-0000-0000-0001 [fd00::1]:3306",
+		}},
+		{ServerNameFormatHostname, []string{
+			"server db-example-com-10-0-0-1 10.0.0.1:3306",
+			"server db-example-com-fd00-0000-0000-0000-0000-0000-0000-0001 [fd00::1]:3306",
+		}},
+		{ServerNameFormatIP, []string{
+			"server 10-0-0-1-3306 10.0.0.1:3306",
+			"server fd00-0000-0000-0000-0000-0000-0000-0001-3306 [fd00::1]:3306",
+		}},
+	}
+	for _, c := range cases {
+		serverNameFormat = c.Format
+		services, err := client.getServices()
+		if assert.NoError(t, err) && assert.Equal(t, 1, len(services)) {
+			assert.Equal(t, c.Expected, serverLines(services[0]), "server lines with format %s", c.Format)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+/*
+Copyright 2017 Tuenti Technologies S.L. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"log"
+	"os"
+	"sync"
+)
+
+// CreatedFiles keeps track of the files created by kube2lb, so they can be
+// removed on exit without touching files that already existed
+type CreatedFiles struct {
+	sync.Mutex
+	paths []string
+}
+
+// Open checks that the file can be written, creating it if it doesn't exist
+func (f *CreatedFiles) Open(path string) error {
+	_, err := os.Stat(path)
+	existed := err == nil
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	file.Close()
+
+	if !existed {
+		f.Lock()
+		f.paths = append(f.paths, path)
+		f.Unlock()
+	}
+	return nil
+}
+
+// Remove removes the files created by kube2lb
+func (f *CreatedFiles) Remove() {
+	f.Lock()
+	defer f.Unlock()
+	for _, path := range f.paths {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			log.Printf("Couldn't remove %s: %s", path, err)
+			continue
+		}
+		log.Printf("Removed %s", path)
+	}
+	f.paths = nil
+}
@@ -0,0 +1,61 @@
+/*
+Copyright 2017 Tuenti Technologies S.L. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestCreatedFilesRemove(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kube2lb-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	existing := path.Join(dir, "existing.cfg")
+	if err := ioutil.WriteFile(existing, []byte("existing"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	created := path.Join(dir, "created.cfg")
+
+	var files CreatedFiles
+	for _, p := range []string{existing, created} {
+		if err := files.Open(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := files.Open(path.Join(dir, "notexists", "created.cfg")); err == nil {
+		t.Error("Files in directories that don't exist cannot be opened")
+	}
+
+	// Generated content doesn't change which files were created
+	if err := ioutil.WriteFile(created, []byte("generated"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	files.Remove()
+	if _, err := os.Stat(created); !os.IsNotExist(err) {
+		t.Errorf("%s should have been removed", created)
+	}
+	if d, err := ioutil.ReadFile(existing); err != nil || string(d) != "existing" {
+		t.Errorf("%s shouldn't have been modified (%v)", existing, err)
+	}
+}
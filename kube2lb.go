@@ -22,19 +22,55 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"os/signal"
+	"syscall"
 )
 
 var version = "dev"
 
 func main() {
-	var apiserver, kubecfg, domain, configPath, templatePath, notify string
+	var apiserver, kubecfg, domain, configPath, configMap, configMapKey, configMapRollout, templatePath, partialsPath string
+	var notify notifyDefinitions
+	var leaderElect bool
+	var leaderElectLock, leaderElectIdentity string
+	var clusterID, clusters string
+	var canaryTemplatePath, canaryConfigPath string
+	var mapTemplatePath, mapPath string
+	var backendsPath string
+	var metricsAddress, adminAddress string
+	var adminPprof bool
+	var serializeNotify bool
+	var cleanupOnExit bool
+	var configLock, configLockWait bool
 	var showVersion bool
 	flag.StringVar(&apiserver, "apiserver", "", "Kubernetes API server URL")
-	flag.StringVar(&kubecfg, "kubecfg", "", "Path to kubernetes client configuration (Optional)")
-	flag.StringVar(&domain, "domain", "local", "DNS domain for the cluster")
+	flag.StringVar(&kubecfg, "kubeconfig", "", "Path to kubernetes client configuration (Optional)")
+	flag.StringVar(&kubecfg, "kubecfg", "", "Deprecated, use -kubeconfig")
+	flag.StringVar(&clusterID, "cluster-id", "", "Identifier of the cluster, used as prefix of its services names (Optional)")
+	flag.StringVar(&clusters, "clusters", "", "Comma-separated list of additional clusters to merge services from, as ID=KUBECONFIG (Optional)")
+	flag.StringVar(&domain, "domain", "", "DNS domain for the cluster, or comma-separated list of domains, the first one is the main one, detected from resolv.conf by default")
 	flag.StringVar(&configPath, "config", "", "Configuration path to generate")
+	flag.StringVar(&configMap, "config-map", "", "Config map to write generated configuration, as NAMESPACE/NAME (Optional)")
+	flag.StringVar(&configMapKey, "config-map-key", "config", "Key of the config map to write generated configuration")
+	flag.StringVar(&configMapRollout, "config-map-rollout-deployment", "", "Deployment in the namespace of the config map to roll out when it changes (Optional)")
+	flag.BoolVar(&configLock, "config-lock", false, "Hold a lock on a .lock file next to the configuration path, so other instances cannot write the same configuration")
+	flag.BoolVar(&configLockWait, "config-lock-wait", false, "Wait for the configuration lock if it is held by other instance, instead of exiting")
+	flag.BoolVar(&cleanupOnExit, "cleanup-on-exit", false, "Remove generated files on exit, if they didn't exist before starting")
 	flag.StringVar(&templatePath, "template", "", "Configuration source template")
-	flag.StringVar(&notify, "notify", "", "Notification configuration")
+	flag.StringVar(&canaryTemplatePath, "canary-template", "", "Alternative template to render on each update and compare with the configuration, without notifying (Optional)")
+	flag.StringVar(&canaryConfigPath, "canary-config", "", "Path to write the configuration generated with the canary template, configuration path with .canary suffix by default")
+	flag.StringVar(&mapTemplatePath, "map-template", "", "Template for a secondary map file, e.g. with server names and backends for nginx (Optional)")
+	flag.StringVar(&mapPath, "map-config", "", "Path to write the secondary map file generated with -map-template")
+	flag.StringVar(&backendsPath, "backends-config", "", "Path to write a JSON list of the backends of each service, for tools applying changes without reloads (Optional)")
+	flag.StringVar(&partialsPath, "template-partials", "", "Directory with .tmpl partial templates that can be included from the source template (Optional)")
+	flag.Var(&notify, "notify", "Notification configuration, it can be repeated to notify several processes")
+	flag.BoolVar(&serializeNotify, "serialize-notify", false, "Don't run notifications while other one is running, notifications requested meanwhile are coalesced in a single one")
+	flag.BoolVar(&leaderElect, "leader-elect", false, "Only update configuration while holding a leadership lease, for HA deployments")
+	flag.StringVar(&leaderElectLock, "leader-elect-lock", "kube-system/kube2lb", "Config map used to hold the leadership lease, as NAMESPACE/NAME")
+	flag.StringVar(&leaderElectIdentity, "leader-elect-identity", "", "Identity of this instance for leader election, hostname by default")
+	flag.StringVar(&metricsAddress, "metrics-address", "", "Address to serve metrics on /debug/vars, e.g. :8080 (Optional)")
+	flag.StringVar(&adminAddress, "admin-address", "", "Address to serve admin endpoints, POST /pause and /resume to suspend and resume updates, e.g. :8081 (Optional)")
+	flag.BoolVar(&adminPprof, "admin-pprof", false, "Serve profiling endpoints under /debug/pprof/ on the admin address")
 	flag.BoolVar(&showVersion, "version", false, "Show version")
 	flag.Parse()
 
@@ -47,33 +83,183 @@ func main() {
 		log.Fatalf("Template not defined or doesn't exist")
 	}
 
-	if notify == "" {
+	if partialsPath != "" {
+		if info, err := os.Stat(partialsPath); err != nil || !info.IsDir() {
+			log.Fatalf("Template partials directory doesn't exist")
+		}
+	}
+
+	if len(notify) == 0 {
 		log.Fatalf("Notifier cannot be empty")
 	}
 
-	if f, err := os.OpenFile(configPath, os.O_WRONLY|os.O_CREATE, 0644); err != nil {
-		log.Fatalf("Cannot open configuration file to write: %v", err)
-	} else {
-		f.Close()
+	if configPath == "" && configMap == "" {
+		log.Fatalf("Configuration path or config map must be defined")
+	}
+
+	if canaryTemplatePath != "" {
+		if _, err := os.Stat(canaryTemplatePath); err != nil {
+			log.Fatalf("Canary template doesn't exist")
+		}
+		if configPath == "" {
+			log.Fatalf("Configuration path must be defined to use a canary template")
+		}
+		if canaryConfigPath == "" {
+			canaryConfigPath = configPath + ".canary"
+		}
+	}
+
+	if (mapTemplatePath == "") != (mapPath == "") {
+		log.Fatalf("Both map template and map path must be defined to generate a map file")
+	}
+	if mapTemplatePath != "" {
+		if _, err := os.Stat(mapTemplatePath); err != nil {
+			log.Fatalf("Map template doesn't exist")
+		}
+	}
+
+	if configMapRollout != "" && configMap == "" {
+		log.Fatalf("Config map must be defined to roll out deployments")
+	}
+
+	if verifyURL != "" {
+		if err := validateVerifyTimeout(verifyTimeout, updateTimeoutDuration()); err != nil {
+			log.Fatalf("Invalid verification: %s", err)
+		}
 	}
 
-	notifier, err := NewNotifier(notify)
+	if configPath != "" && configLock {
+		if configLockWait {
+			log.Printf("Waiting for lock on %s", lockPath(configPath))
+		}
+		lock, err := LockFile(lockPath(configPath), configLockWait)
+		if err != nil {
+			log.Fatalf("Couldn't lock configuration file: %v", err)
+		}
+		defer lock.Unlock()
+	}
+
+	var createdFiles CreatedFiles
+	if configPath != "" {
+		if err := createdFiles.Open(configPath); err != nil {
+			log.Fatalf("Cannot open configuration file to write: %v", err)
+		}
+	}
+	if mapPath != "" {
+		if err := createdFiles.Open(mapPath); err != nil {
+			log.Fatalf("Cannot open map file to write: %v", err)
+		}
+	}
+
+	if backendsPath != "" {
+		if err := createdFiles.Open(backendsPath); err != nil {
+			log.Fatalf("Cannot open backends file to write: %v", err)
+		}
+	}
+
+	if cleanupOnExit {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+		go func() {
+			s := <-signals
+			log.Printf("Received %s, removing created files", s)
+			createdFiles.Remove()
+			os.Exit(0)
+		}()
+	}
+
+	notifier, err := NewNotifiers(notify)
 	if err != nil {
 		log.Fatalf("Couldn't initialize notifier: %s", err)
 	}
+	if s, ok := notifier.(ConfigPathSetter); ok {
+		s.SetConfigPath(configPath)
+	}
+
+	if domain == "" {
+		domain = detectClusterDomain()
+	}
 
 	client, err := NewKubernetesClient(kubecfg, apiserver, domain)
 	if err != nil {
 		log.Fatalf("Couldn't connect with Kubernetes API server: %s", err)
 	}
 
+	client.SetCluster(clusterID)
+
+	tracer, err := NewTracerFromFlags()
+	if err != nil {
+		log.Fatalf("Couldn't initialize tracing: %s", err)
+	}
+	client.SetTracer(tracer)
+
+	clusterConfigs, err := ParseClusters(clusters)
+	if err != nil {
+		log.Fatalf("Couldn't parse clusters: %s", err)
+	}
+	for id, clusterConfig := range clusterConfigs {
+		cluster, err := NewKubernetesClient(clusterConfig, "", domain)
+		if err != nil {
+			log.Fatalf("Couldn't connect with Kubernetes API server of cluster %s: %s", id, err)
+		}
+		if err := client.AddCluster(id, cluster); err != nil {
+			log.Fatalf("Couldn't add cluster %s: %s", id, err)
+		}
+	}
+
+	if leaderElect {
+		if leaderElectIdentity == "" {
+			if leaderElectIdentity, err = os.Hostname(); err != nil {
+				log.Fatalf("Couldn't obtain identity for leader election: %s", err)
+			}
+		}
+		if err := client.EnableLeaderElection(leaderElectLock, leaderElectIdentity); err != nil {
+			log.Fatalf("Couldn't initialize leader election: %s", err)
+		}
+	}
+
+	if adminPprof && adminAddress == "" {
+		log.Fatalf("Admin address must be defined to serve profiling endpoints")
+	}
+
+	if adminAddress != "" {
+		pauser := NewPauser()
+		client.EnablePause(pauser)
+		go ServeAdmin(adminAddress, pauser, adminPprof)
+	}
+
 	if err := initServerNameTemplates(); err != nil {
 		log.Fatalf("Couldn't initialize server name templates: %s", err)
 	}
 
-	client.AddTemplate(NewTemplate(templatePath, configPath))
+	if configPath != "" {
+		client.AddTemplate(NewTemplate(templatePath, configPath, partialsPath))
+		if canaryTemplatePath != "" {
+			client.AddTemplate(NewCanaryTemplate(canaryTemplatePath, canaryConfigPath, partialsPath, configPath))
+		}
+	}
+	if mapPath != "" {
+		client.AddTemplate(NewTemplate(mapTemplatePath, mapPath, partialsPath))
+	}
+	if backendsPath != "" {
+		client.AddTemplate(NewBackendsFile(backendsPath))
+	}
+	if configMap != "" {
+		t, err := client.NewConfigMapTemplate(templatePath, partialsPath, configMap, configMapKey, configMapRollout)
+		if err != nil {
+			log.Fatalf("Couldn't initialize config map output: %s", err)
+		}
+		client.AddTemplate(t)
+	}
+	if serializeNotify {
+		notifier = NewSerialNotifier(notifier)
+	}
 	client.AddNotifier(notifier)
 
+	if metricsAddress != "" {
+		go ServeMetrics(metricsAddress)
+	}
+
 	if err := client.Watch(context.Background()); err != nil {
 		log.Fatalf("Couldn't watch Kubernetes API server: %s", err)
 	}
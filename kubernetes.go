@@ -23,7 +23,12 @@ import (
 	"fmt"
 	"log"
 	"net"
+	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"k8s.io/apimachinery/pkg/api/meta"
@@ -40,11 +45,33 @@ import (
 var defaultLBIP = net.IPv4zero.String()
 var defaultPortMode = "http"
 var reconnectTimeoutSeconds = 300
+var defaultBalance = "roundrobin"
+var defaultDrainTimeout time.Duration
+var kubeAPIQPS = float64(rest.DefaultQPS)
+var kubeAPIBurst = rest.DefaultBurst
+var failOnEmpty = false
+var defaultCookieMode = "insert indirect"
+var defaultMinEndpoints = 0
+var honorLocalTrafficPolicy = true
+var defaultRetries = 0
+var watchNamespace = api.NamespaceAll
+var renderConcurrency = 1
 
 func init() {
 	flag.StringVar(&defaultLBIP, "default-lb-ip", defaultLBIP, "Default IP for services in load balancer, can be overriden by loadBalancerIP service field")
 	flag.StringVar(&defaultPortMode, "default-port-mode", defaultPortMode, "Default mode for service ports")
+	flag.StringVar(&defaultBalance, "default-balance", defaultBalance, "Default balance algorithm for service backends")
+	flag.DurationVar(&defaultDrainTimeout, "default-drain-timeout", defaultDrainTimeout, "Default drain timeout for service backends")
 	flag.IntVar(&reconnectTimeoutSeconds, "reconnect-timeout", reconnectTimeoutSeconds, "Reconnect timeout in seconds")
+	flag.Float64Var(&kubeAPIQPS, "kube-api-qps", kubeAPIQPS, "Maximum queries per second to the Kubernetes API server")
+	flag.IntVar(&kubeAPIBurst, "kube-api-burst", kubeAPIBurst, "Maximum burst of queries to the Kubernetes API server")
+	flag.StringVar(&defaultCookieMode, "default-cookie-mode", defaultCookieMode, "Default mode for stickiness cookies")
+	flag.IntVar(&defaultRetries, "default-retries", defaultRetries, "Default number of retries for service backends, 0 to not set them")
+	flag.IntVar(&defaultMinEndpoints, "default-min-endpoints", defaultMinEndpoints, "Default minimum number of ready endpoints before including a service port in the configuration")
+	flag.BoolVar(&honorLocalTrafficPolicy, "honor-local-traffic-policy", honorLocalTrafficPolicy, "Only consider nodes with ready endpoints for node ports of services with Local external traffic policy")
+	flag.StringVar(&watchNamespace, "namespace", watchNamespace, "Only watch services, endpoints and pods in this namespace, all namespaces are watched by default")
+	flag.IntVar(&renderConcurrency, "render-concurrency", renderConcurrency, "Maximum number of templates rendered concurrently on each update")
+	flag.BoolVar(&failOnEmpty, "fail-on-empty", failOnEmpty, "Fail on first update if no services are found, instead of generating an empty configuration")
 }
 
 type KubernetesClient struct {
@@ -53,14 +80,48 @@ type KubernetesClient struct {
 
 	nodeStore      NodeStore
 	serviceStore   ServiceStore
-	endpointsStore EndpointsStore
+	endpointsStore EndpointsLister
+
+	// Only used with -ready-annotation
+	podStore *PodStore
+
+	// Only used with -service-settings-config-map
+	settingsStore *ServiceSettingsStore
+
+	// Held to replace the stores, and to read them from other goroutines
+	storesLock sync.RWMutex
 
 	nodeWatcher      watch.Interface
 	serviceWatcher   watch.Interface
 	endpointsWatcher watch.Interface
+	podWatcher       watch.Interface
+	settingsWatcher  watch.Interface
 
 	lastResourceVersion string
 
+	// Cluster information of the last notification
+	lastNotifiedInfo *ClusterInformation
+
+	externalNames *ExternalNameResolver
+
+	// Set after the first execution of templates
+	rendered bool
+
+	// Service ports that have reached their minimum number of endpoints
+	warmedUp map[string]bool
+
+	// Endpoints seen by service port, to keep them during the remove grace period
+	seenEndpoints map[string]map[string]seenEndpoint
+
+	// Replaced in tests
+	now func() time.Time
+
+	tracer *Tracer
+
+	// Identifier of the cluster, and additional clusters merged with this one
+	cluster  string
+	clusters []*KubernetesClient
+
 	updaterBuilder UpdaterBuilder
 	eventForwarder func(watch.Event)
 
@@ -74,10 +135,72 @@ const (
 	ExternalDomainsAnnotation = "kube2lb/external-domains"
 	PortModeAnnotation        = "kube2lb/port-mode"
 	BackendTimeoutAnnotation  = "kube2lb/backend-timeout"
+	AllowedCIDRsAnnotation    = "kube2lb/allowed-cidrs"
+	BackendOptionsAnnotation  = "kube2lb/backend-options"
+	BackendPortAnnotation     = "kube2lb/backend-port"
+	SNIHostsAnnotation        = "kube2lb/sni-hosts"
+	BalanceAnnotation         = "kube2lb/balance"
+	DrainTimeoutAnnotation    = "kube2lb/drain-timeout"
+	CookieAnnotation          = "kube2lb/cookie"
+	CookieModeAnnotation      = "kube2lb/cookie-mode"
+	RateLimitAnnotation       = "kube2lb/rate-limit"
+	MinEndpointsAnnotation    = "kube2lb/min-endpoints"
+	TimeoutsAnnotation        = "kube2lb/timeouts"
+	EndpointsOrderAnnotation  = "kube2lb/endpoints-order"
+	BackendTLSAnnotation      = "kube2lb/backend-tls"
+	BackendVerifyAnnotation   = "kube2lb/backend-tls-verify"
+	BackendCAAnnotation       = "kube2lb/backend-tls-ca"
+	BindOptionsAnnotation     = "kube2lb/bind-options"
+	HealthStatusAnnotation    = "kube2lb/health-check-status"
+	RetriesAnnotation         = "kube2lb/retries"
+	RedirectAnnotation        = "kube2lb/redirect"
+	RedirectTargetAnnotation  = "kube2lb/redirect-target"
+	RedirectCodeAnnotation    = "kube2lb/redirect-code"
+	ExcludePortsAnnotation    = "kube2lb/exclude-ports"
+	DefaultServerAnnotation   = "kube2lb/default-server"
+	HTTP2Annotation           = "kube2lb/http2"
+	ALPNAnnotation            = "kube2lb/alpn"
+	WeightAnnotation          = "kube2lb/weight"
+	UnixSocketsAnnotation     = "kube2lb/unix-sockets"
+	AgentCheckAnnotation      = "kube2lb/agent-check"
 )
 
+// Replaced in tests
+var inClusterConfig = rest.InClusterConfig
+
+func buildConfig(kubecfg, apiserver string) (*rest.Config, error) {
+	config, err := selectConfig(kubecfg, apiserver)
+	if err != nil {
+		return nil, err
+	}
+	config.QPS = float32(kubeAPIQPS)
+	config.Burst = kubeAPIBurst
+	wrapRetryTransport(config, kubeAPIRetries, kubeAPIRetryMaxWait)
+	return config, nil
+}
+
+// selectConfig selects the client configuration, explicit kubeconfig or API
+// server take precedence, then in-cluster configuration is used if available,
+// and default kubeconfig locations are used otherwise
+func selectConfig(kubecfg, apiserver string) (*rest.Config, error) {
+	if kubecfg != "" || apiserver != "" {
+		return clientcmd.BuildConfigFromFlags(apiserver, kubecfg)
+	}
+
+	config, err := inClusterConfig()
+	if err == nil {
+		log.Printf("Using in-cluster configuration")
+		return config, nil
+	}
+	log.Printf("In-cluster configuration not available, using default kubeconfig: %s", err)
+
+	return clientcmd.NewNonInteractiveDeferredLoadingClientConfig(
+		clientcmd.NewDefaultClientConfigLoadingRules(),
+		&clientcmd.ConfigOverrides{}).ClientConfig()
+}
+
 func NewKubernetesClient(kubecfg, apiserver, domain string) (*KubernetesClient, error) {
-	config, err := clientcmd.BuildConfigFromFlags(apiserver, kubecfg)
+	config, err := buildConfig(kubecfg, apiserver)
 	if err != nil {
 		return nil, err
 	}
@@ -121,13 +244,42 @@ func (c *KubernetesClient) connect() (err error) {
 		return fmt.Errorf("couldn't watch events on nodes: %v", err)
 	}
 
-	si := c.clientset.Core().Services(api.NamespaceAll)
+	si := c.clientset.Core().Services(watchNamespace)
 	c.serviceWatcher, err = si.Watch(options)
 	if err != nil {
 		return fmt.Errorf("couldn't watch events on services: %v", err)
 	}
 
-	ei := c.clientset.Core().Endpoints(api.NamespaceAll)
+	if readyAnnotation != "" {
+		pi := c.clientset.Core().Pods(watchNamespace)
+		c.podWatcher, err = pi.Watch(options)
+		if err != nil {
+			return fmt.Errorf("couldn't watch events on pods: %v", err)
+		}
+	}
+
+	if serviceSettingsConfigMap != "" {
+		namespace, name, err := parseNamespacedName(serviceSettingsConfigMap)
+		if err != nil {
+			return err
+		}
+		settingsOptions := options
+		settingsOptions.FieldSelector = "metadata.name=" + name
+		c.settingsWatcher, err = c.clientset.Core().ConfigMaps(namespace).Watch(settingsOptions)
+		if err != nil {
+			return fmt.Errorf("couldn't watch events on service settings: %v", err)
+		}
+	}
+
+	if useEndpointSlices {
+		c.endpointsWatcher, err = watchEndpointSlices(c.clientset.Core().RESTClient(), watchNamespace, options)
+		if err != nil {
+			return fmt.Errorf("couldn't watch events on endpoint slices: %v", err)
+		}
+		return
+	}
+
+	ei := c.clientset.Core().Endpoints(watchNamespace)
 	c.endpointsWatcher, err = ei.Watch(options)
 	if err != nil {
 		return fmt.Errorf("couldn't watch events on endpoints: %v", err)
@@ -145,15 +297,43 @@ func (c *KubernetesClient) stopWatchers() {
 	if c.endpointsWatcher != nil {
 		c.endpointsWatcher.Stop()
 	}
+	if c.podWatcher != nil {
+		c.podWatcher.Stop()
+	}
+	if c.settingsWatcher != nil {
+		c.settingsWatcher.Stop()
+	}
+}
+
+// resultChan returns the channel of events of the watcher, or nil, that
+// blocks forever, if there is no watcher
+func resultChan(w watch.Interface) <-chan watch.Event {
+	if w == nil {
+		return nil
+	}
+	return w.ResultChan()
+}
+
+// SetTracer sets the tracer used to trace updates, they are not traced if nil
+func (c *KubernetesClient) SetTracer(t *Tracer) {
+	c.tracer = t
 }
 
 func (c *KubernetesClient) AddNotifier(n Notifier) {
 	c.notifiers = append(c.notifiers, n)
 }
 
-func (c *KubernetesClient) Notify(ctx context.Context) {
+// Notify notifies all notifiers, the ones implementing ChangesNotifier also
+// receive the changes since the last notification
+func (c *KubernetesClient) Notify(ctx context.Context, changes ClusterChanges) {
 	for _, n := range c.notifiers {
-		if err := n.Notify(ctx); err != nil {
+		var err error
+		if cn, ok := n.(ChangesNotifier); ok {
+			err = cn.NotifyChanges(ctx, changes)
+		} else {
+			err = n.Notify(ctx)
+		}
+		if err != nil {
 			log.Printf("Couldn't notify: %s", err)
 		}
 	}
@@ -163,12 +343,153 @@ func (c *KubernetesClient) AddTemplate(t Template) {
 	c.templates = append(c.templates, t)
 }
 
-func (c *KubernetesClient) ExecuteTemplates(info *ClusterInformation) {
+// ExecuteTemplates executes the templates, up to -render-concurrency at the
+// same time, templates implementing orderedTemplate are executed after all the
+// templates added before them. It returns true if the output of any template
+// has changed, rendering metrics are only recorded if all templates succeed
+func (c *KubernetesClient) ExecuteTemplates(info *ClusterInformation) bool {
+	concurrency := renderConcurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	workers := make(chan struct{}, concurrency)
+	changed, failed := false, false
 	for _, t := range c.templates {
-		if err := t.Execute(info); err != nil {
-			log.Printf("Couldn't write template: %s", err)
+		if _, ok := t.(orderedTemplate); ok {
+			wg.Wait()
+		}
+		workers <- struct{}{}
+		wg.Add(1)
+		go func(t Template) {
+			defer func() {
+				<-workers
+				wg.Done()
+			}()
+			templateChanged, err := t.Execute(info)
+			if err != nil {
+				log.Printf("Couldn't write template: %s", err)
+			}
+			lock.Lock()
+			changed = changed || templateChanged
+			failed = failed || err != nil
+			lock.Unlock()
+		}(t)
+	}
+	wg.Wait()
+
+	if !failed {
+		recordRenderedInformation(info)
+		for _, t := range c.templates {
+			if s, ok := t.(sizedTemplate); ok {
+				recordConfigSize(s.renderedSize())
+			}
+		}
+	}
+	return changed
+}
+
+// portTimeouts returns the timeouts for a port, timeouts not set for the port
+// are taken from the ones set for all ports with "*", the server timeout
+// falls back to the backend timeout
+func portTimeouts(timeouts map[string]Timeouts, port string, backendTimeout int) Timeouts {
+	t := timeouts[port]
+	all := timeouts["*"]
+	if t.Connect <= 0 {
+		t.Connect = all.Connect
+	}
+	if t.Client <= 0 {
+		t.Client = all.Client
+	}
+	if t.Server <= 0 {
+		t.Server = all.Server
+	}
+	if t.Server <= 0 {
+		t.Server = backendTimeout
+	}
+	if t.Queue <= 0 {
+		t.Queue = all.Queue
+	}
+	return t
+}
+
+func warmUpKey(s *v1.Service, port v1.ServicePort) string {
+	return fmt.Sprintf("%s/%s:%d", s.Namespace, s.Name, port.Port)
+}
+
+// warmUp returns true if a service port can be included in the
+// configuration, ports are included once they reach the minimum number of
+// ready endpoints, and excluded again if they lose all of them
+func (c *KubernetesClient) warmUp(key string, ready, min int) bool {
+	if c.warmedUp == nil {
+		c.warmedUp = make(map[string]bool)
+	}
+	switch {
+	case ready == 0 && min > 0:
+		delete(c.warmedUp, key)
+		return false
+	case ready >= min:
+		c.warmedUp[key] = true
+		return true
+	}
+	return c.warmedUp[key]
+}
+
+type seenEndpoint struct {
+	endpoint ServiceEndpoint
+	lastSeen time.Time
+}
+
+// endpointsWithGrace returns the endpoints of a service port adding, as
+// draining, the ones removed during the remove grace period
+func (c *KubernetesClient) endpointsWithGrace(key string, endpoints []ServiceEndpoint) []ServiceEndpoint {
+	if endpointRemoveGrace <= 0 {
+		return endpoints
+	}
+	if c.seenEndpoints == nil {
+		c.seenEndpoints = make(map[string]map[string]seenEndpoint)
+	}
+	if c.now == nil {
+		c.now = time.Now
+	}
+	now := c.now()
+
+	seen, found := c.seenEndpoints[key]
+	if !found {
+		seen = make(map[string]seenEndpoint)
+		c.seenEndpoints[key] = seen
+	}
+	current := make(map[string]bool)
+	for _, e := range endpoints {
+		current[e.String()] = true
+		seen[e.String()] = seenEndpoint{endpoint: e, lastSeen: now}
+	}
+
+	var draining []ServiceEndpoint
+	for k, s := range seen {
+		if current[k] {
+			continue
+		}
+		if now.Sub(s.lastSeen) > endpointRemoveGrace {
+			delete(seen, k)
+			continue
 		}
+		e := s.endpoint
+		e.Draining = true
+		draining = append(draining, e)
+	}
+	if len(seen) == 0 {
+		delete(c.seenEndpoints, key)
 	}
+	if len(draining) == 0 {
+		return endpoints
+	}
+	sort.Slice(draining, func(i, j int) bool {
+		return draining[i].String() < draining[j].String()
+	})
+	return append(append([]ServiceEndpoint(nil), endpoints...), draining...)
 }
 
 func (c *KubernetesClient) readAnnotation(meta meta_v1.ObjectMeta, annotation string, value interface{}) {
@@ -181,7 +502,84 @@ func (c *KubernetesClient) readAnnotation(meta meta_v1.ObjectMeta, annotation st
 	}
 }
 
+func (c *KubernetesClient) readCIDRs(s *v1.Service, cidrs []string) []string {
+	var valid []string
+	for _, cidr := range cidrs {
+		cidr = strings.TrimSpace(cidr)
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			log.Printf("Ignoring invalid CIDR '%s' for %s service in %s: %s", cidr, s.Name, s.Namespace, err)
+			continue
+		}
+		valid = append(valid, cidr)
+	}
+	return valid
+}
+
+// portsSet contains names or numbers of service ports
+type portsSet []string
+
+// Contains returns true if the port is in the set, by name or by number
+func (p portsSet) Contains(port v1.ServicePort) bool {
+	for _, excluded := range p {
+		if excluded == port.Name || excluded == strconv.Itoa(int(port.Port)) {
+			return true
+		}
+	}
+	return false
+}
+
+// readExternalNames returns the valid server names of the external domains
+// annotation, invalid ones could inject arbitrary content in configurations
+func (c *KubernetesClient) readExternalNames(s *v1.Service) []string {
+	var valid []string
+	for _, name := range c.readList(s.ObjectMeta, ExternalDomainsAnnotation, ",") {
+		if err := validateServerName(name); err != nil {
+			log.Printf("Ignoring invalid external domain '%s' for %s service in %s: %s", name, s.Name, s.Namespace, err)
+			continue
+		}
+		valid = append(valid, name)
+	}
+	return valid
+}
+
+func (c *KubernetesClient) readList(meta meta_v1.ObjectMeta, annotation, separator string) []string {
+	var items []string
+	for _, item := range strings.Split(meta.Annotations[annotation], separator) {
+		item = strings.TrimSpace(item)
+		if len(item) > 0 {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+var balanceAlgorithms = map[string]bool{
+	"roundrobin": true,
+	"static-rr":  true,
+	"leastconn":  true,
+	"first":      true,
+	"source":     true,
+	"uri":        true,
+	"url_param":  true,
+	"hdr":        true,
+	"random":     true,
+	"rdp-cookie": true,
+}
+
+// validBalance checks if the name of the algorithm is known, arguments
+// as in "hdr(host)" or "url_param userid" are not validated
+func validBalance(balance string) bool {
+	name := strings.TrimSpace(balance)
+	if i := strings.IndexAny(name, "( "); i >= 0 {
+		name = name[:i]
+	}
+	return balanceAlgorithms[name]
+}
+
 func (c *KubernetesClient) getServices() ([]ServiceInformation, error) {
+	c.storesLock.RLock()
+	defer c.storesLock.RUnlock()
+
 	services, err := c.serviceStore.List()
 	if err != nil {
 		return nil, fmt.Errorf("couldn't get services: %s", err)
@@ -192,13 +590,159 @@ func (c *KubernetesClient) getServices() ([]ServiceInformation, error) {
 		return nil, fmt.Errorf("couldn't get endpoints: %s", err)
 	}
 
+	if readyAnnotation != "" && c.podStore != nil {
+		readyPods, err := c.podStore.ReadyPods(readyAnnotation)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't get pods: %s", err)
+		}
+		endpoints = readyGateEndpoints(endpoints, readyPods)
+	}
+
 	endpointsHelper := NewEndpointsHelper(endpoints)
 
+	var settings map[string]map[string]string
+	if c.settingsStore != nil {
+		if settings, err = c.settingsStore.Settings(); err != nil {
+			return nil, fmt.Errorf("couldn't get service settings: %s", err)
+		}
+	}
+
 	servicesInformation := make([]ServiceInformation, 0, len(services))
 	for _, s := range services {
-		var external []string
-		if domains, ok := s.ObjectMeta.Annotations[ExternalDomainsAnnotation]; ok && len(domains) > 0 {
-			external = strings.Split(domains, ",")
+		s = withSettings(s, settings)
+		external := c.readExternalNames(s)
+
+		var allowedCIDRs []string
+		if cidrs, ok := s.ObjectMeta.Annotations[AllowedCIDRsAnnotation]; ok && len(cidrs) > 0 {
+			allowedCIDRs = c.readCIDRs(s, strings.Split(cidrs, ","))
+		}
+
+		backendOptions := c.readList(s.ObjectMeta, BackendOptionsAnnotation, "\n")
+		sniHosts := c.readList(s.ObjectMeta, SNIHostsAnnotation, ",")
+		bindOptions := c.readList(s.ObjectMeta, BindOptionsAnnotation, "\n")
+		excludedPorts := portsSet(c.readList(s.ObjectMeta, ExcludePortsAnnotation, ","))
+
+		balance := defaultBalance
+		if b, ok := s.ObjectMeta.Annotations[BalanceAnnotation]; ok && len(b) > 0 {
+			if validBalance(b) {
+				balance = strings.TrimSpace(b)
+			} else {
+				log.Printf("Ignoring unknown balance algorithm '%s' for %s service in %s", b, s.Name, s.Namespace)
+			}
+		}
+
+		endpointsOrder := defaultEndpointsOrder
+		if o, ok := s.ObjectMeta.Annotations[EndpointsOrderAnnotation]; ok && len(o) > 0 {
+			if validEndpointsOrder(strings.TrimSpace(o)) {
+				endpointsOrder = strings.TrimSpace(o)
+			} else {
+				log.Printf("Ignoring unknown endpoints order '%s' for %s service in %s", o, s.Name, s.Namespace)
+			}
+		}
+
+		var cookie *CookieSpec
+		if name, ok := s.ObjectMeta.Annotations[CookieAnnotation]; ok && len(strings.TrimSpace(name)) > 0 {
+			cookie = &CookieSpec{Name: strings.TrimSpace(name), Mode: defaultCookieMode}
+			if mode, ok := s.ObjectMeta.Annotations[CookieModeAnnotation]; ok && len(strings.TrimSpace(mode)) > 0 {
+				cookie.Mode = strings.TrimSpace(mode)
+			}
+		}
+
+		backendTLS := c.backendTLS(s)
+		http2, alpn := c.alpn(s)
+
+		var healthCheck *HealthCheck
+		if status, ok := s.ObjectMeta.Annotations[HealthStatusAnnotation]; ok && len(status) > 0 {
+			if expected, err := parseStatusRange(status); err != nil {
+				log.Printf("Ignoring invalid health check status '%s' for %s service in %s: %s", status, s.Name, s.Namespace, err)
+			} else {
+				healthCheck = &HealthCheck{ExpectStatus: expected}
+			}
+		}
+
+		redirect := c.redirect(s)
+
+		var resourceVersion string
+		if emitSourceComments {
+			resourceVersion = s.ResourceVersion
+		}
+
+		var defaultServer *DefaultServer
+		c.readAnnotation(s.ObjectMeta, DefaultServerAnnotation, &defaultServer)
+		if defaultServer != nil {
+			if defaultServer.Inter < 0 || defaultServer.Rise < 0 || defaultServer.Fall < 0 {
+				log.Printf("Ignoring invalid default server options '%s' for %s service in %s: negative values", s.ObjectMeta.Annotations[DefaultServerAnnotation], s.Name, s.Namespace)
+				defaultServer = nil
+			} else if defaultServer.Options() == "" {
+				defaultServer = nil
+			}
+		}
+
+		var agentCheck *AgentCheck
+		c.readAnnotation(s.ObjectMeta, AgentCheckAnnotation, &agentCheck)
+		if agentCheck != nil {
+			var err error
+			if agentCheck.Port <= 0 || agentCheck.Port > 65535 {
+				err = fmt.Errorf("port must be between 1 and 65535")
+			} else if agentCheck.Interval < 0 {
+				err = fmt.Errorf("interval cannot be negative")
+			}
+			if err != nil {
+				log.Printf("Ignoring invalid agent check '%s' for %s service in %s: %s", s.ObjectMeta.Annotations[AgentCheckAnnotation], s.Name, s.Namespace, err)
+				agentCheck = nil
+			}
+		}
+
+		var rateLimit int
+		if l, ok := s.ObjectMeta.Annotations[RateLimitAnnotation]; ok && len(l) > 0 {
+			limit, err := strconv.Atoi(strings.TrimSpace(l))
+			if err == nil && limit <= 0 {
+				err = fmt.Errorf("it must be positive")
+			}
+			if err != nil {
+				log.Printf("Ignoring invalid rate limit '%s' for %s service in %s: %s", l, s.Name, s.Namespace, err)
+			} else {
+				rateLimit = limit
+			}
+		}
+
+		weight, weighted := 1, false
+		if w, ok := s.ObjectMeta.Annotations[WeightAnnotation]; ok && len(w) > 0 {
+			n, err := strconv.Atoi(strings.TrimSpace(w))
+			if err == nil && (n < 0 || n > 256) {
+				err = fmt.Errorf("it must be between 0 and 256")
+			}
+			if err != nil {
+				log.Printf("Ignoring invalid weight '%s' for %s service in %s: %s", w, s.Name, s.Namespace, err)
+			} else {
+				weight, weighted = n, true
+			}
+		}
+
+		retries := defaultRetries
+		if r, ok := s.ObjectMeta.Annotations[RetriesAnnotation]; ok && len(r) > 0 {
+			n, err := strconv.Atoi(strings.TrimSpace(r))
+			if err != nil {
+				log.Printf("Ignoring invalid retries '%s' for %s service in %s: %s", r, s.Name, s.Namespace, err)
+			} else {
+				retries = n
+			}
+		}
+		if retries < 0 {
+			retries = 0
+		}
+
+		minEndpoints := defaultMinEndpoints
+		if m, ok := s.ObjectMeta.Annotations[MinEndpointsAnnotation]; ok && len(m) > 0 {
+			n, err := strconv.Atoi(strings.TrimSpace(m))
+			if err == nil && n < 0 {
+				err = fmt.Errorf("it cannot be negative")
+			}
+			if err != nil {
+				log.Printf("Ignoring invalid minimum endpoints '%s' for %s service in %s: %s", m, s.Name, s.Namespace, err)
+			} else {
+				minEndpoints = n
+			}
 		}
 
 		var portModes map[string]string
@@ -207,11 +751,42 @@ func (c *KubernetesClient) getServices() ([]ServiceInformation, error) {
 		var backendTimeouts map[string]int
 		c.readAnnotation(s.ObjectMeta, BackendTimeoutAnnotation, &backendTimeouts)
 
+		var backendPorts map[string]int32
+		c.readAnnotation(s.ObjectMeta, BackendPortAnnotation, &backendPorts)
+
+		var timeouts map[string]Timeouts
+		c.readAnnotation(s.ObjectMeta, TimeoutsAnnotation, &timeouts)
+
+		var unixSockets map[string]string
+		c.readAnnotation(s.ObjectMeta, UnixSocketsAnnotation, &unixSockets)
+		for name, path := range unixSockets {
+			if !filepath.IsAbs(path) {
+				log.Printf("Ignoring invalid unix socket '%s' for %s port of %s service in %s: it must be an absolute path", path, name, s.Name, s.Namespace)
+				delete(unixSockets, name)
+			}
+		}
+
+		drainTimeout := defaultDrainTimeout
+		if t, ok := s.ObjectMeta.Annotations[DrainTimeoutAnnotation]; ok && len(t) > 0 {
+			d, err := time.ParseDuration(strings.TrimSpace(t))
+			if err == nil && d < 0 {
+				err = fmt.Errorf("negative duration")
+			}
+			if err != nil {
+				log.Printf("Ignoring invalid drain timeout '%s' for %s service in %s: %s", t, s.Name, s.Namespace, err)
+			} else {
+				drainTimeout = d
+			}
+		}
+
 		switch s.Spec.Type {
 		case v1.ServiceTypeNodePort, v1.ServiceTypeLoadBalancer:
 			endpointsPortsMap := endpointsHelper.ServicePortsMap(s)
 			if len(endpointsPortsMap) == 0 {
 				log.Printf("Couldn't find endpoints for %s in %s?", s.Name, s.Namespace)
+				for _, port := range s.Spec.Ports {
+					c.warmUp(warmUpKey(s, port), 0, minEndpoints)
+				}
 				continue
 			}
 
@@ -226,7 +801,15 @@ func (c *KubernetesClient) getServices() ([]ServiceInformation, error) {
 				parsedLBIP = net.ParseIP(s.Spec.LoadBalancerIP)
 			}
 
+			// As in Kubernetes, source ranges in the spec take precedence over annotations
+			if s.Spec.Type == v1.ServiceTypeLoadBalancer && len(s.Spec.LoadBalancerSourceRanges) > 0 {
+				allowedCIDRs = c.readCIDRs(s, s.Spec.LoadBalancerSourceRanges)
+			}
+
 			for _, port := range s.Spec.Ports {
+				if excludedPorts.Contains(port) {
+					continue
+				}
 				mode, ok := portModes[port.Name]
 				if !ok {
 					mode = defaultPortMode
@@ -235,6 +818,33 @@ func (c *KubernetesClient) getServices() ([]ServiceInformation, error) {
 				if !ok {
 					timeout = 0
 				}
+				serviceTimeouts := portTimeouts(timeouts, port.Name, timeout)
+				serviceEndpoints, notReadyEndpoints := endpointsHelper.ServicePortEndpoints(s, port)
+				if !c.warmUp(warmUpKey(s, port), len(serviceEndpoints), minEndpoints) {
+					log.Printf("Skipping %s port of %s service in %s, %d ready endpoints of %d required", port.Name, s.Name, s.Namespace, len(serviceEndpoints), minEndpoints)
+					continue
+				}
+				backendPort, ok := backendPorts[port.Name]
+				if ok && (backendPort <= 0 || backendPort > 65535) {
+					log.Printf("Ignoring invalid backend port %d for %s port of %s service in %s", backendPort, port.Name, s.Name, s.Namespace)
+					ok = false
+				}
+				if ok {
+					serviceEndpoints = endpointsWithPort(serviceEndpoints, backendPort)
+					notReadyEndpoints = endpointsWithPort(notReadyEndpoints, backendPort)
+				} else {
+					backendPort = port.Port
+				}
+				serviceEndpoints = c.endpointsWithGrace(warmUpKey(s, port), serviceEndpoints)
+				serviceEndpoints = limitEndpoints(warmUpKey(s, port), serviceEndpoints, maxEndpointsPerService)
+				sortEndpoints(serviceEndpoints, endpointsOrder)
+				sortEndpoints(notReadyEndpoints, endpointsOrder)
+				uniqueServerNames(serviceEndpoints, notReadyEndpoints)
+				localTraffic := honorLocalTrafficPolicy && s.Spec.ExternalTrafficPolicy == v1.ServiceExternalTrafficPolicyTypeLocal
+				var localNodes []string
+				if localTraffic {
+					localNodes = endpointsNodes(serviceEndpoints)
+				}
 				servicesInformation = append(servicesInformation,
 					ServiceInformation{
 						Name:      s.Name,
@@ -244,81 +854,418 @@ func (c *KubernetesClient) getServices() ([]ServiceInformation, error) {
 							Port:     port.Port,
 							Mode:     strings.ToLower(mode),
 							Protocol: strings.ToLower(string(port.Protocol)),
+							Socket:   unixSockets[port.Name],
 						},
-						Endpoints: endpointsPortsMap[port.TargetPort.IntVal],
-						NodePort:  port.NodePort,
-						External:  external,
-						Timeout:   timeout,
+						Endpoints:       serviceEndpoints,
+						NotReady:        notReadyEndpoints,
+						BackendPort:     backendPort,
+						SNIHosts:        sniHosts,
+						Balance:         balance,
+						DrainTimeout:    drainTimeout,
+						Cookie:          cookie,
+						BackendTLS:      backendTLS,
+						HTTP2:           http2,
+						ALPN:            alpn,
+						HealthCheck:     healthCheck,
+						DefaultServer:   defaultServer,
+						AgentCheck:      agentCheck,
+						Redirect:        redirect,
+						RateLimit:       rateLimit,
+						Weight:          weight,
+						Weighted:        weighted,
+						Retries:         retries,
+						MinEndpoints:    minEndpoints,
+						NodePort:        port.NodePort,
+						External:        external,
+						Timeout:         timeout,
+						Timeouts:        serviceTimeouts,
+						AllowedCIDRs:    allowedCIDRs,
+						BackendOptions:  backendOptions,
+						BindOptions:     bindOptions,
+						LocalTraffic:    localTraffic,
+						LocalNodes:      localNodes,
+						Annotations:     s.Annotations,
+						ResourceVersion: resourceVersion,
+					},
+				)
+			}
+		case v1.ServiceTypeExternalName:
+			if !externalNameServices {
+				break
+			}
+			for _, port := range s.Spec.Ports {
+				if excludedPorts.Contains(port) {
+					continue
+				}
+				mode, ok := portModes[port.Name]
+				if !ok {
+					mode = defaultPortMode
+				}
+				backendPort, ok := backendPorts[port.Name]
+				if !ok || backendPort <= 0 || backendPort > 65535 {
+					backendPort = port.Port
+				}
+				serviceEndpoints := c.externalNameEndpoints(s.Spec.ExternalName, backendPort)
+				if len(serviceEndpoints) == 0 {
+					log.Printf("Couldn't resolve %s for %s in %s", s.Spec.ExternalName, s.Name, s.Namespace)
+					continue
+				}
+				uniqueServerNames(serviceEndpoints)
+				servicesInformation = append(servicesInformation,
+					ServiceInformation{
+						Name:      s.Name,
+						Namespace: s.Namespace,
+						Port: PortSpec{
+							IP:       net.ParseIP(defaultLBIP),
+							Port:     port.Port,
+							Mode:     strings.ToLower(mode),
+							Protocol: strings.ToLower(string(port.Protocol)),
+							Socket:   unixSockets[port.Name],
+						},
+						Endpoints:       serviceEndpoints,
+						BackendPort:     backendPort,
+						SNIHosts:        sniHosts,
+						Balance:         balance,
+						DrainTimeout:    drainTimeout,
+						Cookie:          cookie,
+						BackendTLS:      backendTLS,
+						HTTP2:           http2,
+						ALPN:            alpn,
+						HealthCheck:     healthCheck,
+						DefaultServer:   defaultServer,
+						AgentCheck:      agentCheck,
+						Redirect:        redirect,
+						RateLimit:       rateLimit,
+						Weight:          weight,
+						Weighted:        weighted,
+						Retries:         retries,
+						External:        external,
+						Timeout:         backendTimeouts[port.Name],
+						Timeouts:        portTimeouts(timeouts, port.Name, backendTimeouts[port.Name]),
+						AllowedCIDRs:    allowedCIDRs,
+						BackendOptions:  backendOptions,
+						BindOptions:     bindOptions,
+						Annotations:     s.Annotations,
+						ResourceVersion: resourceVersion,
 					},
 				)
 			}
 		}
 	}
+	if c.cluster != "" {
+		for i := range servicesInformation {
+			servicesInformation[i].Cluster = c.cluster
+			servicesInformation[i].Name = c.cluster + "-" + servicesInformation[i].Name
+		}
+	}
 	return servicesInformation, nil
 }
 
-func (c *KubernetesClient) Update(ctx context.Context) error {
-	nodeNames := c.nodeStore.GetNames()
+// parseStatusRange parses a HTTP status code, or a range of codes as MIN-MAX
+func parseStatusRange(status string) (string, error) {
+	var codes []string
+	var last int
+	for _, part := range strings.SplitN(status, "-", 2) {
+		code, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil {
+			return "", err
+		}
+		if code < 100 || code > 599 {
+			return "", fmt.Errorf("%d is not a valid HTTP status code", code)
+		}
+		if code < last {
+			return "", fmt.Errorf("empty range")
+		}
+		last = code
+		codes = append(codes, strconv.Itoa(code))
+	}
+	return strings.Join(codes, "-"), nil
+}
+
+// backendTLS reads the TLS configuration of the backends of a service,
+// certificates are verified by default
+func (c *KubernetesClient) backendTLS(s *v1.Service) BackendTLS {
+	var backendTLS BackendTLS
+	if e, ok := s.ObjectMeta.Annotations[BackendTLSAnnotation]; ok && len(e) > 0 {
+		enabled, err := strconv.ParseBool(strings.TrimSpace(e))
+		if err != nil {
+			log.Printf("Ignoring invalid backend TLS '%s' for %s service in %s: %s", e, s.Name, s.Namespace, err)
+		}
+		backendTLS.Enabled = enabled
+	}
+	if !backendTLS.Enabled {
+		return backendTLS
+	}
+
+	backendTLS.Verify = BackendTLSVerifyRequired
+	if v, ok := s.ObjectMeta.Annotations[BackendVerifyAnnotation]; ok && len(v) > 0 {
+		switch verify := strings.TrimSpace(v); verify {
+		case BackendTLSVerifyNone, BackendTLSVerifyRequired:
+			backendTLS.Verify = verify
+		default:
+			log.Printf("Ignoring unknown backend TLS verify mode '%s' for %s service in %s", v, s.Name, s.Namespace)
+		}
+	}
+	backendTLS.CAFile = strings.TrimSpace(s.ObjectMeta.Annotations[BackendCAAnnotation])
+	return backendTLS
+}
+
+// alpn returns if HTTP/2 is enabled for the service, and the protocols to
+// advertise with ALPN, h2 and http/1.1 by default if HTTP/2 is enabled
+func (c *KubernetesClient) alpn(s *v1.Service) (bool, []string) {
+	var http2 bool
+	if e, ok := s.ObjectMeta.Annotations[HTTP2Annotation]; ok && len(e) > 0 {
+		enabled, err := strconv.ParseBool(strings.TrimSpace(e))
+		if err != nil {
+			log.Printf("Ignoring invalid HTTP/2 '%s' for %s service in %s: %s", e, s.Name, s.Namespace, err)
+		}
+		http2 = enabled
+	}
+
+	var alpn []string
+	for _, protocol := range c.readList(s.ObjectMeta, ALPNAnnotation, ",") {
+		if strings.ContainsAny(protocol, " \t\r\n") {
+			log.Printf("Ignoring invalid ALPN protocol '%s' for %s service in %s", protocol, s.Name, s.Namespace)
+			continue
+		}
+		alpn = append(alpn, protocol)
+	}
+	if len(alpn) == 0 && http2 {
+		alpn = []string{"h2", "http/1.1"}
+	}
+	return http2, alpn
+}
+
+var redirectCodes = map[int]bool{301: true, 302: true, 303: true, 307: true, 308: true}
+
+func (c *KubernetesClient) redirect(s *v1.Service) *Redirect {
+	t, ok := s.ObjectMeta.Annotations[RedirectAnnotation]
+	if !ok || len(strings.TrimSpace(t)) == 0 {
+		return nil
+	}
+	redirect := &Redirect{
+		Type:   strings.TrimSpace(t),
+		Target: strings.TrimSpace(s.ObjectMeta.Annotations[RedirectTargetAnnotation]),
+		Code:   302,
+	}
+	switch redirect.Type {
+	case RedirectScheme:
+		if redirect.Target == "" {
+			redirect.Target = "https"
+		}
+	case RedirectLocation, RedirectPrefix:
+		if redirect.Target == "" {
+			log.Printf("Ignoring %s redirect without target for %s service in %s", redirect.Type, s.Name, s.Namespace)
+			return nil
+		}
+	default:
+		log.Printf("Ignoring unknown redirect type '%s' for %s service in %s", t, s.Name, s.Namespace)
+		return nil
+	}
+	if strings.ContainsAny(redirect.Target, " \t\r\n") {
+		log.Printf("Ignoring invalid redirect target '%s' for %s service in %s", redirect.Target, s.Name, s.Namespace)
+		return nil
+	}
+	if c, ok := s.ObjectMeta.Annotations[RedirectCodeAnnotation]; ok && len(c) > 0 {
+		code, err := strconv.Atoi(strings.TrimSpace(c))
+		if err == nil && !redirectCodes[code] {
+			err = fmt.Errorf("it must be one of 301, 302, 303, 307 or 308")
+		}
+		if err != nil {
+			log.Printf("Ignoring invalid redirect code '%s' for %s service in %s: %s", c, s.Name, s.Namespace, err)
+		} else {
+			redirect.Code = code
+		}
+	}
+	return redirect
+}
+
+func (c *KubernetesClient) Update(ctx context.Context) (err error) {
+	ctx, span := c.tracer.Start(ctx, "kube2lb.update")
+	defer func() {
+		if err != nil {
+			span.SetAttribute("error", err)
+		}
+		span.End()
+	}()
+
+	nodeNames := c.clustersNodeNames()
 
 	if net.ParseIP(defaultLBIP) == nil {
 		return fmt.Errorf("invalid default lb IP %s", defaultLBIP)
 	}
 
-	services, err := c.getServices()
+	if !validIPFamily(endpointIPFamily) {
+		return fmt.Errorf("invalid endpoint IP family %s", endpointIPFamily)
+	}
+
+	if !validEndpointsOrder(defaultEndpointsOrder) {
+		return fmt.Errorf("invalid default endpoints order %s", defaultEndpointsOrder)
+	}
+
+	if !validServerNameFormat(serverNameFormat) {
+		return fmt.Errorf("invalid server name format %s", serverNameFormat)
+	}
+
+	if !validBalance(defaultBalance) {
+		return fmt.Errorf("invalid default balance algorithm %s", defaultBalance)
+	}
+
+	stats, err := statsInformation()
+	if err != nil {
+		return err
+	}
+
+	maintenance, err := maintenanceInformation()
+	if err != nil {
+		return err
+	}
+
+	services, err := c.clustersServices()
 	if err != nil {
 		return fmt.Errorf("couldn't get services: %s", err)
 	}
+	sortServices(services)
 
-	portsMap := make(map[string]PortSpec)
-	for _, service := range services {
-		portsMap[service.Port.String()] = service.Port
+	// The first domain is the main one
+	domains := strings.Split(c.domain, ",")
+	for i := range domains {
+		domains[i] = strings.TrimSpace(domains[i])
 	}
-	ports := make([]PortSpec, 0, len(portsMap))
-	for _, port := range portsMap {
-		ports = append(ports, port)
+
+	if failOnEmpty && !c.rendered && len(services) == 0 {
+		return fmt.Errorf("no services found on first update")
 	}
 
 	info := &ClusterInformation{
-		Nodes:    nodeNames,
-		Services: services,
-		Ports:    ports,
-		Domain:   c.domain,
+		Nodes:       nodeNames,
+		Services:    services,
+		Ports:       servicesPorts(services),
+		Domain:      domains[0],
+		Domains:     domains,
+		Stats:       stats,
+		Maintenance: maintenance,
 	}
-	c.ExecuteTemplates(info)
-	c.Notify(ctx)
+	_, renderSpan := c.tracer.Start(ctx, "kube2lb.render")
+	changed := c.ExecuteTemplates(info)
+	renderSpan.SetAttribute("services", len(info.Services))
+	renderSpan.SetAttribute("changed", changed)
+	renderSpan.End()
+	c.rendered = true
+	if !changed {
+		log.Printf("Configuration not changed, skipping notification")
+		return nil
+	}
+	notifyCtx, notifySpan := c.tracer.Start(ctx, "kube2lb.notify")
+	c.Notify(notifyCtx, DiffClusterInformation(c.lastNotifiedInfo, info))
+	if verifyURL != "" {
+		if err := c.verifyOrRollback(notifyCtx, info); err != nil {
+			notifySpan.SetAttribute("error", err)
+			notifySpan.End()
+			return err
+		}
+	}
+	notifySpan.End()
+	c.lastNotifiedInfo = info
 
 	return nil
 }
 
 func (c *KubernetesClient) Watch(ctx context.Context) error {
-	isFirstUpdate := true
+	// Stores are initialized before watching, so updates signaled by any
+	// cluster can read the stores of all of them
+	c.resetStores()
+	for _, cluster := range c.clusters {
+		cluster.resetStores()
+	}
+
+	// Set again when stores of any cluster are reset, from their watchers
+	var isFirstUpdate int32 = 1
 	updater := c.updaterBuilder(func(ctx context.Context) {
 		var err error
 		if err = c.Update(ctx); err != nil {
 			log.Printf("Couldn't update state: %s", err)
 		}
-		if isFirstUpdate {
+		if atomic.LoadInt32(&isFirstUpdate) == 1 {
 			if err != nil {
 				log.Fatalf("Failing on first update, check configuration.")
 			}
-			isFirstUpdate = false
+			atomic.StoreInt32(&isFirstUpdate, 0)
 		}
 	})
 	go updater.Run(ctx)
 
+	// External names are resolved again on updates after the refresh interval
+	if externalNameServices && externalNameRefresh > 0 {
+		go func() {
+			ticker := time.NewTicker(externalNameRefresh)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					updater.Signal()
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+
+	// Stores of any cluster are rebuilt from scratch after errors
+	onReset := func() {
+		atomic.StoreInt32(&isFirstUpdate, 1)
+	}
+	for _, cluster := range c.clusters {
+		go func(cluster *KubernetesClient) {
+			if err := cluster.watch(ctx, updater, onReset); err != nil {
+				log.Fatalf("Couldn't watch Kubernetes API server of cluster %s: %s", cluster.cluster, err)
+			}
+		}(cluster)
+	}
+	return c.watch(ctx, updater, onReset)
+}
+
+// resetStores replaces the local stores with empty ones
+func (c *KubernetesClient) resetStores() {
+	c.storesLock.Lock()
+	defer c.storesLock.Unlock()
+	c.nodeStore = NodeStore{NewLocalStore()}
+	c.serviceStore = ServiceStore{NewLocalStore()}
+	if useEndpointSlices {
+		c.endpointsStore = &EndpointSlicesStore{NewLocalStore()}
+	} else {
+		c.endpointsStore = &EndpointsStore{NewLocalStore()}
+	}
+	c.podStore = nil
+	if readyAnnotation != "" {
+		c.podStore = &PodStore{NewLocalStore()}
+	}
+	c.settingsStore = nil
+	if serviceSettingsConfigMap != "" {
+		c.settingsStore = &ServiceSettingsStore{NewLocalStore()}
+	}
+	c.lastResourceVersion = ""
+}
+
+// watch updates the local stores with the events received from the API
+// server, signaling the updater on changes, stores must have been reset
+// before starting to watch
+func (c *KubernetesClient) watch(ctx context.Context, updater Updater, onReset func()) error {
 	resetStores := func() {
-		isFirstUpdate = true
-		c.nodeStore = NodeStore{NewLocalStore()}
-		c.serviceStore = ServiceStore{NewLocalStore()}
-		c.endpointsStore = EndpointsStore{NewLocalStore()}
-		c.lastResourceVersion = ""
+		onReset()
+		c.resetStores()
 	}
-	resetStores()
 
 	updateStore := func(s Store, e watch.Event) {
 		switch e.Type {
 		case watch.Added:
-			s.Update(e.Object)
+			// Objects are added again when watches are restarted
+			old := s.Update(e.Object)
+			if old != nil {
+				if eq, err := s.Equal(old, e.Object); err == nil && eq {
+					return
+				}
+			}
 		case watch.Modified:
 			old := s.Update(e.Object)
 			if old == nil {
@@ -348,7 +1295,14 @@ func (c *KubernetesClient) Watch(ctx context.Context) error {
 		if accessor != nil {
 			c.lastResourceVersion = accessor.GetResourceVersion()
 		}
+		_, span := c.tracer.Start(ctx, "kube2lb.event")
+		span.SetAttribute("type", e.Type)
+		if key, ok := serviceChangeKey(e.Object); ok {
+			span.SetAttribute("service", key)
+		}
+		recordServiceChange(e.Object)
 		updater.Signal()
+		span.End()
 	}
 
 	var more bool
@@ -361,6 +1315,10 @@ func (c *KubernetesClient) Watch(ctx context.Context) error {
 			updateStore(c.serviceStore, e)
 		case e, more = <-c.endpointsWatcher.ResultChan():
 			updateStore(c.endpointsStore, e)
+		case e, more = <-resultChan(c.podWatcher):
+			updateStore(c.podStore, e)
+		case e, more = <-resultChan(c.settingsWatcher):
+			updateStore(c.settingsStore, e)
 		}
 
 		// Used in tests to know when events have been processed
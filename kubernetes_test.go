@@ -18,16 +18,28 @@ package main
 
 import (
 	"context"
+	"expvar"
 	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
+	"text/template"
 	"time"
 
 	"github.com/stretchr/testify/assert"
 
 	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/util/intstr"
 	"k8s.io/apimachinery/pkg/watch"
 	"k8s.io/client-go/pkg/api/v1"
+	"k8s.io/client-go/rest"
 )
 
 type testWatcher struct {
@@ -71,10 +83,10 @@ type dummyTemplate struct {
 	lastExecutedWith *ClusterInformation
 }
 
-func (t *dummyTemplate) Execute(info *ClusterInformation) error {
+func (t *dummyTemplate) Execute(info *ClusterInformation) (bool, error) {
 	t.executionCount++
 	t.lastExecutedWith = info
-	return nil
+	return true, nil
 }
 
 // An updater that doesn't call the updater function but register
@@ -282,3 +294,1692 @@ func TestKubernetesWatch(t *testing.T) {
 	assert.Equal(t, updater.Signaled, true, "Updater should have been signaled when adding annotation to service")
 	updater.F(ctx)
 }
+
+func newTestStoresClient(objects ...runtime.Object) *KubernetesClient {
+	client := &KubernetesClient{
+		nodeStore:      NodeStore{NewLocalStore()},
+		serviceStore:   ServiceStore{NewLocalStore()},
+		endpointsStore: &EndpointsStore{NewLocalStore()},
+		domain:         "kube2lb.test",
+	}
+	for _, o := range objects {
+		switch o.(type) {
+		case *v1.Node:
+			client.nodeStore.Update(o)
+		case *v1.Service:
+			client.serviceStore.Update(o)
+		case *v1.Endpoints:
+			client.endpointsStore.Update(o)
+		case *v1.ConfigMap:
+			if client.settingsStore == nil {
+				client.settingsStore = &ServiceSettingsStore{NewLocalStore()}
+			}
+			client.settingsStore.Update(o)
+		case *v1.Pod:
+			if client.podStore == nil {
+				client.podStore = &PodStore{NewLocalStore()}
+			}
+			client.podStore.Update(o)
+		}
+	}
+	return client
+}
+
+func newTestService(name string, annotations map[string]string) (*v1.Service, *v1.Endpoints) {
+	service := &v1.Service{
+		ObjectMeta: meta_v1.ObjectMeta{
+			SelfLink:    "/service/" + name,
+			Name:        name,
+			Namespace:   "test",
+			Annotations: annotations,
+		},
+		Spec: v1.ServiceSpec{
+			Type: v1.ServiceTypeNodePort,
+			Ports: []v1.ServicePort{
+				{
+					Name: "http", Port: 80, TargetPort: intstr.FromInt(80),
+				},
+			},
+		},
+	}
+	endpoints := &v1.Endpoints{
+		ObjectMeta: meta_v1.ObjectMeta{SelfLink: "/endpoints/" + name, Name: name, Namespace: "test"},
+		Subsets: []v1.EndpointSubset{
+			{
+				Addresses: []v1.EndpointAddress{{IP: "10.0.0.1"}, {IP: "10.0.0.2"}},
+				Ports:     []v1.EndpointPort{{Name: "http", Port: 80}},
+			},
+		},
+	}
+	return service, endpoints
+}
+
+func TestExternalDomainsValidation(t *testing.T) {
+	cases := []struct {
+		Annotation string
+		Expected   []string
+	}{
+		{"", nil},
+		{"test.example.com", []string{"test.example.com"}},
+		{" a.example.com , b.example.com ,", []string{"a.example.com", "b.example.com"}},
+		{"*.example.com,example.com.", []string{"*.example.com", "example.com."}},
+		{"my-service.Example.com,x.example.com", []string{"my-service.Example.com", "x.example.com"}},
+		{`~^(test1|test2)\.example\.(com|net)$`, []string{`~^(test1|test2)\.example\.(com|net)$`}},
+		{"test.example.com if TRUE", nil},
+		{"test.example.com\nacl evil always_true", nil},
+		{"-bad.example.com,bad-.example.com,bad..example.com,under_score.example.com", nil},
+		{"*.*.example.com,*.", nil},
+		{strings.Repeat("a", 64) + ".example.com", nil},
+		{"~(unclosed,~,~a b", nil},
+		{"ok.example.com,bad!.example.com,~^ok$", []string{"ok.example.com", "~^ok$"}},
+	}
+
+	for _, c := range cases {
+		service, endpoints := newTestService("service1", map[string]string{ExternalDomainsAnnotation: c.Annotation})
+		client := newTestStoresClient(service, endpoints)
+		services, err := client.getServices()
+		if assert.NoError(t, err) && assert.Equal(t, 1, len(services)) {
+			assert.Equal(t, c.Expected, services[0].External, "external domains for %q", c.Annotation)
+		}
+	}
+}
+
+func TestExcludePortsAnnotation(t *testing.T) {
+	cases := []struct {
+		Annotation string
+		Expected   []int32
+	}{
+		{"", []int32{80, 443, 9090}},
+		{"metrics", []int32{80, 443}},
+		{"9090", []int32{80, 443}},
+		{" https , 80 ", []int32{9090}},
+		{"8080,unknown", []int32{80, 443, 9090}},
+		{"http,https,metrics", nil},
+	}
+
+	for _, c := range cases {
+		service, endpoints := newTestService("service1", map[string]string{ExcludePortsAnnotation: c.Annotation})
+		service.Spec.Ports = []v1.ServicePort{
+			{Name: "http", Port: 80, TargetPort: intstr.FromInt(8080)},
+			{Name: "https", Port: 443, TargetPort: intstr.FromInt(8443)},
+			{Name: "metrics", Port: 9090, TargetPort: intstr.FromInt(9090)},
+		}
+		endpoints.Subsets[0].Ports = []v1.EndpointPort{{Name: "http", Port: 8080}, {Name: "https", Port: 8443}, {Name: "metrics", Port: 9090}}
+		client := newTestStoresClient(service, endpoints)
+		services, err := client.getServices()
+		if assert.NoError(t, err) {
+			var ports []int32
+			for _, s := range services {
+				ports = append(ports, s.Port.Port)
+			}
+			sort.Slice(ports, func(i, j int) bool { return ports[i] < ports[j] })
+			assert.Equal(t, c.Expected, ports, "ports with excluded %q", c.Annotation)
+		}
+	}
+}
+
+func TestEndpointHostnames(t *testing.T) {
+	service, endpoints := newTestService("web", nil)
+	endpoints.Subsets[0].Addresses = []v1.EndpointAddress{
+		{IP: "10.0.0.1", Hostname: "web-0", TargetRef: &v1.ObjectReference{Kind: "Pod", Name: "web-0"}},
+		{IP: "10.0.0.2"},
+	}
+	endpoints.Subsets[0].NotReadyAddresses = []v1.EndpointAddress{
+		{IP: "10.0.0.3", Hostname: "web-2", TargetRef: &v1.ObjectReference{Kind: "Pod", Name: "web-2"}},
+	}
+	client := newTestStoresClient(service, endpoints)
+	services, err := client.getServices()
+	if assert.NoError(t, err) && assert.Equal(t, 1, len(services)) {
+		hostnames := make(map[string]string)
+		for _, e := range append(services[0].Endpoints, services[0].NotReady...) {
+			hostnames[e.IP] = e.Hostname
+		}
+		assert.Equal(t, map[string]string{"10.0.0.1": "web-0", "10.0.0.2": "", "10.0.0.3": "web-2"}, hostnames)
+	}
+
+	// Hostnames are also read from endpoint slices
+	hostname := "web-1"
+	slice := newTestEndpointSlice("web-abc", "web", 80, []string{"10.0.0.4"}, nil)
+	slice.Endpoints[0].Hostname = &hostname
+	client = newTestStoresClient(service)
+	client.endpointsStore = &EndpointSlicesStore{NewLocalStore()}
+	client.endpointsStore.Update(slice)
+	services, err = client.getServices()
+	if assert.NoError(t, err) && assert.Equal(t, 1, len(services)) && assert.Equal(t, 1, len(services[0].Endpoints)) {
+		assert.Equal(t, "web-1", services[0].Endpoints[0].Hostname)
+	}
+}
+
+func TestMultiplePortsService(t *testing.T) {
+	service, endpoints := newTestService("service1", nil)
+	service.Spec.Ports = []v1.ServicePort{
+		{Name: "http", Port: 80, TargetPort: intstr.FromInt(8080), Protocol: v1.ProtocolTCP},
+		{Name: "https", Port: 443, TargetPort: intstr.FromString("https"), Protocol: v1.ProtocolTCP},
+		{Name: "metrics", Port: 9090, TargetPort: intstr.FromInt(8080), Protocol: v1.ProtocolTCP},
+	}
+	endpoints.Subsets = []v1.EndpointSubset{
+		{
+			Addresses: []v1.EndpointAddress{{IP: "10.0.0.1"}},
+			Ports:     []v1.EndpointPort{{Name: "http", Port: 8080}, {Name: "https", Port: 8443}, {Name: "metrics", Port: 8080}},
+		},
+		{
+			Addresses:         []v1.EndpointAddress{{IP: "10.0.0.2"}},
+			NotReadyAddresses: []v1.EndpointAddress{{IP: "10.0.0.3"}},
+			Ports:             []v1.EndpointPort{{Name: "https", Port: 9443}},
+		},
+	}
+
+	client := newTestStoresClient(service, endpoints)
+	services, err := client.getServices()
+	if !assert.NoError(t, err) || !assert.Equal(t, 3, len(services)) {
+		return
+	}
+
+	byPort := make(map[int32]ServiceInformation)
+	labels := make(map[string]bool)
+	for _, s := range services {
+		byPort[s.Port.Port] = s
+		labels[s.String()] = true
+	}
+	assert.Equal(t, 3, len(labels), "labels of each port should be unique")
+
+	assert.Equal(t, []string{"10.0.0.1"}, endpointsIPs(byPort[80].Endpoints))
+	assert.Equal(t, []string{"10.0.0.1"}, endpointsIPs(byPort[9090].Endpoints))
+	assert.Equal(t, []string{"10.0.0.1", "10.0.0.2"}, endpointsIPs(byPort[443].Endpoints), "named target ports should be matched by name")
+	assert.Equal(t, []string{"10.0.0.3"}, endpointsIPs(byPort[443].NotReady))
+	var ports []int32
+	for _, e := range byPort[443].Endpoints {
+		ports = append(ports, e.Port)
+	}
+	assert.Contains(t, ports, int32(8443))
+	assert.Contains(t, ports, int32(9443))
+
+	// Manually managed endpoints can have different port names
+	endpoints.Subsets = []v1.EndpointSubset{
+		{
+			Addresses: []v1.EndpointAddress{{IP: "10.0.0.4"}},
+			Ports:     []v1.EndpointPort{{Name: "web", Port: 8080}},
+		},
+	}
+	client = newTestStoresClient(service, endpoints)
+	manual, err := client.getServices()
+	if assert.NoError(t, err) && assert.Equal(t, 3, len(manual)) {
+		for _, s := range manual {
+			var expected []string
+			if s.Port.Port != 443 {
+				expected = []string{"10.0.0.4"}
+			}
+			assert.Equal(t, expected, endpointsIPs(s.Endpoints), "endpoints for port %d", s.Port.Port)
+		}
+	}
+
+	// Ports of the same service can share server names
+	defer func(strict bool) { strictServerNames = strict }(strictServerNames)
+	strictServerNames = true
+	assert.NoError(t, checkServerNameCollisions(&ClusterInformation{Services: services, Domain: "cluster.local"}))
+}
+
+func TestLocalTrafficPolicy(t *testing.T) {
+	node1, node2 := "node1", "node2"
+	service, endpoints := newTestService("service1", nil)
+	service.Spec.ExternalTrafficPolicy = v1.ServiceExternalTrafficPolicyTypeLocal
+	endpoints.Subsets[0].Addresses = []v1.EndpointAddress{
+		{IP: "10.0.0.1", NodeName: &node2},
+		{IP: "10.0.0.2", NodeName: &node1},
+		{IP: "10.0.0.3", NodeName: &node2},
+	}
+	endpoints.Subsets[0].NotReadyAddresses = []v1.EndpointAddress{{IP: "10.0.0.4", NodeName: &node1}}
+	nodes := []string{"node1", "node2", "node3"}
+
+	defer func(honor bool) { honorLocalTrafficPolicy = honor }(honorLocalTrafficPolicy)
+	client := newTestStoresClient(service, endpoints)
+
+	honorLocalTrafficPolicy = true
+	services, err := client.getServices()
+	if assert.NoError(t, err) && assert.Equal(t, 1, len(services)) {
+		assert.True(t, services[0].LocalTraffic)
+		assert.Equal(t, []string{"node1", "node2"}, services[0].LocalNodes)
+		assert.Equal(t, []string{"node1", "node2"}, services[0].NodePortNodes(nodes))
+	}
+
+	endpoints.Subsets[0].Addresses = endpoints.Subsets[0].Addresses[:1]
+	client = newTestStoresClient(service, endpoints)
+	services, err = client.getServices()
+	if assert.NoError(t, err) && assert.Equal(t, 1, len(services)) {
+		assert.Equal(t, []string{"node2"}, services[0].NodePortNodes(nodes), "nodes with only not ready endpoints shouldn't be included")
+	}
+
+	honorLocalTrafficPolicy = false
+	services, err = client.getServices()
+	if assert.NoError(t, err) && assert.Equal(t, 1, len(services)) {
+		assert.False(t, services[0].LocalTraffic)
+		assert.Equal(t, nodes, services[0].NodePortNodes(nodes))
+	}
+
+	honorLocalTrafficPolicy = true
+	service.Spec.ExternalTrafficPolicy = v1.ServiceExternalTrafficPolicyTypeCluster
+	client = newTestStoresClient(service, endpoints)
+	services, err = client.getServices()
+	if assert.NoError(t, err) && assert.Equal(t, 1, len(services)) {
+		assert.False(t, services[0].LocalTraffic)
+		assert.Equal(t, nodes, services[0].NodePortNodes(nodes))
+	}
+}
+
+func TestEndpointRemoveGrace(t *testing.T) {
+	defer func(grace time.Duration) { endpointRemoveGrace = grace }(endpointRemoveGrace)
+	endpointRemoveGrace = 10 * time.Second
+
+	service, endpoints := newTestService("service1", nil)
+	client := newTestStoresClient(service, endpoints)
+	clock := &testClock{t: time.Now()}
+	client.now = clock.Now
+
+	setAddresses := func(ips ...string) {
+		var addresses []v1.EndpointAddress
+		for _, ip := range ips {
+			addresses = append(addresses, v1.EndpointAddress{IP: ip})
+		}
+		updated := *endpoints
+		updated.Subsets = []v1.EndpointSubset{{Addresses: addresses, Ports: endpoints.Subsets[0].Ports}}
+		client.endpointsStore.Update(&updated)
+	}
+	check := func(message string, ready, draining []string) {
+		services, err := client.getServices()
+		if !assert.NoError(t, err) || !assert.Equal(t, 1, len(services)) {
+			return
+		}
+		var readyIPs, drainingIPs []string
+		for _, e := range services[0].Endpoints {
+			if e.Draining {
+				drainingIPs = append(drainingIPs, e.IP)
+			} else {
+				readyIPs = append(readyIPs, e.IP)
+			}
+		}
+		assert.Equal(t, ready, readyIPs, "ready endpoints %s", message)
+		assert.Equal(t, draining, drainingIPs, "draining endpoints %s", message)
+	}
+
+	check("initially", []string{"10.0.0.1", "10.0.0.2"}, nil)
+
+	setAddresses("10.0.0.1")
+	clock.Advance(time.Second)
+	check("after removing an endpoint", []string{"10.0.0.1"}, []string{"10.0.0.2"})
+
+	setAddresses("10.0.0.1", "10.0.0.2")
+	clock.Advance(time.Second)
+	check("after the endpoint returns", []string{"10.0.0.1", "10.0.0.2"}, nil)
+
+	setAddresses("10.0.0.1")
+	clock.Advance(9 * time.Second)
+	check("during the grace period", []string{"10.0.0.1"}, []string{"10.0.0.2"})
+
+	clock.Advance(2 * time.Second)
+	check("after the grace period", []string{"10.0.0.1"}, nil)
+
+	endpointRemoveGrace = 0
+	setAddresses("10.0.0.2")
+	check("without grace period", []string{"10.0.0.2"}, nil)
+}
+
+func TestAllowedCIDRsAnnotation(t *testing.T) {
+	cases := []struct {
+		Annotation string
+		Expected   []string
+	}{
+		{"", nil},
+		{"10.0.0.0/8", []string{"10.0.0.0/8"}},
+		{"10.0.0.0/8, 192.168.0.0/16,2001:db8::/32", []string{"10.0.0.0/8", "192.168.0.0/16", "2001:db8::/32"}},
+		{"10.0.0.0/8,foo,10.0.0.1,192.168.0.0/33", []string{"10.0.0.0/8"}},
+		{"foo", nil},
+	}
+
+	for _, c := range cases {
+		service, endpoints := newTestService("service1", map[string]string{AllowedCIDRsAnnotation: c.Annotation})
+		client := newTestStoresClient(service, endpoints)
+		services, err := client.getServices()
+		if assert.NoError(t, err) && assert.Equal(t, 1, len(services)) {
+			assert.Equal(t, c.Expected, services[0].AllowedCIDRs, "allowed CIDRs for %q", c.Annotation)
+		}
+	}
+}
+
+func TestLoadBalancerSourceRanges(t *testing.T) {
+	service, endpoints := newTestService("service1", map[string]string{AllowedCIDRsAnnotation: "10.0.0.0/8"})
+	service.Spec.Type = v1.ServiceTypeLoadBalancer
+	service.Spec.LoadBalancerSourceRanges = []string{"192.168.0.0/16", "invalid", "172.16.0.0/12"}
+
+	client := newTestStoresClient(service, endpoints)
+	services, err := client.getServices()
+	if assert.NoError(t, err) && assert.Equal(t, 1, len(services)) {
+		assert.Equal(t, []string{"192.168.0.0/16", "172.16.0.0/12"}, services[0].AllowedCIDRs)
+	}
+
+	// Source ranges are only used by load balancer services
+	service.Spec.Type = v1.ServiceTypeNodePort
+	services, err = client.getServices()
+	if assert.NoError(t, err) && assert.Equal(t, 1, len(services)) {
+		assert.Equal(t, []string{"10.0.0.0/8"}, services[0].AllowedCIDRs)
+	}
+}
+
+func TestReadyAndTotalEndpointsCount(t *testing.T) {
+	service, endpoints := newTestService("service1", nil)
+	endpoints.Subsets = []v1.EndpointSubset{
+		{
+			Addresses:         []v1.EndpointAddress{{IP: "10.0.0.1"}, {IP: "10.0.0.2"}},
+			NotReadyAddresses: []v1.EndpointAddress{{IP: "10.0.0.3"}},
+			Ports:             []v1.EndpointPort{{Name: "http", Port: 80}},
+		},
+	}
+
+	client := newTestStoresClient(service, endpoints)
+	services, err := client.getServices()
+	if assert.NoError(t, err) && assert.Equal(t, 1, len(services)) {
+		assert.Equal(t, 2, services[0].ReadyCount(), "ready endpoints")
+		assert.Equal(t, 3, services[0].TotalCount(), "total endpoints")
+		if assert.Equal(t, 1, len(services[0].NotReady)) {
+			assert.Equal(t, "10.0.0.3", services[0].NotReady[0].IP)
+			assert.False(t, services[0].NotReady[0].Ready)
+		}
+		for _, e := range services[0].Endpoints {
+			assert.True(t, e.Ready, "endpoint %s should be ready", e.IP)
+		}
+	}
+
+	// Endpoints becoming unready should be considered a change
+	unready := *endpoints
+	unready.Subsets = []v1.EndpointSubset{
+		{
+			Addresses:         []v1.EndpointAddress{{IP: "10.0.0.1"}},
+			NotReadyAddresses: []v1.EndpointAddress{{IP: "10.0.0.2"}, {IP: "10.0.0.3"}},
+			Ports:             []v1.EndpointPort{{Name: "http", Port: 80}},
+		},
+	}
+	unready.ResourceVersion = "2"
+	eq, err := EqualEndpoints(endpoints, &unready)
+	if assert.NoError(t, err) {
+		assert.False(t, eq, "endpoints with different readiness shouldn't be equal")
+	}
+}
+
+func TestBackendOptionsAnnotation(t *testing.T) {
+	cases := []struct {
+		Annotation string
+		Expected   []string
+	}{
+		{"", nil},
+		{"option httpchk GET /healthz", []string{"option httpchk GET /healthz"}},
+		{"option httpchk GET /healthz\nhttp-check expect status 200\n", []string{"option httpchk GET /healthz", "http-check expect status 200"}},
+		{"\n  option forwardfor \n\n\tretries 3\n", []string{"option forwardfor", "retries 3"}},
+	}
+
+	for _, c := range cases {
+		service, endpoints := newTestService("service1", map[string]string{BackendOptionsAnnotation: c.Annotation})
+		client := newTestStoresClient(service, endpoints)
+		services, err := client.getServices()
+		if assert.NoError(t, err) && assert.Equal(t, 1, len(services)) {
+			assert.Equal(t, c.Expected, services[0].BackendOptions, "backend options for %q", c.Annotation)
+		}
+	}
+}
+
+func TestBindOptionsAnnotation(t *testing.T) {
+	cases := []struct {
+		Annotation string
+		Expected   []string
+	}{
+		{"", nil},
+		{"accept-proxy", []string{"accept-proxy"}},
+		{"accept-proxy\n tfo \nalpn h2,http/1.1\n", []string{"accept-proxy", "tfo", "alpn h2,http/1.1"}},
+	}
+
+	for _, c := range cases {
+		service, endpoints := newTestService("service1", map[string]string{BindOptionsAnnotation: c.Annotation})
+		client := newTestStoresClient(service, endpoints)
+		services, err := client.getServices()
+		if assert.NoError(t, err) && assert.Equal(t, 1, len(services)) {
+			assert.Equal(t, c.Expected, services[0].BindOptions, "bind options for %q", c.Annotation)
+		}
+	}
+}
+
+func TestUnixSocketsAnnotation(t *testing.T) {
+	cases := []struct {
+		Annotation string
+		Expected   string
+	}{
+		{"", ""},
+		{`{"http": "/var/run/haproxy/service1.sock"}`, "/var/run/haproxy/service1.sock"},
+		{`{"other": "/var/run/haproxy/service1.sock"}`, ""},
+		{`{"http": "service1.sock"}`, ""},
+		{`/var/run/haproxy/service1.sock`, ""},
+	}
+
+	for _, c := range cases {
+		service, endpoints := newTestService("service1", map[string]string{UnixSocketsAnnotation: c.Annotation})
+		client := newTestStoresClient(service, endpoints)
+		services, err := client.getServices()
+		if assert.NoError(t, err) && assert.Equal(t, 1, len(services)) {
+			assert.Equal(t, c.Expected, services[0].Port.Socket, "socket for %q", c.Annotation)
+		}
+	}
+}
+
+const testKubeconfig = `apiVersion: v1
+kind: Config
+clusters:
+- name: test
+  cluster:
+    server: https://kubeconfig.kube2lb.test:6443
+contexts:
+- name: test
+  context:
+    cluster: test
+current-context: test
+`
+
+func TestBuildConfig(t *testing.T) {
+	defer func(f func() (*rest.Config, error)) { inClusterConfig = f }(inClusterConfig)
+	inClusterConfig = func() (*rest.Config, error) {
+		return &rest.Config{Host: "https://incluster.kube2lb.test:443"}, nil
+	}
+
+	f, err := ioutil.TempFile("", "kube2lb-kubeconfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(testKubeconfig)
+	f.Close()
+
+	config, err := buildConfig(f.Name(), "")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "https://kubeconfig.kube2lb.test:6443", config.Host, "kubeconfig file should be used if defined")
+	}
+
+	config, err = buildConfig(f.Name(), "https://apiserver.kube2lb.test")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "https://apiserver.kube2lb.test", config.Host, "API server should override kubeconfig file")
+	}
+
+	config, err = buildConfig("", "")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "https://incluster.kube2lb.test:443", config.Host, "in-cluster configuration should be used by default")
+	}
+
+	inClusterConfig = func() (*rest.Config, error) {
+		return nil, fmt.Errorf("not in cluster")
+	}
+	defer os.Setenv("KUBECONFIG", os.Getenv("KUBECONFIG"))
+	os.Setenv("KUBECONFIG", f.Name())
+	config, err = buildConfig("", "")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "https://kubeconfig.kube2lb.test:6443", config.Host, "default kubeconfig should be used out of cluster")
+	}
+}
+
+func TestBuildConfigRateLimits(t *testing.T) {
+	defer func(f func() (*rest.Config, error)) { inClusterConfig = f }(inClusterConfig)
+	inClusterConfig = func() (*rest.Config, error) {
+		return &rest.Config{Host: "https://incluster.kube2lb.test:443"}, nil
+	}
+
+	config, err := buildConfig("", "")
+	if assert.NoError(t, err) {
+		assert.Equal(t, rest.DefaultQPS, config.QPS, "default QPS")
+		assert.Equal(t, rest.DefaultBurst, config.Burst, "default burst")
+	}
+
+	defer func(qps float64, burst int) { kubeAPIQPS, kubeAPIBurst = qps, burst }(kubeAPIQPS, kubeAPIBurst)
+	kubeAPIQPS, kubeAPIBurst = 50, 100
+	config, err = buildConfig("", "")
+	if assert.NoError(t, err) {
+		assert.Equal(t, float32(50), config.QPS, "configured QPS")
+		assert.Equal(t, 100, config.Burst, "configured burst")
+	}
+}
+
+func TestBackendPortAnnotation(t *testing.T) {
+	cases := []struct {
+		Annotation  string
+		BackendPort int32
+		Endpoints   int32
+	}{
+		{"", 80, 80},
+		{`{"http": 8080}`, 8080, 8080},
+		{`{"other": 8080}`, 80, 80},
+		{`{"http": 70000}`, 80, 80},
+		{`{"http": -1}`, 80, 80},
+	}
+
+	for _, c := range cases {
+		service, endpoints := newTestService("service1", map[string]string{BackendPortAnnotation: c.Annotation})
+		client := newTestStoresClient(service, endpoints)
+		services, err := client.getServices()
+		if assert.NoError(t, err) && assert.Equal(t, 1, len(services)) {
+			assert.Equal(t, int32(80), services[0].Port.Port, "frontend port for %q", c.Annotation)
+			assert.Equal(t, c.BackendPort, services[0].BackendPort, "backend port for %q", c.Annotation)
+			for _, e := range services[0].Endpoints {
+				assert.Equal(t, c.Endpoints, e.Port, "endpoint port for %q", c.Annotation)
+			}
+		}
+	}
+}
+
+func TestSNIHostsAnnotation(t *testing.T) {
+	cases := []struct {
+		Annotation string
+		Expected   []string
+	}{
+		{"", nil},
+		{"service1.example.com", []string{"service1.example.com"}},
+		{"service1.example.com, service1.example.net,,*.example.org", []string{"service1.example.com", "service1.example.net", "*.example.org"}},
+	}
+
+	for _, c := range cases {
+		service, endpoints := newTestService("service1", map[string]string{SNIHostsAnnotation: c.Annotation})
+		client := newTestStoresClient(service, endpoints)
+		services, err := client.getServices()
+		if assert.NoError(t, err) && assert.Equal(t, 1, len(services)) {
+			assert.Equal(t, c.Expected, services[0].SNIHosts, "SNI hosts for %q", c.Annotation)
+		}
+	}
+}
+
+func TestServiceAnnotations(t *testing.T) {
+	annotations := map[string]string{"example.com/weight": "10"}
+	service, endpoints := newTestService("service1", annotations)
+	client := newTestStoresClient(service, endpoints)
+	services, err := client.getServices()
+	if assert.NoError(t, err) && assert.Equal(t, 1, len(services)) {
+		assert.Equal(t, annotations, services[0].Annotations)
+		assert.Equal(t, "10", annotation(services[0], "example.com/weight", "1"))
+	}
+}
+
+func TestBalanceAnnotation(t *testing.T) {
+	cases := []struct {
+		Annotation string
+		Expected   string
+	}{
+		{"", "roundrobin"},
+		{"leastconn", "leastconn"},
+		{" source ", "source"},
+		{"hdr(host)", "hdr(host)"},
+		{"url_param userid", "url_param userid"},
+		{"fastest", "roundrobin"},
+		{"leastconn; rm -rf", "roundrobin"},
+	}
+
+	for _, c := range cases {
+		service, endpoints := newTestService("service1", map[string]string{BalanceAnnotation: c.Annotation})
+		client := newTestStoresClient(service, endpoints)
+		services, err := client.getServices()
+		if assert.NoError(t, err) && assert.Equal(t, 1, len(services)) {
+			assert.Equal(t, c.Expected, services[0].Balance, "balance for %q", c.Annotation)
+		}
+	}
+}
+
+func TestCookieAnnotations(t *testing.T) {
+	cases := []struct {
+		Annotations map[string]string
+		Expected    *CookieSpec
+	}{
+		{nil, nil},
+		{map[string]string{CookieAnnotation: " "}, nil},
+		{map[string]string{CookieModeAnnotation: "prefix"}, nil},
+		{map[string]string{CookieAnnotation: "SRVID"}, &CookieSpec{Name: "SRVID", Mode: "insert indirect"}},
+		{map[string]string{CookieAnnotation: "SRVID", CookieModeAnnotation: " insert indirect nocache "}, &CookieSpec{Name: "SRVID", Mode: "insert indirect nocache"}},
+	}
+
+	for _, c := range cases {
+		service, endpoints := newTestService("service1", c.Annotations)
+		client := newTestStoresClient(service, endpoints)
+		services, err := client.getServices()
+		if assert.NoError(t, err) && assert.Equal(t, 1, len(services)) {
+			assert.Equal(t, c.Expected, services[0].Cookie, "cookie for %v", c.Annotations)
+		}
+	}
+}
+
+func TestBackendTLSAnnotations(t *testing.T) {
+	cases := []struct {
+		Annotations map[string]string
+		Expected    BackendTLS
+		Options     string
+	}{
+		{nil, BackendTLS{}, ""},
+		{map[string]string{BackendTLSAnnotation: "false", BackendVerifyAnnotation: "none"}, BackendTLS{}, ""},
+		{map[string]string{BackendTLSAnnotation: "yes"}, BackendTLS{}, ""},
+		{map[string]string{BackendTLSAnnotation: "true"}, BackendTLS{Enabled: true, Verify: "required"}, "ssl verify required"},
+		{map[string]string{BackendTLSAnnotation: "true", BackendVerifyAnnotation: " none ", BackendCAAnnotation: "/etc/ssl/ca.pem"}, BackendTLS{Enabled: true, Verify: "none", CAFile: "/etc/ssl/ca.pem"}, "ssl verify none"},
+		{map[string]string{BackendTLSAnnotation: "true", BackendVerifyAnnotation: "required", BackendCAAnnotation: "/etc/ssl/ca.pem"}, BackendTLS{Enabled: true, Verify: "required", CAFile: "/etc/ssl/ca.pem"}, "ssl verify required ca-file /etc/ssl/ca.pem"},
+		{map[string]string{BackendTLSAnnotation: "true", BackendVerifyAnnotation: "optional"}, BackendTLS{Enabled: true, Verify: "required"}, "ssl verify required"},
+	}
+
+	for _, c := range cases {
+		service, endpoints := newTestService("service1", c.Annotations)
+		client := newTestStoresClient(service, endpoints)
+		services, err := client.getServices()
+		if assert.NoError(t, err) && assert.Equal(t, 1, len(services)) {
+			assert.Equal(t, c.Expected, services[0].BackendTLS, "backend TLS for %v", c.Annotations)
+			assert.Equal(t, c.Options, services[0].BackendTLS.ServerOptions(), "server options for %v", c.Annotations)
+		}
+	}
+}
+
+func TestHealthCheckStatusAnnotation(t *testing.T) {
+	cases := []struct {
+		Annotation string
+		Expected   *HealthCheck
+	}{
+		{"", nil},
+		{"204", &HealthCheck{ExpectStatus: "204"}},
+		{" 200-399 ", &HealthCheck{ExpectStatus: "200-399"}},
+		{"200 - 299", &HealthCheck{ExpectStatus: "200-299"}},
+		{"301-301", &HealthCheck{ExpectStatus: "301-301"}},
+		{"299-200", nil},
+		{"600", nil},
+		{"99-200", nil},
+		{"ok", nil},
+		{"200-", nil},
+		{"200-300-400", nil},
+	}
+
+	for _, c := range cases {
+		service, endpoints := newTestService("service1", map[string]string{HealthStatusAnnotation: c.Annotation})
+		client := newTestStoresClient(service, endpoints)
+		services, err := client.getServices()
+		if assert.NoError(t, err) && assert.Equal(t, 1, len(services)) {
+			assert.Equal(t, c.Expected, services[0].HealthCheck, "health check for %q", c.Annotation)
+		}
+	}
+}
+
+func TestRedirectAnnotations(t *testing.T) {
+	cases := []struct {
+		Annotations map[string]string
+		Expected    *Redirect
+		Rule        string
+	}{
+		{nil, nil, ""},
+		{
+			map[string]string{RedirectAnnotation: "scheme"},
+			&Redirect{Type: RedirectScheme, Target: "https", Code: 302},
+			"redirect scheme https code 302",
+		},
+		{
+			map[string]string{RedirectAnnotation: "scheme", RedirectTargetAnnotation: "https", RedirectCodeAnnotation: "301"},
+			&Redirect{Type: RedirectScheme, Target: "https", Code: 301},
+			"redirect scheme https code 301",
+		},
+		{
+			map[string]string{RedirectAnnotation: " location ", RedirectTargetAnnotation: " https://example.com/ ", RedirectCodeAnnotation: "308"},
+			&Redirect{Type: RedirectLocation, Target: "https://example.com/", Code: 308},
+			"redirect location https://example.com/ code 308",
+		},
+		{
+			map[string]string{RedirectAnnotation: "prefix", RedirectTargetAnnotation: "https://example.com"},
+			&Redirect{Type: RedirectPrefix, Target: "https://example.com", Code: 302},
+			"redirect prefix https://example.com code 302",
+		},
+		{
+			map[string]string{RedirectAnnotation: "location", RedirectTargetAnnotation: "https://example.com", RedirectCodeAnnotation: "200"},
+			&Redirect{Type: RedirectLocation, Target: "https://example.com", Code: 302},
+			"redirect location https://example.com code 302",
+		},
+		{map[string]string{RedirectAnnotation: "location"}, nil, ""},
+		{map[string]string{RedirectAnnotation: "location", RedirectTargetAnnotation: "https://example.com if TRUE"}, nil, ""},
+		{map[string]string{RedirectAnnotation: "host", RedirectTargetAnnotation: "example.com"}, nil, ""},
+	}
+
+	for _, c := range cases {
+		service, endpoints := newTestService("service1", c.Annotations)
+		client := newTestStoresClient(service, endpoints)
+		services, err := client.getServices()
+		if assert.NoError(t, err) && assert.Equal(t, 1, len(services)) {
+			assert.Equal(t, c.Expected, services[0].Redirect, "redirect for %v", c.Annotations)
+			if c.Expected != nil {
+				assert.Equal(t, c.Rule, services[0].Redirect.Rule())
+			}
+		}
+	}
+}
+
+func TestReadyAnnotation(t *testing.T) {
+	defer func(annotation string) { readyAnnotation = annotation }(readyAnnotation)
+	readyAnnotation = "example.com/lb-ready"
+
+	newPod := func(name, ready string) *v1.Pod {
+		pod := &v1.Pod{ObjectMeta: meta_v1.ObjectMeta{SelfLink: "/pod/" + name, Name: name, Namespace: "test"}}
+		if ready != "" {
+			pod.Annotations = map[string]string{readyAnnotation: ready}
+		}
+		return pod
+	}
+
+	service, endpoints := newTestService("service1", nil)
+	endpoints.Subsets[0].Addresses = []v1.EndpointAddress{
+		{IP: "10.0.0.1", TargetRef: &v1.ObjectReference{Kind: "Pod", Name: "pod-a", Namespace: "test"}},
+		{IP: "10.0.0.2", TargetRef: &v1.ObjectReference{Kind: "Pod", Name: "pod-b", Namespace: "test"}},
+		{IP: "10.0.0.3", TargetRef: &v1.ObjectReference{Kind: "Pod", Name: "pod-c", Namespace: "test"}},
+		{IP: "10.0.0.4", TargetRef: &v1.ObjectReference{Kind: "Pod", Name: "pod-d", Namespace: "test"}},
+		{IP: "10.0.0.5"},
+	}
+	endpoints.Subsets[0].NotReadyAddresses = []v1.EndpointAddress{
+		{IP: "10.0.0.6", TargetRef: &v1.ObjectReference{Kind: "Pod", Name: "pod-e", Namespace: "test"}},
+	}
+	client := newTestStoresClient(service, endpoints,
+		newPod("pod-a", "true"),
+		newPod("pod-b", "false"),
+		newPod("pod-c", ""),
+		newPod("pod-e", "true"),
+	)
+
+	services, err := client.getServices()
+	if assert.NoError(t, err) && assert.Equal(t, 1, len(services)) {
+		assert.Equal(t, []string{"10.0.0.1", "10.0.0.5"}, endpointsIPs(services[0].Endpoints), "only pods passing the gate and endpoints without pods should be ready")
+		assert.Equal(t, []string{"10.0.0.2", "10.0.0.3", "10.0.0.4", "10.0.0.6"}, endpointsIPs(services[0].NotReady))
+		for _, e := range services[0].NotReady {
+			assert.False(t, e.Ready)
+		}
+	}
+
+	// Endpoints in the store are not modified
+	assert.Equal(t, 5, len(endpoints.Subsets[0].Addresses))
+
+	readyAnnotation = ""
+	services, err = client.getServices()
+	if assert.NoError(t, err) && assert.Equal(t, 1, len(services)) {
+		assert.Equal(t, 5, len(services[0].Endpoints), "pods shouldn't be considered without ready annotation")
+	}
+}
+
+func TestRateLimitAnnotation(t *testing.T) {
+	cases := []struct {
+		Annotation string
+		Expected   int
+	}{
+		{"", 0},
+		{"100", 100},
+		{" 50 ", 50},
+		{"0", 0},
+		{"-10", 0},
+		{"10.5", 0},
+		{"foo", 0},
+	}
+
+	for _, c := range cases {
+		service, endpoints := newTestService("service1", map[string]string{RateLimitAnnotation: c.Annotation})
+		client := newTestStoresClient(service, endpoints)
+		services, err := client.getServices()
+		if assert.NoError(t, err) && assert.Equal(t, 1, len(services)) {
+			assert.Equal(t, c.Expected, services[0].RateLimit, "rate limit for %q", c.Annotation)
+		}
+	}
+}
+
+func TestRetriesAnnotation(t *testing.T) {
+	cases := []struct {
+		Default    int
+		Annotation string
+		Expected   int
+	}{
+		{0, "", 0},
+		{3, "", 3},
+		{0, "5", 5},
+		{3, " 1 ", 1},
+		{3, "0", 0},
+		{3, "-2", 0},
+		{-1, "", 0},
+		{3, "many", 3},
+	}
+
+	defer func(retries int) { defaultRetries = retries }(defaultRetries)
+	for _, c := range cases {
+		defaultRetries = c.Default
+		service, endpoints := newTestService("service1", map[string]string{RetriesAnnotation: c.Annotation})
+		client := newTestStoresClient(service, endpoints)
+		services, err := client.getServices()
+		if assert.NoError(t, err) && assert.Equal(t, 1, len(services)) {
+			assert.Equal(t, c.Expected, services[0].Retries, "retries for %q with default %d", c.Annotation, c.Default)
+		}
+	}
+}
+
+func TestMinEndpointsAnnotation(t *testing.T) {
+	service, _ := newTestService("service1", map[string]string{MinEndpointsAnnotation: "2"})
+	client := newTestStoresClient(service)
+
+	setEndpoints := func(ips ...string) {
+		endpoints := &v1.Endpoints{
+			ObjectMeta: meta_v1.ObjectMeta{SelfLink: "/endpoints/service1", Name: "service1", Namespace: "test"},
+		}
+		if len(ips) > 0 {
+			subset := v1.EndpointSubset{Ports: []v1.EndpointPort{{Name: "http", Port: 80}}}
+			for _, ip := range ips {
+				subset.Addresses = append(subset.Addresses, v1.EndpointAddress{IP: ip})
+			}
+			endpoints.Subsets = []v1.EndpointSubset{subset}
+		}
+		client.endpointsStore.Update(endpoints)
+	}
+
+	steps := []struct {
+		IPs      []string
+		Included bool
+	}{
+		{[]string{"10.0.0.1"}, false},
+		{[]string{"10.0.0.1", "10.0.0.2"}, true},
+		{[]string{"10.0.0.1"}, true},
+		{nil, false},
+		{[]string{"10.0.0.1"}, false},
+		{[]string{"10.0.0.1", "10.0.0.2", "10.0.0.3"}, true},
+	}
+	for i, step := range steps {
+		setEndpoints(step.IPs...)
+		services, err := client.getServices()
+		if assert.NoError(t, err) {
+			if assert.Equal(t, step.Included, len(services) == 1, "step %d, endpoints %v", i, step.IPs) && step.Included {
+				assert.Equal(t, 2, services[0].MinEndpoints)
+				assert.Equal(t, len(step.IPs), services[0].ReadyCount())
+			}
+		}
+	}
+
+	// Invalid values are ignored
+	for _, annotation := range []string{"-1", "foo"} {
+		service, endpoints := newTestService("service1", map[string]string{MinEndpointsAnnotation: annotation})
+		services, err := newTestStoresClient(service, endpoints).getServices()
+		if assert.NoError(t, err) && assert.Equal(t, 1, len(services)) {
+			assert.Equal(t, defaultMinEndpoints, services[0].MinEndpoints)
+		}
+	}
+}
+
+func TestTimeoutsAnnotation(t *testing.T) {
+	cases := []struct {
+		Annotations map[string]string
+		Expected    Timeouts
+	}{
+		{nil, Timeouts{}},
+		{map[string]string{BackendTimeoutAnnotation: `{"http": 20000}`}, Timeouts{Server: 20000}},
+		{map[string]string{TimeoutsAnnotation: `{"http": {"connect": 5000, "queue": 10000}}`}, Timeouts{Connect: 5000, Queue: 10000}},
+		{map[string]string{TimeoutsAnnotation: `{"other": {"connect": 5000}}`}, Timeouts{}},
+		{
+			map[string]string{
+				TimeoutsAnnotation:       `{"*": {"connect": 1000, "client": 30000, "server": 40000}, "http": {"connect": 5000}}`,
+				BackendTimeoutAnnotation: `{"http": 20000}`,
+			},
+			Timeouts{Connect: 5000, Client: 30000, Server: 40000},
+		},
+		{
+			map[string]string{
+				TimeoutsAnnotation:       `{"*": {"client": 30000}, "http": {"server": 50000}}`,
+				BackendTimeoutAnnotation: `{"http": 20000}`,
+			},
+			Timeouts{Client: 30000, Server: 50000},
+		},
+		{map[string]string{TimeoutsAnnotation: `invalid`, BackendTimeoutAnnotation: `{"http": 20000}`}, Timeouts{Server: 20000}},
+	}
+
+	for _, c := range cases {
+		service, endpoints := newTestService("service1", c.Annotations)
+		client := newTestStoresClient(service, endpoints)
+		services, err := client.getServices()
+		if assert.NoError(t, err) && assert.Equal(t, 1, len(services)) {
+			assert.Equal(t, c.Expected, services[0].Timeouts, "timeouts for %v", c.Annotations)
+		}
+	}
+}
+
+func TestDrainTimeoutAnnotation(t *testing.T) {
+	cases := []struct {
+		Annotation string
+		Default    time.Duration
+		Expected   time.Duration
+	}{
+		{"", 0, 0},
+		{"", 10 * time.Second, 10 * time.Second},
+		{"30s", 0, 30 * time.Second},
+		{"1m30s", 10 * time.Second, 90 * time.Second},
+		{"500ms", 0, 500 * time.Millisecond},
+		{"0s", 10 * time.Second, 0},
+		{"30", 10 * time.Second, 10 * time.Second},
+		{"-5s", 10 * time.Second, 10 * time.Second},
+		{"forever", 0, 0},
+	}
+
+	defer func(d time.Duration) { defaultDrainTimeout = d }(defaultDrainTimeout)
+	for _, c := range cases {
+		defaultDrainTimeout = c.Default
+		service, endpoints := newTestService("service1", map[string]string{DrainTimeoutAnnotation: c.Annotation})
+		client := newTestStoresClient(service, endpoints)
+		services, err := client.getServices()
+		if assert.NoError(t, err) && assert.Equal(t, 1, len(services)) {
+			assert.Equal(t, c.Expected, services[0].DrainTimeout, "drain timeout for %q", c.Annotation)
+		}
+	}
+}
+
+func TestEndpointIPFamily(t *testing.T) {
+	service, endpoints := newTestService("service1", nil)
+	endpoints.Subsets = []v1.EndpointSubset{
+		{
+			Addresses:         []v1.EndpointAddress{{IP: "10.0.0.1"}, {IP: "fd00::1"}, {IP: "10.0.0.2"}},
+			NotReadyAddresses: []v1.EndpointAddress{{IP: "fd00::2"}, {IP: "10.0.0.3"}},
+			Ports:             []v1.EndpointPort{{Name: "http", Port: 80}},
+		},
+	}
+	cases := []struct {
+		Family   string
+		Ready    []string
+		NotReady []string
+	}{
+		{IPFamilyAll, []string{"10.0.0.1", "10.0.0.2", "fd00::1"}, []string{"10.0.0.3", "fd00::2"}},
+		{IPFamilyV4, []string{"10.0.0.1", "10.0.0.2"}, []string{"10.0.0.3"}},
+		{IPFamilyV6, []string{"fd00::1"}, []string{"fd00::2"}},
+	}
+
+	defer func(family string) { endpointIPFamily = family }(endpointIPFamily)
+	client := newTestStoresClient(service, endpoints)
+	for _, c := range cases {
+		endpointIPFamily = c.Family
+		services, err := client.getServices()
+		if assert.NoError(t, err) && assert.Equal(t, 1, len(services)) {
+			assert.Equal(t, c.Ready, endpointsIPs(services[0].Endpoints), "ready endpoints for %s", c.Family)
+			assert.Equal(t, c.NotReady, endpointsIPs(services[0].NotReady), "not ready endpoints for %s", c.Family)
+		}
+	}
+
+	endpointIPFamily = "v5"
+	assert.Error(t, client.Update(context.Background()), "update should fail with invalid IP family")
+}
+
+func TestEndpointsOrder(t *testing.T) {
+	addresses := []v1.EndpointAddress{
+		{IP: "10.0.0.10", TargetRef: &v1.ObjectReference{Name: "pod-a"}},
+		{IP: "10.0.0.9", TargetRef: &v1.ObjectReference{Name: "pod-c"}},
+		{IP: "10.0.0.2", TargetRef: &v1.ObjectReference{Name: "pod-b"}},
+	}
+	reversed := []v1.EndpointAddress{addresses[2], addresses[1], addresses[0]}
+
+	cases := []struct {
+		Default    string
+		Annotation string
+		Expected   []string
+	}{
+		{EndpointsOrderNone, "", nil},
+		{EndpointsOrderIP, "", []string{"10.0.0.2", "10.0.0.9", "10.0.0.10"}},
+		{EndpointsOrderNone, "ip", []string{"10.0.0.2", "10.0.0.9", "10.0.0.10"}},
+		{EndpointsOrderNone, " name ", []string{"10.0.0.10", "10.0.0.2", "10.0.0.9"}},
+		{EndpointsOrderName, "random", []string{"10.0.0.10", "10.0.0.2", "10.0.0.9"}},
+	}
+
+	defer func(order string) { defaultEndpointsOrder = order }(defaultEndpointsOrder)
+	for _, c := range cases {
+		defaultEndpointsOrder = c.Default
+		var orders [][]string
+		for _, subsetAddresses := range [][]v1.EndpointAddress{addresses, reversed} {
+			service, endpoints := newTestService("service1", map[string]string{EndpointsOrderAnnotation: c.Annotation})
+			endpoints.Subsets[0].Addresses = subsetAddresses
+			client := newTestStoresClient(service, endpoints)
+			services, err := client.getServices()
+			if !assert.NoError(t, err) || !assert.Equal(t, 1, len(services)) {
+				continue
+			}
+			var ips []string
+			for _, e := range services[0].Endpoints {
+				ips = append(ips, e.IP)
+			}
+			orders = append(orders, ips)
+		}
+		if c.Expected == nil {
+			assert.NotEqual(t, orders[0], orders[1], "original order expected with %s order", c.Default)
+			continue
+		}
+		for _, ips := range orders {
+			assert.Equal(t, c.Expected, ips, "order for default %s and annotation %q", c.Default, c.Annotation)
+		}
+	}
+
+	defaultEndpointsOrder = "random"
+	client := newTestStoresClient(newTestService("service1", nil))
+	assert.Error(t, client.Update(context.Background()), "update should fail with invalid endpoints order")
+}
+
+func TestRenderMetrics(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kube2lb-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sourcePath := dir + "/test.tpl"
+	configPath := dir + "/test.cfg"
+	if err := ioutil.WriteFile(sourcePath, []byte("{{ range .Services }}{{ .Name }}\n{{ end }}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	service1, endpoints1 := newTestService("service1", nil)
+	service2, endpoints2 := newTestService("service2", nil)
+	endpoints2.Subsets[0].NotReadyAddresses = []v1.EndpointAddress{{IP: "10.0.0.3"}}
+	client := newTestStoresClient(service1, endpoints1, service2, endpoints2)
+	client.AddTemplate(NewTemplate(sourcePath, configPath, ""))
+	client.AddTemplate(NewConfigMapTemplate(newFakeConfigMapClient(), sourcePath, "", "lb", "haproxy.cfg"))
+
+	if !assert.NoError(t, client.Update(context.Background())) {
+		return
+	}
+	assert.Equal(t, int64(2), renderedBackends.Value())
+	assert.Equal(t, int64(5), renderedServers.Value(), "ready and not ready servers should be counted")
+	for _, target := range []string{configPath, "configmap:lb/haproxy.cfg"} {
+		if size, ok := configSize.Get(target).(*expvar.Int); assert.True(t, ok, "size expected for %s", target) {
+			assert.Equal(t, int64(len("service1\nservice2\n")), size.Value())
+		}
+	}
+
+	client.serviceStore.Delete(service2)
+	if assert.NoError(t, client.Update(context.Background())) {
+		assert.Equal(t, int64(1), renderedBackends.Value())
+		assert.Equal(t, int64(2), renderedServers.Value())
+		if size, ok := configSize.Get(configPath).(*expvar.Int); assert.True(t, ok) {
+			assert.Equal(t, int64(len("service1\n")), size.Value())
+		}
+	}
+
+	// Metrics are not recorded if any template fails
+	defer func(size int) { maxConfigSize = size }(maxConfigSize)
+	maxConfigSize = len("service1\n")
+	client.serviceStore.Update(service2)
+	if assert.NoError(t, client.Update(context.Background())) {
+		assert.Equal(t, int64(1), renderedBackends.Value())
+		assert.Equal(t, int64(2), renderedServers.Value())
+		for _, target := range []string{configPath, "configmap:lb/haproxy.cfg"} {
+			if size, ok := configSize.Get(target).(*expvar.Int); assert.True(t, ok, "size expected for %s", target) {
+				assert.Equal(t, int64(len("service1\n")), size.Value(), "size of failed configuration recorded for %s", target)
+			}
+		}
+	}
+}
+
+func TestServiceChangesMetric(t *testing.T) {
+	serviceWatcher := newTestWatcher()
+	endpointsWatcher := newTestWatcher()
+	eventForwarderChan := make(chan struct{}, 100)
+
+	updater := dummyUpdater{}
+	client := &KubernetesClient{
+		nodeWatcher:      newTestWatcher(),
+		serviceWatcher:   serviceWatcher,
+		endpointsWatcher: endpointsWatcher,
+		updaterBuilder:   updater.Build,
+		eventForwarder: func(watch.Event) {
+			eventForwarderChan <- struct{}{}
+		},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go client.Watch(ctx)
+
+	changes := func(key string) int64 {
+		if v, ok := serviceChanges.Get(key).(*expvar.Int); ok {
+			return v.Value()
+		}
+		return 0
+	}
+	send := func(w *testWatcher, e watch.Event) {
+		w.resultChan <- e
+		select {
+		case <-eventForwarderChan:
+		case <-time.After(100 * time.Millisecond):
+			t.Fatal("event consumption timeout")
+		}
+	}
+
+	service, endpoints := newTestService("metrics1", nil)
+	other, otherEndpoints := newTestService("metrics2", nil)
+
+	send(serviceWatcher, watch.Event{Type: watch.Added, Object: service})
+	send(serviceWatcher, watch.Event{Type: watch.Added, Object: other})
+	send(endpointsWatcher, watch.Event{Type: watch.Added, Object: endpoints})
+	send(endpointsWatcher, watch.Event{Type: watch.Added, Object: otherEndpoints})
+	assert.Equal(t, int64(2), changes("test/metrics1"))
+	assert.Equal(t, int64(2), changes("test/metrics2"))
+
+	// Repeated objects don't signal updates and are not counted
+	send(endpointsWatcher, watch.Event{Type: watch.Modified, Object: endpoints})
+	assert.Equal(t, int64(2), changes("test/metrics1"))
+
+	modified := *endpoints
+	modified.ResourceVersion = "2"
+	modified.Subsets = []v1.EndpointSubset{{
+		Addresses: []v1.EndpointAddress{{IP: "10.0.0.1"}},
+		Ports:     endpoints.Subsets[0].Ports,
+	}}
+	send(endpointsWatcher, watch.Event{Type: watch.Modified, Object: &modified})
+	assert.Equal(t, int64(3), changes("test/metrics1"))
+	assert.Equal(t, int64(2), changes("test/metrics2"))
+}
+
+func TestFailOnEmpty(t *testing.T) {
+	defer func(fail bool) { failOnEmpty = fail }(failOnEmpty)
+	failOnEmpty = true
+
+	client := newTestStoresClient()
+	template := &dummyTemplate{}
+	client.AddTemplate(template)
+	assert.Error(t, client.Update(context.Background()), "first update without services should fail")
+	assert.Equal(t, 0, template.executionCount, "templates shouldn't be executed without services")
+
+	service, endpoints := newTestService("service1", nil)
+	client = newTestStoresClient(service, endpoints)
+	client.AddTemplate(template)
+	if assert.NoError(t, client.Update(context.Background())) {
+		assert.Equal(t, 1, template.executionCount)
+	}
+
+	// Only first update fails
+	client.serviceStore.Delete(service)
+	if assert.NoError(t, client.Update(context.Background())) {
+		assert.Equal(t, 2, template.executionCount)
+	}
+}
+
+// newTestMultiPortServices returns n services with two ports and several
+// external domains, with their endpoints and a node for each one
+func newTestMultiPortServices(n int) []runtime.Object {
+	var objects []runtime.Object
+	for i := 0; i < n; i++ {
+		name := fmt.Sprintf("service%d", i)
+		service, endpoints := newTestService(name, map[string]string{
+			ExternalDomainsAnnotation: fmt.Sprintf("a.%[1]s.example.com,b.%[1]s.example.com,c.%[1]s.example.com", name),
+			PortModeAnnotation:        `{"https": "tcp"}`,
+		})
+		service.Spec.Ports = append(service.Spec.Ports, v1.ServicePort{Name: "https", Port: 443, TargetPort: intstr.FromInt(443)})
+		endpoints.Subsets[0].Ports = append(endpoints.Subsets[0].Ports, v1.EndpointPort{Name: "https", Port: 443})
+		objects = append(objects, service, endpoints)
+		objects = append(objects, &v1.Node{ObjectMeta: meta_v1.ObjectMeta{SelfLink: "/node/" + name, Name: "node-" + name}})
+	}
+	return objects
+}
+
+func TestStableRendering(t *testing.T) {
+	defer func(templates []*template.Template) { serverNameTemplates = templates }(serverNameTemplates)
+	var err error
+	serverNameTemplates, err = parseServerNameTemplatesArg("{{ .Service.Name }}.{{ .Domain }},{{ .Service.Name }}.{{ .Service.Namespace }}.{{ .Domain }},www.{{ .Service.Name }}.{{ .Domain }}")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := newTestStoresClient(newTestMultiPortServices(8)...)
+
+	dir, err := ioutil.TempDir("", "kube2lb-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sourcePath := path.Join(dir, "test.tpl")
+	source := `{{ range .Nodes }}node {{ . }}
+{{ end }}{{ range .Ports }}port {{ . }}
+{{ end }}{{ range $service := .Services }}service {{ $service }}{{ range ServerNames $service $.Domain }} {{ . }}{{ end }}
+{{ end }}`
+	if err := ioutil.WriteFile(sourcePath, []byte(source), 0644); err != nil {
+		t.Fatal(err)
+	}
+	client.AddTemplate(NewTemplate(sourcePath, path.Join(dir, "test.cfg"), ""))
+	notifier := newTestNotifier()
+	client.AddNotifier(notifier)
+
+	if assert.NoError(t, client.Update(context.Background())) {
+		assert.NoError(t, notifier.Wait(), "first update should notify")
+	}
+	for i := 0; i < 10; i++ {
+		if assert.NoError(t, client.Update(context.Background())) {
+			assert.Equal(t, 0, len(notifier.waitChan), "update %d without changes shouldn't notify", i)
+		}
+	}
+}
+
+func TestClusterDomains(t *testing.T) {
+	service, endpoints := newTestService("service1", nil)
+	client := newTestStoresClient(service, endpoints)
+	client.domain = "cluster.local, example.com"
+	template := &dummyTemplate{}
+	client.AddTemplate(template)
+
+	if assert.NoError(t, client.Update(context.Background())) && assert.NotNil(t, template.lastExecutedWith) {
+		assert.Equal(t, "cluster.local", template.lastExecutedWith.Domain)
+		assert.Equal(t, []string{"cluster.local", "example.com"}, template.lastExecutedWith.Domains)
+	}
+}
+
+func TestServiceSettingsConfigMap(t *testing.T) {
+	service1, endpoints1 := newTestService("service1", map[string]string{
+		BalanceAnnotation: "leastconn",
+	})
+	service2, endpoints2 := newTestService("service2", nil)
+	service3, endpoints3 := newTestService("service3", nil)
+	settings := &v1.ConfigMap{
+		ObjectMeta: meta_v1.ObjectMeta{SelfLink: "/configmap/settings", Name: "settings", Namespace: "kube-system"},
+		Data: map[string]string{
+			"test.service1": "kube2lb/balance: source\nkube2lb/retries: \"3\"\n",
+			"test.service2": `{"kube2lb/balance": "source"}`,
+			"test.service3": "invalid: [",
+		},
+	}
+	client := newTestStoresClient(service1, endpoints1, service2, endpoints2, service3, endpoints3, settings)
+
+	services, err := client.getServices()
+	if !assert.NoError(t, err) || !assert.Equal(t, 3, len(services)) {
+		return
+	}
+	for _, s := range services {
+		switch s.Name {
+		case "service1":
+			assert.Equal(t, "leastconn", s.Balance, "annotations should override settings")
+			assert.Equal(t, 3, s.Retries)
+		case "service2":
+			assert.Equal(t, "source", s.Balance)
+		case "service3":
+			assert.Equal(t, defaultBalance, s.Balance, "invalid settings should be ignored")
+		}
+	}
+
+	// Services in the store are not modified
+	assert.Equal(t, map[string]string{BalanceAnnotation: "leastconn"}, service1.Annotations)
+	assert.Nil(t, service2.Annotations)
+}
+
+func TestDefaultServerAnnotation(t *testing.T) {
+	cases := []struct {
+		Annotation string
+		Expected   *DefaultServer
+		Options    string
+	}{
+		{"", nil, ""},
+		{`{"inter": 2000, "rise": 2, "fall": 3}`, &DefaultServer{Inter: 2000, Rise: 2, Fall: 3}, "inter 2000 rise 2 fall 3"},
+		{`{"fall": 5}`, &DefaultServer{Fall: 5}, "fall 5"},
+		{`{}`, nil, ""},
+		{`{"inter": -1, "rise": 2}`, nil, ""},
+		{`inter 2000`, nil, ""},
+	}
+
+	for _, c := range cases {
+		var annotations map[string]string
+		if c.Annotation != "" {
+			annotations = map[string]string{DefaultServerAnnotation: c.Annotation}
+		}
+		service, endpoints := newTestService("service1", annotations)
+		client := newTestStoresClient(service, endpoints)
+		services, err := client.getServices()
+		if assert.NoError(t, err) && assert.Equal(t, 1, len(services)) {
+			assert.Equal(t, c.Expected, services[0].DefaultServer, c.Annotation)
+			if c.Expected != nil {
+				assert.Equal(t, c.Options, services[0].DefaultServer.Options())
+			}
+		}
+	}
+}
+
+func TestAgentCheckAnnotation(t *testing.T) {
+	cases := []struct {
+		Annotation string
+		Expected   *AgentCheck
+		Options    string
+	}{
+		{"", nil, ""},
+		{`{"port": 9999}`, &AgentCheck{Port: 9999}, "agent-check agent-port 9999"},
+		{`{"port": 9999, "interval": 2000}`, &AgentCheck{Port: 9999, Interval: 2000}, "agent-check agent-port 9999 agent-inter 2000"},
+		{`{"interval": 2000}`, nil, ""},
+		{`{"port": 70000}`, nil, ""},
+		{`{"port": 9999, "interval": -1}`, nil, ""},
+		{`9999`, nil, ""},
+	}
+
+	for _, c := range cases {
+		var annotations map[string]string
+		if c.Annotation != "" {
+			annotations = map[string]string{AgentCheckAnnotation: c.Annotation}
+		}
+		service, endpoints := newTestService("service1", annotations)
+		client := newTestStoresClient(service, endpoints)
+		services, err := client.getServices()
+		if assert.NoError(t, err) && assert.Equal(t, 1, len(services)) {
+			assert.Equal(t, c.Expected, services[0].AgentCheck, c.Annotation)
+			if c.Expected != nil {
+				assert.Equal(t, c.Options, services[0].AgentCheck.Options())
+			}
+		}
+	}
+}
+
+func TestWatchNamespace(t *testing.T) {
+	var lock sync.Mutex
+	var paths []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		paths = append(paths, r.URL.Path)
+		lock.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/api/v1/namespaces/team/services":
+			fmt.Fprintln(w, `{"type":"ADDED","object":{"kind":"Service","apiVersion":"v1","metadata":{"name":"service1","namespace":"team"}}}`)
+		case "/api/v1/services":
+			fmt.Fprintln(w, `{"type":"ADDED","object":{"kind":"Service","apiVersion":"v1","metadata":{"name":"service1","namespace":"other"}}}`)
+		}
+	}))
+	defer server.Close()
+
+	defer func(namespace string) { watchNamespace = namespace }(watchNamespace)
+	watchNamespace = "team"
+
+	client, err := NewKubernetesClient("", server.URL, "cluster.local")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer client.stopWatchers()
+
+	select {
+	case e := <-client.serviceWatcher.ResultChan():
+		if service, ok := e.Object.(*v1.Service); assert.True(t, ok, "service expected") {
+			assert.Equal(t, "team", service.Namespace)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("service event timeout")
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	assert.Contains(t, paths, "/api/v1/namespaces/team/services")
+	assert.Contains(t, paths, "/api/v1/namespaces/team/endpoints")
+	assert.NotContains(t, paths, "/api/v1/services")
+	assert.NotContains(t, paths, "/api/v1/endpoints")
+}
+
+func TestALPNAnnotations(t *testing.T) {
+	cases := []struct {
+		Annotations map[string]string
+		HTTP2       bool
+		ALPN        []string
+		Option      string
+	}{
+		{nil, false, nil, ""},
+		{map[string]string{HTTP2Annotation: "false"}, false, nil, ""},
+		{map[string]string{HTTP2Annotation: "true"}, true, []string{"h2", "http/1.1"}, "alpn h2,http/1.1"},
+		{map[string]string{HTTP2Annotation: "true", ALPNAnnotation: "h2"}, true, []string{"h2"}, "alpn h2"},
+		{map[string]string{ALPNAnnotation: " http/1.1 , h2 "}, false, []string{"http/1.1", "h2"}, "alpn http/1.1,h2"},
+		{map[string]string{ALPNAnnotation: "h2 if TRUE"}, false, nil, ""},
+		{map[string]string{HTTP2Annotation: "yes"}, false, nil, ""},
+	}
+
+	for _, c := range cases {
+		service, endpoints := newTestService("service1", c.Annotations)
+		client := newTestStoresClient(service, endpoints)
+		services, err := client.getServices()
+		if assert.NoError(t, err) && assert.Equal(t, 1, len(services)) {
+			assert.Equal(t, c.HTTP2, services[0].HTTP2, "%v", c.Annotations)
+			assert.Equal(t, c.ALPN, services[0].ALPN, "%v", c.Annotations)
+			assert.Equal(t, c.Option, services[0].ALPNOption(), "%v", c.Annotations)
+		}
+	}
+}
+
+func TestMaxEndpointsPerService(t *testing.T) {
+	defer func(max int) { maxEndpointsPerService = max }(maxEndpointsPerService)
+
+	service, endpoints := newTestService("service1", nil)
+	var addresses []v1.EndpointAddress
+	for i := 1; i <= 10; i++ {
+		addresses = append(addresses, v1.EndpointAddress{IP: fmt.Sprintf("10.0.0.%d", i)})
+	}
+	endpoints.Subsets[0].Addresses = addresses
+
+	maxEndpointsPerService = 0
+	services, err := newTestStoresClient(service, endpoints).getServices()
+	if assert.NoError(t, err) && assert.Equal(t, 1, len(services)) {
+		assert.Equal(t, 10, len(services[0].Endpoints), "endpoints shouldn't be limited by default")
+	}
+
+	maxEndpointsPerService = 3
+	services, err = newTestStoresClient(service, endpoints).getServices()
+	if !assert.NoError(t, err) || !assert.Equal(t, 1, len(services)) {
+		return
+	}
+	selected := endpointsIPs(services[0].Endpoints)
+	assert.Equal(t, 3, len(selected))
+
+	services, err = newTestStoresClient(service, endpoints).getServices()
+	if assert.NoError(t, err) && assert.Equal(t, 1, len(services)) {
+		assert.Equal(t, selected, endpointsIPs(services[0].Endpoints), "the same endpoints should be selected on each update")
+	}
+
+	// Removing endpoints that were not selected doesn't change the selection
+	var remaining []v1.EndpointAddress
+	for _, address := range addresses {
+		if address.IP == selected[0] || address.IP == selected[1] || address.IP == selected[2] || len(remaining) < 4 {
+			remaining = append(remaining, address)
+		}
+	}
+	endpoints.Subsets[0].Addresses = remaining
+	services, err = newTestStoresClient(service, endpoints).getServices()
+	if assert.NoError(t, err) && assert.Equal(t, 1, len(services)) {
+		assert.Equal(t, selected, endpointsIPs(services[0].Endpoints))
+	}
+}
+
+func TestLimitEndpointsDraining(t *testing.T) {
+	endpoints := []ServiceEndpoint{
+		{IP: "10.0.0.1", Port: 80, Draining: true},
+		{IP: "10.0.0.2", Port: 80},
+		{IP: "10.0.0.3", Port: 80, Draining: true},
+		{IP: "10.0.0.4", Port: 80},
+	}
+	limited := limitEndpoints("test/service1:80", endpoints, 2)
+	assert.Equal(t, []string{"10.0.0.2", "10.0.0.4"}, endpointsIPs(limited), "draining endpoints should be discarded first")
+
+	limited = limitEndpoints("test/service1:80", endpoints, 3)
+	if assert.Equal(t, 3, len(limited)) {
+		for i := 1; i < len(limited); i++ {
+			assert.True(t, compareIPs(limited[i-1].IP, limited[i].IP) < 0, "order should be kept")
+		}
+	}
+}
+
+func TestEmitSourceComments(t *testing.T) {
+	defer func(emit bool) { emitSourceComments = emit }(emitSourceComments)
+
+	service, endpoints := newTestService("service1", nil)
+	service.ResourceVersion = "1234"
+	source := "{{ range .Services }}backend {{ .Name }}\n{{ with .SourceComment }}  {{ . }}\n{{ end }}{{ end }}"
+
+	emitSourceComments = false
+	services, err := newTestStoresClient(service, endpoints).getServices()
+	if assert.NoError(t, err) && assert.Equal(t, 1, len(services)) {
+		assert.Equal(t, "", services[0].ResourceVersion, "resource version shouldn't be set if comments are disabled")
+		content, err := executeTestTemplate(t, source, &ClusterInformation{Services: services})
+		if assert.NoError(t, err) {
+			assert.Equal(t, "backend service1\n", content)
+		}
+	}
+
+	emitSourceComments = true
+	services, err = newTestStoresClient(service, endpoints).getServices()
+	if assert.NoError(t, err) && assert.Equal(t, 1, len(services)) {
+		content, err := executeTestTemplate(t, source, &ClusterInformation{Services: services})
+		if assert.NoError(t, err) {
+			assert.Equal(t, "backend service1\n  # source: service test/service1 resourceVersion=1234\n", content)
+		}
+	}
+}
+
+func TestWeightAnnotation(t *testing.T) {
+	cases := []struct {
+		Annotation string
+		Weight     int
+		Weighted   bool
+	}{
+		{"", 1, false},
+		{"80", 80, true},
+		{" 0 ", 0, true},
+		{"256", 256, true},
+		{"257", 1, false},
+		{"-1", 1, false},
+		{"half", 1, false},
+	}
+
+	for _, c := range cases {
+		var annotations map[string]string
+		if c.Annotation != "" {
+			annotations = map[string]string{WeightAnnotation: c.Annotation}
+		}
+		service, endpoints := newTestService("service1", annotations)
+		services, err := newTestStoresClient(service, endpoints).getServices()
+		if assert.NoError(t, err) && assert.Equal(t, 1, len(services)) {
+			assert.Equal(t, c.Weight, services[0].Weight, c.Annotation)
+			assert.Equal(t, c.Weighted, services[0].Weighted, c.Annotation)
+		}
+	}
+}
+
+func TestEndpointsNoOpUpdates(t *testing.T) {
+	serviceWatcher := newTestWatcher()
+	endpointsWatcher := newTestWatcher()
+	eventForwarderChan := make(chan struct{}, 100)
+
+	updater := dummyUpdater{}
+	client := &KubernetesClient{
+		nodeWatcher:      newTestWatcher(),
+		serviceWatcher:   serviceWatcher,
+		endpointsWatcher: endpointsWatcher,
+		updaterBuilder:   updater.Build,
+		eventForwarder: func(watch.Event) {
+			eventForwarderChan <- struct{}{}
+		},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go client.Watch(ctx)
+
+	// signaled sends the event and returns true if the updater was signaled
+	signaled := func(w *testWatcher, e watch.Event) bool {
+		w.resultChan <- e
+		select {
+		case <-eventForwarderChan:
+		case <-time.After(100 * time.Millisecond):
+			t.Fatal("event consumption timeout")
+		}
+		s := updater.Signaled
+		updater.Signaled = false
+		return s
+	}
+
+	service, endpoints := newTestService("service1", nil)
+	endpoints.ResourceVersion = "1"
+	assert.True(t, signaled(serviceWatcher, watch.Event{Type: watch.Added, Object: service}))
+	assert.True(t, signaled(endpointsWatcher, watch.Event{Type: watch.Added, Object: endpoints}))
+
+	bumped := *endpoints
+	bumped.ResourceVersion = "2"
+	assert.False(t, signaled(endpointsWatcher, watch.Event{Type: watch.Modified, Object: &bumped}), "resource version bumps shouldn't signal updates")
+
+	readded := bumped
+	readded.ResourceVersion = "3"
+	assert.False(t, signaled(endpointsWatcher, watch.Event{Type: watch.Added, Object: &readded}), "objects added again without changes shouldn't signal updates")
+
+	renamed := readded
+	renamed.ResourceVersion = "4"
+	renamed.Subsets = []v1.EndpointSubset{{
+		Addresses: endpoints.Subsets[0].Addresses,
+		Ports:     []v1.EndpointPort{{Name: "web", Port: 80}},
+	}}
+	assert.True(t, signaled(endpointsWatcher, watch.Event{Type: watch.Modified, Object: &renamed}), "changes in port names should signal updates")
+
+	removed := renamed
+	removed.ResourceVersion = "5"
+	removed.Subsets = []v1.EndpointSubset{{
+		Addresses: endpoints.Subsets[0].Addresses[:1],
+		Ports:     renamed.Subsets[0].Ports,
+	}}
+	assert.True(t, signaled(endpointsWatcher, watch.Event{Type: watch.Modified, Object: &removed}), "changes in addresses should signal updates")
+
+	assert.True(t, signaled(serviceWatcher, watch.Event{Type: watch.Deleted, Object: service}), "deleted services should signal updates")
+}
+
+type concurrentTemplate struct {
+	running, maxRunning *int32
+	executed            int32
+	lock                *sync.Mutex
+	order               *[]string
+	name                string
+}
+
+func (t *concurrentTemplate) Execute(info *ClusterInformation) (bool, error) {
+	t.lock.Lock()
+	*t.running++
+	if *t.running > *t.maxRunning {
+		*t.maxRunning = *t.running
+	}
+	t.lock.Unlock()
+
+	time.Sleep(20 * time.Millisecond)
+
+	t.lock.Lock()
+	*t.running--
+	t.executed++
+	*t.order = append(*t.order, t.name)
+	t.lock.Unlock()
+	return t.name == "changed", nil
+}
+
+type orderedConcurrentTemplate struct {
+	*concurrentTemplate
+}
+
+func (orderedConcurrentTemplate) executeAfterPrevious() {}
+
+func TestRenderConcurrency(t *testing.T) {
+	defer func(concurrency int) { renderConcurrency = concurrency }(renderConcurrency)
+
+	var lock sync.Mutex
+	var running, maxRunning int32
+	var order []string
+	newTemplate := func(name string) *concurrentTemplate {
+		return &concurrentTemplate{running: &running, maxRunning: &maxRunning, lock: &lock, order: &order, name: name}
+	}
+
+	for _, concurrency := range []int{1, 2, 4} {
+		renderConcurrency = concurrency
+		running, maxRunning, order = 0, 0, nil
+
+		client := &KubernetesClient{}
+		var templates []*concurrentTemplate
+		for i := 0; i < 8; i++ {
+			name := fmt.Sprintf("fragment%d", i)
+			if i == 5 {
+				name = "changed"
+			}
+			template := newTemplate(name)
+			templates = append(templates, template)
+			client.AddTemplate(template)
+		}
+		ordered := newTemplate("ordered")
+		client.AddTemplate(orderedConcurrentTemplate{ordered})
+
+		assert.True(t, client.ExecuteTemplates(&ClusterInformation{}), "change in any template should be reported")
+		for _, template := range templates {
+			assert.Equal(t, int32(1), template.executed, "all templates should be executed once")
+		}
+		assert.Equal(t, int32(1), ordered.executed)
+		assert.True(t, maxRunning <= int32(concurrency), "%d templates running concurrently, limit is %d", maxRunning, concurrency)
+		if concurrency > 1 {
+			assert.True(t, maxRunning > 1, "templates should be executed concurrently")
+		}
+		if assert.Equal(t, 9, len(order)) {
+			assert.Equal(t, "ordered", order[8], "ordered templates should be executed after previous ones")
+		}
+	}
+}
@@ -0,0 +1,314 @@
+/*
+Copyright 2017 Tuenti Technologies S.L. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+const LeaderAnnotation = "kube2lb/leader"
+
+var leaseDuration = 15 * time.Second
+var leaseRetryPeriod = 2 * time.Second
+
+func init() {
+	flag.DurationVar(&leaseDuration, "leader-elect-lease-duration", leaseDuration, "Duration of the leadership lease, followers wait this time before taking over")
+	flag.DurationVar(&leaseRetryPeriod, "leader-elect-retry-period", leaseRetryPeriod, "Period between attempts to acquire or renew the leadership lease")
+}
+
+type LeaderRecord struct {
+	HolderIdentity       string    `json:"holderIdentity"`
+	LeaseDurationSeconds int       `json:"leaseDurationSeconds"`
+	AcquireTime          time.Time `json:"acquireTime"`
+	RenewTime            time.Time `json:"renewTime"`
+}
+
+// LeaderLock stores the leadership lease, Get returns nil if there is no
+// lease yet, and Update must fail if the lease has been modified by other
+// instance since the last Get
+type LeaderLock interface {
+	Get() (*LeaderRecord, error)
+	Create(LeaderRecord) error
+	Update(LeaderRecord) error
+}
+
+type configMapLeaderLock struct {
+	clientset       *kubernetes.Clientset
+	namespace, name string
+
+	configMap *v1.ConfigMap
+}
+
+func NewConfigMapLeaderLock(clientset *kubernetes.Clientset, definition string) (LeaderLock, error) {
+	namespace, name, err := parseNamespacedName(definition)
+	if err != nil {
+		return nil, err
+	}
+	return &configMapLeaderLock{clientset: clientset, namespace: namespace, name: name}, nil
+}
+
+func (l *configMapLeaderLock) Get() (*LeaderRecord, error) {
+	configMap, err := l.clientset.Core().ConfigMaps(l.namespace).Get(l.name, meta_v1.GetOptions{})
+	if errors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	l.configMap = configMap
+
+	var record LeaderRecord
+	if data, found := configMap.Annotations[LeaderAnnotation]; found {
+		if err := json.Unmarshal([]byte(data), &record); err != nil {
+			return nil, err
+		}
+	}
+	return &record, nil
+}
+
+func (l *configMapLeaderLock) Create(record LeaderRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	l.configMap, err = l.clientset.Core().ConfigMaps(l.namespace).Create(&v1.ConfigMap{
+		ObjectMeta: meta_v1.ObjectMeta{
+			Name:        l.name,
+			Namespace:   l.namespace,
+			Annotations: map[string]string{LeaderAnnotation: string(data)},
+		},
+	})
+	return err
+}
+
+func (l *configMapLeaderLock) Update(record LeaderRecord) error {
+	if l.configMap == nil {
+		return fmt.Errorf("lock not initialized, get it before updating it")
+	}
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	if l.configMap.Annotations == nil {
+		l.configMap.Annotations = make(map[string]string)
+	}
+	l.configMap.Annotations[LeaderAnnotation] = string(data)
+	l.configMap, err = l.clientset.Core().ConfigMaps(l.namespace).Update(l.configMap)
+	return err
+}
+
+type LeaderElector struct {
+	lock     LeaderLock
+	identity string
+
+	leaseDuration, renewDeadline, retryPeriod time.Duration
+
+	// Replaced in tests
+	now func() time.Time
+}
+
+func NewLeaderElector(lock LeaderLock, identity string) *LeaderElector {
+	return &LeaderElector{
+		lock:          lock,
+		identity:      identity,
+		leaseDuration: leaseDuration,
+		renewDeadline: leaseDuration * 2 / 3,
+		retryPeriod:   leaseRetryPeriod,
+		now:           time.Now,
+	}
+}
+
+// tryAcquireOrRenew returns true if this instance holds the lease after trying
+// to acquire or renew it
+func (e *LeaderElector) tryAcquireOrRenew() bool {
+	now := e.now()
+	record := LeaderRecord{
+		HolderIdentity:       e.identity,
+		LeaseDurationSeconds: int(e.leaseDuration / time.Second),
+		AcquireTime:          now,
+		RenewTime:            now,
+	}
+
+	old, err := e.lock.Get()
+	if err != nil {
+		log.Printf("Couldn't get leader lock: %s", err)
+		return false
+	}
+	if old == nil {
+		if err := e.lock.Create(record); err != nil {
+			log.Printf("Couldn't create leader lock: %s", err)
+			return false
+		}
+		return true
+	}
+
+	if old.HolderIdentity == e.identity {
+		record.AcquireTime = old.AcquireTime
+	} else if old.HolderIdentity != "" && old.RenewTime.Add(e.leaseDuration).After(now) {
+		return false
+	}
+
+	if err := e.lock.Update(record); err != nil {
+		log.Printf("Couldn't update leader lock: %s", err)
+		return false
+	}
+	return true
+}
+
+// Run blocks acquiring and renewing the leadership lease until the context
+// is done. Every time the lease is acquired, lead is called with a context
+// that is cancelled when the lease is lost.
+func (e *LeaderElector) Run(ctx context.Context, lead func(context.Context)) {
+	for {
+		if !e.acquire(ctx) {
+			return
+		}
+		log.Printf("Leadership acquired by %s", e.identity)
+
+		leaderCtx, cancel := context.WithCancel(ctx)
+		lead(leaderCtx)
+		e.renew(ctx)
+		cancel()
+
+		select {
+		case <-ctx.Done():
+			return
+		default:
+			log.Printf("Leadership lost by %s, standing by", e.identity)
+		}
+	}
+}
+
+func (e *LeaderElector) acquire(ctx context.Context) bool {
+	for {
+		if e.tryAcquireOrRenew() {
+			return true
+		}
+		select {
+		case <-time.After(e.retryPeriod):
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+func (e *LeaderElector) renew(ctx context.Context) {
+	lastRenew := e.now()
+	for {
+		select {
+		case <-time.After(e.retryPeriod):
+		case <-ctx.Done():
+			return
+		}
+		if e.tryAcquireOrRenew() {
+			lastRenew = e.now()
+		} else if e.now().Sub(lastRenew) > e.renewDeadline {
+			return
+		}
+	}
+}
+
+// leaderElectionUpdater only runs updates while leading, a new updater is
+// built for each leadership term
+type leaderElectionUpdater struct {
+	sync.Mutex
+
+	elector *LeaderElector
+	builder UpdaterBuilder
+	f       UpdaterFunc
+
+	signals chan struct{}
+}
+
+func NewLeaderElectionUpdaterBuilder(elector *LeaderElector, builder UpdaterBuilder) UpdaterBuilder {
+	return func(f UpdaterFunc) Updater {
+		return &leaderElectionUpdater{
+			elector: elector,
+			builder: builder,
+			f:       f,
+		}
+	}
+}
+
+func (u *leaderElectionUpdater) Run(ctx context.Context) {
+	u.elector.Run(ctx, func(leaderCtx context.Context) {
+		updater := u.builder(u.f)
+		go updater.Run(leaderCtx)
+
+		// Signals are forwarded from a different goroutine so watchers are
+		// never blocked by updaters of finished terms, signals pending when
+		// the term finishes are discarded
+		signals := make(chan struct{}, 1)
+		go func() {
+			for {
+				select {
+				case <-signals:
+					if leaderCtx.Err() == nil {
+						updater.Signal()
+					}
+				case <-leaderCtx.Done():
+					u.Lock()
+					if u.signals == signals {
+						u.signals = nil
+					}
+					u.Unlock()
+					return
+				}
+			}
+		}()
+
+		u.Lock()
+		u.signals = signals
+		u.Unlock()
+
+		// Configuration may be outdated if other instance was leading
+		u.Signal()
+	})
+}
+
+func (u *leaderElectionUpdater) Signal() {
+	u.Lock()
+	defer u.Unlock()
+	if u.signals == nil {
+		return
+	}
+	select {
+	case u.signals <- struct{}{}:
+	default:
+		// There is already a pending signal
+	}
+}
+
+func (c *KubernetesClient) EnableLeaderElection(lockDefinition, identity string) error {
+	lock, err := NewConfigMapLeaderLock(c.clientset, lockDefinition)
+	if err != nil {
+		return err
+	}
+	c.updaterBuilder = NewLeaderElectionUpdaterBuilder(NewLeaderElector(lock, identity), c.updaterBuilder)
+	return nil
+}
@@ -0,0 +1,232 @@
+/*
+Copyright 2017 Tuenti Technologies S.L. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// A lease shared by several test electors, each one with its own view of
+// the lease version to detect conflicts as the API server would do
+type testLease struct {
+	sync.Mutex
+	record  *LeaderRecord
+	version int
+}
+
+type testLeaderLock struct {
+	lease   *testLease
+	version int
+}
+
+func (l *testLeaderLock) Get() (*LeaderRecord, error) {
+	l.lease.Lock()
+	defer l.lease.Unlock()
+	l.version = l.lease.version
+	if l.lease.record == nil {
+		return nil, nil
+	}
+	record := *l.lease.record
+	return &record, nil
+}
+
+func (l *testLeaderLock) Create(record LeaderRecord) error {
+	l.lease.Lock()
+	defer l.lease.Unlock()
+	if l.lease.record != nil {
+		return fmt.Errorf("already exists")
+	}
+	l.lease.record = &record
+	l.lease.version++
+	return nil
+}
+
+func (l *testLeaderLock) Update(record LeaderRecord) error {
+	l.lease.Lock()
+	defer l.lease.Unlock()
+	if l.version != l.lease.version {
+		return fmt.Errorf("conflict")
+	}
+	l.lease.record = &record
+	l.lease.version++
+	return nil
+}
+
+type testClock struct {
+	sync.Mutex
+	t time.Time
+}
+
+func (c *testClock) Now() time.Time {
+	c.Lock()
+	defer c.Unlock()
+	return c.t
+}
+
+func (c *testClock) Advance(d time.Duration) {
+	c.Lock()
+	defer c.Unlock()
+	c.t = c.t.Add(d)
+}
+
+func newTestLeaderElector(lease *testLease, clock *testClock, identity string) *LeaderElector {
+	e := NewLeaderElector(&testLeaderLock{lease: lease}, identity)
+	e.leaseDuration = 15 * time.Second
+	e.renewDeadline = 10 * time.Second
+	e.retryPeriod = time.Millisecond
+	e.now = clock.Now
+	return e
+}
+
+func TestLeaderElectionTransitions(t *testing.T) {
+	lease := &testLease{}
+	clock := &testClock{t: time.Now()}
+	a := newTestLeaderElector(lease, clock, "a")
+	b := newTestLeaderElector(lease, clock, "b")
+
+	assert.True(t, a.tryAcquireOrRenew(), "first instance should acquire the lease")
+	assert.False(t, b.tryAcquireOrRenew(), "second instance shouldn't acquire a lease held by other instance")
+
+	acquireTime := lease.record.AcquireTime
+	clock.Advance(5 * time.Second)
+	assert.True(t, a.tryAcquireOrRenew(), "leader should renew its lease")
+	assert.Equal(t, acquireTime, lease.record.AcquireTime, "acquire time should be kept on renewals")
+	assert.Equal(t, clock.Now(), lease.record.RenewTime, "renew time should be updated on renewals")
+
+	clock.Advance(10 * time.Second)
+	assert.False(t, b.tryAcquireOrRenew(), "lease shouldn't be acquired before it expires")
+
+	clock.Advance(6 * time.Second)
+	assert.True(t, b.tryAcquireOrRenew(), "expired lease should be acquired by other instance")
+	assert.Equal(t, "b", lease.record.HolderIdentity)
+	assert.False(t, a.tryAcquireOrRenew(), "previous leader shouldn't renew a lease acquired by other instance")
+}
+
+func TestLeaderElectionConflict(t *testing.T) {
+	lease := &testLease{record: &LeaderRecord{HolderIdentity: "c"}}
+	clock := &testClock{t: time.Now()}
+	a := newTestLeaderElector(lease, clock, "a")
+	b := newTestLeaderElector(lease, clock, "b")
+
+	a.lock.Get()
+	assert.True(t, b.tryAcquireOrRenew(), "expired lease should be acquired")
+
+	// Simulate a concurrent update between a's get and update
+	aLock := a.lock.(*testLeaderLock)
+	assert.Error(t, aLock.Update(LeaderRecord{HolderIdentity: "a"}), "outdated lock shouldn't be updated")
+	assert.Equal(t, "b", lease.record.HolderIdentity)
+}
+
+type countingUpdater struct {
+	sync.Mutex
+	running, signals int
+}
+
+func (u *countingUpdater) Build(f UpdaterFunc) Updater {
+	return u
+}
+
+func (u *countingUpdater) Run(ctx context.Context) {
+	u.Lock()
+	u.running++
+	u.Unlock()
+	<-ctx.Done()
+	u.Lock()
+	u.running--
+	u.Unlock()
+}
+
+func (u *countingUpdater) Signal() {
+	u.Lock()
+	defer u.Unlock()
+	u.signals++
+}
+
+func (u *countingUpdater) State() (running, signals int) {
+	u.Lock()
+	defer u.Unlock()
+	return u.running, u.signals
+}
+
+func eventually(t *testing.T, condition func() bool, message string) {
+	timeout := time.After(2 * time.Second)
+	for !condition() {
+		select {
+		case <-timeout:
+			t.Fatal(message)
+		case <-time.After(time.Millisecond):
+		}
+	}
+}
+
+func TestLeaderElectionUpdater(t *testing.T) {
+	lease := &testLease{}
+	clock := &testClock{t: time.Now()}
+
+	// Other instance is leading
+	other := newTestLeaderElector(lease, clock, "other")
+	assert.True(t, other.tryAcquireOrRenew())
+
+	inner := &countingUpdater{}
+	elector := newTestLeaderElector(lease, clock, "test")
+	updater := NewLeaderElectionUpdaterBuilder(elector, inner.Build)(func(context.Context) {})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go updater.Run(ctx)
+
+	updater.Signal()
+	time.Sleep(10 * time.Millisecond)
+	running, signals := inner.State()
+	assert.Equal(t, 0, running, "updater shouldn't run while standing by")
+	assert.Equal(t, 0, signals, "updater shouldn't be signaled while standing by")
+
+	// Lease of the other instance expires
+	clock.Advance(16 * time.Second)
+	eventually(t, func() bool {
+		running, signals := inner.State()
+		return running == 1 && signals == 1
+	}, "updater should run and be signaled after acquiring leadership")
+
+	updater.Signal()
+	eventually(t, func() bool {
+		_, signals := inner.State()
+		return signals == 2
+	}, "updater should be signaled while leading")
+
+	// Other instance steals the lease, renewals fail until renew deadline
+	lease.Lock()
+	lease.record = &LeaderRecord{HolderIdentity: "other", RenewTime: clock.Now()}
+	lease.version++
+	lease.Unlock()
+	clock.Advance(11 * time.Second)
+	eventually(t, func() bool {
+		running, _ := inner.State()
+		return running == 0
+	}, "updater should stop after losing leadership")
+
+	updater.Signal()
+	time.Sleep(10 * time.Millisecond)
+	_, signals = inner.State()
+	assert.Equal(t, 2, signals, "updater shouldn't be signaled after losing leadership")
+}
@@ -47,14 +47,24 @@ func (s *LocalStore) Equal(o runtime.Object, n runtime.Object) (bool, error) {
 	return EqualResourceVersions(o, n)
 }
 
+// storeKey returns the key of an object in local stores, its namespace/name,
+// or only its name for objects without namespace. Self links are not used as
+// they are not populated by recent API servers
+func storeKey(o runtime.Object) string {
+	accessor, _ := meta.Accessor(o)
+	if accessor.GetNamespace() == "" {
+		return accessor.GetName()
+	}
+	return accessor.GetNamespace() + "/" + accessor.GetName()
+}
+
 func (s *LocalStore) Update(o runtime.Object) runtime.Object {
 	s.Lock()
 	defer s.Unlock()
 
-	accessor, _ := meta.Accessor(o)
-	link := accessor.GetSelfLink()
-	old := s.Objects[link]
-	s.Objects[link] = o
+	key := storeKey(o)
+	old := s.Objects[key]
+	s.Objects[key] = o
 	return old
 }
 
@@ -62,10 +72,9 @@ func (s *LocalStore) Delete(o runtime.Object) runtime.Object {
 	s.Lock()
 	defer s.Unlock()
 
-	accessor, _ := meta.Accessor(o)
-	link := accessor.GetSelfLink()
-	old := s.Objects[link]
-	delete(s.Objects, link)
+	key := storeKey(o)
+	old := s.Objects[key]
+	delete(s.Objects, key)
 	return old
 }
 
@@ -109,6 +118,11 @@ func (s *ServiceStore) List() ([]*v1.Service, error) {
 	return services, nil
 }
 
+type EndpointsLister interface {
+	Store
+	List() ([]*v1.Endpoints, error)
+}
+
 type EndpointsStore struct {
 	*LocalStore
 }
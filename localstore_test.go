@@ -20,12 +20,13 @@ import (
 	"testing"
 
 	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/client-go/pkg/api/v1"
 )
 
 func TestUpdate(t *testing.T) {
-	service1 := &v1.Service{ObjectMeta: meta_v1.ObjectMeta{SelfLink: "/foo/1", UID: "1"}}
-	service2 := &v1.Service{ObjectMeta: meta_v1.ObjectMeta{SelfLink: "/foo/1", UID: "2"}}
+	service1 := &v1.Service{ObjectMeta: meta_v1.ObjectMeta{Name: "foo", Namespace: "test", UID: "1"}}
+	service2 := &v1.Service{ObjectMeta: meta_v1.ObjectMeta{Name: "foo", Namespace: "test", UID: "2"}}
 
 	store := NewLocalStore()
 
@@ -47,8 +48,8 @@ func TestUpdate(t *testing.T) {
 }
 
 func TestDelete(t *testing.T) {
-	service1 := &v1.Service{ObjectMeta: meta_v1.ObjectMeta{SelfLink: "/foo/1", UID: "1"}}
-	service2 := &v1.Service{ObjectMeta: meta_v1.ObjectMeta{SelfLink: "/foo/1", UID: "2"}}
+	service1 := &v1.Service{ObjectMeta: meta_v1.ObjectMeta{Name: "foo", Namespace: "test", UID: "1"}}
+	service2 := &v1.Service{ObjectMeta: meta_v1.ObjectMeta{Name: "foo", Namespace: "test", UID: "2"}}
 
 	store := NewLocalStore()
 
@@ -60,7 +61,7 @@ func TestDelete(t *testing.T) {
 
 	old := store.Delete(service2)
 	if old != service1 {
-		t.Fatalf("Deleting object with same SelfLink should return old object")
+		t.Fatalf("Deleting object with same namespace and name should return old object")
 	}
 	if old, ok := old.(*v1.Service); !ok || old.ObjectMeta.UID != service1.ObjectMeta.UID {
 		t.Fatalf("Returned object is not original object")
@@ -131,6 +132,33 @@ func TestListServices(t *testing.T) {
 	}
 }
 
+func TestStoreWithoutSelfLinks(t *testing.T) {
+	objects := []runtime.Object{
+		&v1.Service{ObjectMeta: meta_v1.ObjectMeta{Name: "service1", Namespace: "test"}},
+		&v1.Service{ObjectMeta: meta_v1.ObjectMeta{Name: "service2", Namespace: "test"}},
+		&v1.Service{ObjectMeta: meta_v1.ObjectMeta{Name: "service1", Namespace: "other"}},
+	}
+
+	store := ServiceStore{NewLocalStore()}
+	for _, o := range objects {
+		if store.Update(o) != nil {
+			t.Fatalf("Objects without self link shouldn't replace other objects")
+		}
+	}
+
+	services, err := store.List()
+	if err != nil {
+		t.Fatalf("Error when getting service list: %v", err)
+	}
+	if len(services) != len(objects) {
+		t.Fatalf("Store should contain %d services, found %d", len(objects), len(services))
+	}
+
+	if store.Delete(objects[2]) != objects[2] || len(store.Objects) != 2 {
+		t.Fatalf("Only the deleted service should be removed")
+	}
+}
+
 func TestListEndpoints(t *testing.T) {
 	endpoints := []*v1.Endpoints{
 		&v1.Endpoints{ObjectMeta: meta_v1.ObjectMeta{SelfLink: "/endpoints/1", Name: "endpoints1"}},
@@ -0,0 +1,68 @@
+/*
+Copyright 2016 Tuenti Technologies S.L. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// FileLock is an exclusive lock held on a file, used to prevent several
+// instances from writing the same configuration
+type FileLock struct {
+	file *os.File
+}
+
+// lockPath returns the path of the lock file used for a configuration file
+func lockPath(path string) string {
+	return path + ".lock"
+}
+
+// LockFile acquires an exclusive lock on the file in the given path, creating
+// it if it doesn't exist. If wait is false and the lock is held by other
+// process it fails instead of waiting for it to be released.
+func LockFile(path string, wait bool) (*FileLock, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	how := syscall.LOCK_EX
+	if !wait {
+		how |= syscall.LOCK_NB
+	}
+	if err := syscall.Flock(int(file.Fd()), how); err != nil {
+		file.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, fmt.Errorf("%s is locked by other process", path)
+		}
+		return nil, err
+	}
+
+	// Process id is written for troubleshooting
+	if err := file.Truncate(0); err == nil {
+		fmt.Fprintf(file, "%d\n", os.Getpid())
+	}
+	return &FileLock{file: file}, nil
+}
+
+// Unlock releases the lock, the file is kept so other processes waiting for
+// it keep using the same one
+func (l *FileLock) Unlock() error {
+	defer l.file.Close()
+	return syscall.Flock(int(l.file.Fd()), syscall.LOCK_UN)
+}
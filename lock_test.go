@@ -0,0 +1,100 @@
+/*
+Copyright 2016 Tuenti Technologies S.L. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileLock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kube2lb-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	configPath := path.Join(dir, "haproxy.cfg")
+
+	first, err := LockFile(lockPath(configPath), false)
+	if err != nil {
+		t.Fatalf("First instance should acquire the lock: %s", err)
+	}
+	content, err := ioutil.ReadFile(lockPath(configPath))
+	if assert.NoError(t, err) {
+		assert.Equal(t, strconv.Itoa(os.Getpid()), strings.TrimSpace(string(content)))
+	}
+
+	_, err = LockFile(lockPath(configPath), false)
+	if assert.Error(t, err, "second instance shouldn't acquire the lock") {
+		assert.Contains(t, err.Error(), "locked by other process")
+	}
+
+	acquired := make(chan *FileLock)
+	go func() {
+		second, err := LockFile(lockPath(configPath), true)
+		assert.NoError(t, err)
+		acquired <- second
+	}()
+
+	select {
+	case <-acquired:
+		t.Fatal("Waiting instance shouldn't acquire the lock while it is held")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	assert.NoError(t, first.Unlock())
+	select {
+	case second := <-acquired:
+		if second != nil {
+			assert.NoError(t, second.Unlock())
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Waiting instance should acquire the lock once released")
+	}
+}
+
+func TestLockFileKeptOnCleanup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kube2lb-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	configPath := path.Join(dir, "haproxy.cfg")
+
+	lock, err := LockFile(lockPath(configPath), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var files CreatedFiles
+	if err := files.Open(configPath); err != nil {
+		t.Fatal(err)
+	}
+
+	files.Remove()
+	_, err = os.Stat(lockPath(configPath))
+	assert.NoError(t, err, "lock file should be kept so waiting instances use the same one")
+	assert.NoError(t, lock.Unlock())
+	_, err = os.Stat(configPath)
+	assert.True(t, os.IsNotExist(err), "created configuration should have been removed")
+}
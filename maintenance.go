@@ -0,0 +1,64 @@
+/*
+Copyright 2016 Tuenti Technologies S.L. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"regexp"
+)
+
+var maintenanceBackend = ""
+var maintenancePage = ""
+
+func init() {
+	flag.StringVar(&maintenanceBackend, "maintenance-backend", maintenanceBackend, "Name of a maintenance backend for the load balancer, it is disabled if not set")
+	flag.StringVar(&maintenancePage, "maintenance-page", maintenancePage, "Path to the contents returned by the maintenance backend, e.g. an HTTP 503 errorfile")
+}
+
+var backendNameRegexp = regexp.MustCompile(`^[A-Za-z0-9_.:-]+$`)
+
+// MaintenanceInformation contains the configuration of a maintenance backend,
+// so all frontends can use the same one
+type MaintenanceInformation struct {
+	Name string
+	Page string
+}
+
+// maintenanceInformation returns the maintenance backend configuration from
+// flags, nil if it is disabled
+func maintenanceInformation() (*MaintenanceInformation, error) {
+	if maintenanceBackend == "" {
+		if maintenancePage != "" {
+			return nil, fmt.Errorf("maintenance page set without maintenance backend")
+		}
+		return nil, nil
+	}
+	if !backendNameRegexp.MatchString(maintenanceBackend) {
+		return nil, fmt.Errorf("invalid maintenance backend name %s", maintenanceBackend)
+	}
+	if maintenancePage == "" {
+		return nil, fmt.Errorf("maintenance page expected for maintenance backend %s", maintenanceBackend)
+	}
+	if info, err := os.Stat(maintenancePage); err != nil {
+		return nil, fmt.Errorf("couldn't find maintenance page: %s", err)
+	} else if info.IsDir() {
+		return nil, fmt.Errorf("maintenance page %s is a directory", maintenancePage)
+	}
+	return &MaintenanceInformation{Name: maintenanceBackend, Page: maintenancePage}, nil
+}
@@ -0,0 +1,115 @@
+/*
+Copyright 2016 Tuenti Technologies S.L. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMaintenanceInformation(t *testing.T) {
+	defer func(backend, page string) {
+		maintenanceBackend, maintenancePage = backend, page
+	}(maintenanceBackend, maintenancePage)
+
+	dir, err := ioutil.TempDir("", "kube2lb-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	page := path.Join(dir, "503.http")
+	if err := ioutil.WriteFile(page, []byte("HTTP/1.0 503 Service Unavailable\r\n\r\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		Backend  string
+		Page     string
+		Expected *MaintenanceInformation
+		Error    bool
+	}{
+		{"", "", nil, false},
+		{"maintenance", page, &MaintenanceInformation{Name: "maintenance", Page: page}, false},
+		{"", page, nil, true},
+		{"maintenance", "", nil, true},
+		{"maintenance", path.Join(dir, "notexists.http"), nil, true},
+		{"maintenance", dir, nil, true},
+		{"maintenance backend", page, nil, true},
+	}
+
+	for _, c := range cases {
+		maintenanceBackend, maintenancePage = c.Backend, c.Page
+		maintenance, err := maintenanceInformation()
+		if c.Error {
+			assert.Error(t, err, "error expected for %+v", c)
+			continue
+		}
+		if assert.NoError(t, err) {
+			assert.Equal(t, c.Expected, maintenance)
+		}
+	}
+}
+
+func TestMaintenanceInClusterInformation(t *testing.T) {
+	defer func(backend, page string) {
+		maintenanceBackend, maintenancePage = backend, page
+	}(maintenanceBackend, maintenancePage)
+
+	dir, err := ioutil.TempDir("", "kube2lb-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	page := path.Join(dir, "503.http")
+	if err := ioutil.WriteFile(page, []byte("HTTP/1.0 503 Service Unavailable\r\n\r\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	service, endpoints := newTestService("service1", nil)
+	client := newTestStoresClient(service, endpoints)
+	template := &dummyTemplate{}
+	client.AddTemplate(template)
+
+	source := `{{ with .Maintenance }}backend {{ .Name }}
+  errorfile 503 {{ .Page }}
+{{ end }}`
+
+	maintenanceBackend, maintenancePage = "", ""
+	if assert.NoError(t, client.Update(context.Background())) {
+		assert.Nil(t, template.lastExecutedWith.Maintenance, "maintenance backend should be disabled by default")
+		content, err := executeTestTemplate(t, source, template.lastExecutedWith)
+		if assert.NoError(t, err) {
+			assert.Equal(t, "", content)
+		}
+	}
+
+	maintenanceBackend, maintenancePage = "maintenance", page
+	if assert.NoError(t, client.Update(context.Background())) && assert.NotNil(t, template.lastExecutedWith.Maintenance) {
+		content, err := executeTestTemplate(t, source, template.lastExecutedWith)
+		if assert.NoError(t, err) {
+			assert.Equal(t, "backend maintenance\n  errorfile 503 "+page+"\n", content)
+		}
+	}
+
+	maintenancePage = path.Join(dir, "notexists.http")
+	assert.Error(t, client.Update(context.Background()), "update should fail with an invalid maintenance page")
+}
@@ -0,0 +1,71 @@
+/*
+Copyright 2016 Tuenti Technologies S.L. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"sort"
+)
+
+// MapEntry is an entry of a map file, as the ones used by nginx map
+// directives, associating a server name with the label of a service
+type MapEntry struct {
+	Key   string
+	Value string
+}
+
+// onPorts returns true if the service is on any of the ports, or if no ports
+// are given
+func onPorts(s ServiceInformation, ports []PortSpec) bool {
+	if len(ports) == 0 {
+		return true
+	}
+	for _, port := range ports {
+		if port.String() == s.Port.String() {
+			return true
+		}
+	}
+	return false
+}
+
+// mapEntries returns the entries mapping the server names of the services to
+// their labels, sorted by server name. If ports are given only services on
+// these ports are included. When several services have the same server name,
+// the first one is used.
+func mapEntries(info *ClusterInformation, domain string, ports ...PortSpec) ([]MapEntry, error) {
+	var entries []MapEntry
+	seen := make(map[serverName]bool)
+	for _, s := range info.Services {
+		if !onPorts(s, ports) {
+			continue
+		}
+		names, err := generateServerNames(s, serverNameDomains(info, domain), info.Nodes)
+		if err != nil {
+			return nil, err
+		}
+		for _, n := range names {
+			if seen[n] {
+				continue
+			}
+			seen[n] = true
+			entries = append(entries, MapEntry{Key: string(n), Value: s.String()})
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Key < entries[j].Key
+	})
+	return entries, nil
+}
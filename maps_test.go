@@ -0,0 +1,90 @@
+/*
+Copyright 2016 Tuenti Technologies S.L. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"testing"
+	"text/template"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMapEntries(t *testing.T) {
+	defer func(templates []*template.Template) { serverNameTemplates = templates }(serverNameTemplates)
+	var err error
+	serverNameTemplates, err = parseServerNameTemplatesArg("{{ .Service.Name }}.{{ .Domain }}")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	http := PortSpec{Port: 80, Mode: "http", Protocol: "tcp"}
+	https := PortSpec{Port: 443, Mode: "http", Protocol: "tcp"}
+	info := &ClusterInformation{
+		Services: []ServiceInformation{
+			{Name: "web", Namespace: "test", Port: http, External: []string{"~^www\\.example\\.(com|net)$"}},
+			{Name: "web", Namespace: "test", Port: https},
+			{Name: "api", Namespace: "test", Port: http, External: []string{"*.api.example.com"}},
+			{Name: "admin", Namespace: "other", Port: https},
+		},
+		Domain:  "example.com",
+		Domains: []string{"example.com", "example.org"},
+	}
+
+	source := `map $host $backend {
+  hostnames;
+{{- range MapEntries .Domain }}
+  {{ .Key }} {{ .Value }};
+{{- end }}
+}
+`
+	expected := `map $host $backend {
+  hostnames;
+  *.api.example.com api_test_80_tcp_http;
+  admin.example.com admin_other_443_tcp_http;
+  admin.example.org admin_other_443_tcp_http;
+  api.example.com api_test_80_tcp_http;
+  api.example.org api_test_80_tcp_http;
+  web.example.com web_test_80_tcp_http;
+  web.example.org web_test_80_tcp_http;
+  ~^www\.example\.(com|net)$ web_test_80_tcp_http;
+}
+`
+	content, err := executeTestTemplate(t, source, info)
+	if assert.NoError(t, err) {
+		assert.Equal(t, expected, content)
+	}
+
+	entries, err := mapEntries(info, info.Domain, https)
+	if assert.NoError(t, err) {
+		assert.Equal(t, []MapEntry{
+			{"admin.example.com", "admin_other_443_tcp_http"},
+			{"admin.example.org", "admin_other_443_tcp_http"},
+			{"web.example.com", "web_test_443_tcp_http"},
+			{"web.example.org", "web_test_443_tcp_http"},
+		}, entries)
+	}
+}
+
+func TestOnPorts(t *testing.T) {
+	http := PortSpec{Port: 80, Mode: "http", Protocol: "tcp"}
+	https := PortSpec{Port: 443, Mode: "http", Protocol: "tcp"}
+	s := ServiceInformation{Name: "web", Namespace: "test", Port: http}
+
+	assert.True(t, onPorts(s, nil), "services should be included if no ports are given")
+	assert.True(t, onPorts(s, []PortSpec{https, http}))
+	assert.False(t, onPorts(s, []PortSpec{https}))
+}
@@ -0,0 +1,100 @@
+/*
+Copyright 2017 Tuenti Technologies S.L. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"expvar"
+	"log"
+	"net/http"
+
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+// serviceChanges counts the changes that signaled an update, by the
+// namespace/name of the affected service
+var serviceChanges = expvar.NewMap("service_changes")
+
+// serverNameCollisions is the number of server names used by more than one
+// service in the last generated configuration
+var serverNameCollisions = expvar.NewInt("server_name_collisions")
+
+// portLabelCollisions is the number of port labels shared by different ports
+// in the last generated configuration
+var portLabelCollisions = expvar.NewInt("port_label_collisions")
+
+// configSizeOverflows counts the generated configurations not written
+// because they exceeded the maximum size
+var configSizeOverflows = expvar.NewInt("config_size_overflows")
+
+// configSize is the size in bytes of the last rendered configuration, by the
+// path or config map it is written to
+var configSize = expvar.NewMap("config_size")
+
+// renderedBackends and renderedServers are the number of backends, one for
+// each service port, and of servers in them, in the last rendered
+// configuration
+var renderedBackends = expvar.NewInt("backends")
+var renderedServers = expvar.NewInt("servers")
+
+func recordConfigSize(target string, size int) {
+	v := new(expvar.Int)
+	v.Set(int64(size))
+	configSize.Set(target, v)
+}
+
+func recordRenderedInformation(info *ClusterInformation) {
+	servers := 0
+	for _, s := range info.Services {
+		servers += s.TotalCount()
+	}
+	renderedBackends.Set(int64(len(info.Services)))
+	renderedServers.Set(int64(servers))
+}
+
+// serviceChangeKey returns the namespace/name of the service affected by a
+// change in the object, if any
+func serviceChangeKey(o runtime.Object) (string, bool) {
+	switch o := o.(type) {
+	case *v1.Service:
+		return o.Namespace + "/" + o.Name, true
+	case *v1.Endpoints:
+		return o.Namespace + "/" + o.Name, true
+	case *EndpointSlice:
+		if service, found := o.Labels[endpointSliceServiceLabel]; found {
+			return o.Namespace + "/" + service, true
+		}
+	}
+	return "", false
+}
+
+func recordServiceChange(o runtime.Object) {
+	if key, ok := serviceChangeKey(o); ok {
+		serviceChanges.Add(key, 1)
+	}
+}
+
+// ServeMetrics exposes metrics in /debug/vars, the default mux is not used
+// to avoid exposing other handlers registered there, as the profiling ones
+func ServeMetrics(address string) {
+	mux := http.NewServeMux()
+	mux.Handle("/debug/vars", expvar.Handler())
+	log.Printf("Serving metrics on %s", address)
+	if err := http.ListenAndServe(address, mux); err != nil {
+		log.Fatalf("Couldn't serve metrics: %s", err)
+	}
+}
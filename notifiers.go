@@ -17,14 +17,19 @@ limitations under the License.
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"os"
 	"os/exec"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
+	"text/template"
 
 	"github.com/jsoriano/getsignal"
 )
@@ -33,6 +38,13 @@ type Notifier interface {
 	Notify(ctx context.Context) error
 }
 
+// ChangesNotifier is implemented by notifiers that can use the services
+// changed since the last notification, e.g. for partial reloads
+type ChangesNotifier interface {
+	Notifier
+	NotifyChanges(ctx context.Context, changes ClusterChanges) error
+}
+
 func NewNotifier(definition string) (Notifier, error) {
 	ds := strings.SplitN(definition, ":", 2)
 	if len(ds) < 2 {
@@ -43,6 +55,8 @@ func NewNotifier(definition string) (Notifier, error) {
 	switch t {
 	case "command":
 		return NewCommandNotifier(d)
+	case "command-template":
+		return NewCommandTemplateNotifier(d)
 	case "pid":
 		return NewPidNotifier(d)
 	case "pidfile":
@@ -54,17 +68,168 @@ func NewNotifier(definition string) (Notifier, error) {
 	}
 }
 
+// notifyDefinitions is a flag that can be repeated to define several notifiers
+type notifyDefinitions []string
+
+func (d *notifyDefinitions) String() string {
+	return strings.Join(*d, ", ")
+}
+
+func (d *notifyDefinitions) Set(definition string) error {
+	*d = append(*d, definition)
+	return nil
+}
+
+// ConfigPathSetter is implemented by notifiers that can use the path of the
+// generated configuration
+type ConfigPathSetter interface {
+	SetConfigPath(path string)
+}
+
+// NewNotifiers creates a notifier for each definition, if there are several
+// definitions all of them are notified
+func NewNotifiers(definitions []string) (Notifier, error) {
+	if len(definitions) == 1 {
+		return NewNotifier(definitions[0])
+	}
+	notifiers := make([]Notifier, 0, len(definitions))
+	for _, definition := range definitions {
+		n, err := NewNotifier(definition)
+		if err != nil {
+			return nil, err
+		}
+		notifiers = append(notifiers, n)
+	}
+	return NewMultiNotifier(notifiers...), nil
+}
+
+// MultiNotifier notifies several notifiers, all of them are notified even if
+// some fail, and their errors are aggregated
+type MultiNotifier struct {
+	notifiers []Notifier
+}
+
+func NewMultiNotifier(notifiers ...Notifier) *MultiNotifier {
+	return &MultiNotifier{notifiers: notifiers}
+}
+
+func (n *MultiNotifier) Notify(ctx context.Context) error {
+	return n.notify(func(notifier Notifier) error {
+		return notifier.Notify(ctx)
+	})
+}
+
+func (n *MultiNotifier) NotifyChanges(ctx context.Context, changes ClusterChanges) error {
+	return n.notify(func(notifier Notifier) error {
+		if cn, ok := notifier.(ChangesNotifier); ok {
+			return cn.NotifyChanges(ctx, changes)
+		}
+		return notifier.Notify(ctx)
+	})
+}
+
+func (n *MultiNotifier) SetConfigPath(path string) {
+	for _, notifier := range n.notifiers {
+		if s, ok := notifier.(ConfigPathSetter); ok {
+			s.SetConfigPath(path)
+		}
+	}
+}
+
+func (n *MultiNotifier) notify(f func(Notifier) error) error {
+	var errors []string
+	for _, notifier := range n.notifiers {
+		if err := f(notifier); err != nil {
+			errors = append(errors, err.Error())
+		}
+	}
+	if len(errors) > 0 {
+		return fmt.Errorf("%d of %d notifications failed: %s", len(errors), len(n.notifiers), strings.Join(errors, "; "))
+	}
+	return nil
+}
+
+// CommandContext is used to render the templates of commands
+type CommandContext struct {
+	// ConfigPath is the path of the generated configuration, empty if it is
+	// only written to a config map
+	ConfigPath string
+
+	// Hash is the SHA-256 of the generated configuration, empty if there is
+	// no configuration path
+	Hash string
+}
+
 type CommandNotifier struct {
-	command string
+	command    string
+	template   *template.Template
+	configPath string
 }
 
 func NewCommandNotifier(definition string) (*CommandNotifier, error) {
 	// -notify command:COMMAND
-	return &CommandNotifier{definition}, nil
+	return &CommandNotifier{command: definition}, nil
+}
+
+func NewCommandTemplateNotifier(definition string) (*CommandNotifier, error) {
+	// -notify command-template:COMMAND
+	t, err := template.New("command").Parse(definition)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid command template: %s", err)
+	}
+	return &CommandNotifier{command: definition, template: t}, nil
+}
+
+func (n *CommandNotifier) SetConfigPath(path string) {
+	n.configPath = path
+}
+
+// render renders the command template with the current configuration, commands
+// that are not templates are returned as is
+func (n *CommandNotifier) render() (string, error) {
+	if n.template == nil {
+		return n.command, nil
+	}
+	data := CommandContext{ConfigPath: n.configPath}
+	if n.configPath != "" {
+		content, err := ioutil.ReadFile(n.configPath)
+		if err != nil {
+			return "", fmt.Errorf("couldn't read configuration to notify: %s", err)
+		}
+		data.Hash = fmt.Sprintf("%x", sha256.Sum256(content))
+	}
+	var command bytes.Buffer
+	if err := n.template.Execute(&command, data); err != nil {
+		return "", fmt.Errorf("couldn't render command: %s", err)
+	}
+	return command.String(), nil
 }
 
 func (n *CommandNotifier) Notify(ctx context.Context) error {
-	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", n.command)
+	command, err := n.render()
+	if err != nil {
+		return err
+	}
+	return n.run(exec.CommandContext(ctx, "/bin/sh", "-c", command))
+}
+
+// NotifyChanges runs the command with the keys of changed services as
+// space-separated lists in the environment
+func (n *CommandNotifier) NotifyChanges(ctx context.Context, changes ClusterChanges) error {
+	command, err := n.render()
+	if err != nil {
+		return err
+	}
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", command)
+	cmd.Env = append(os.Environ(),
+		"KUBE2LB_ADDED_SERVICES="+strings.Join(servicesKeys(changes.Added), " "),
+		"KUBE2LB_REMOVED_SERVICES="+strings.Join(servicesKeys(changes.Removed), " "),
+		"KUBE2LB_MODIFIED_SERVICES="+strings.Join(servicesKeys(changes.Modified), " "),
+	)
+	return n.run(cmd)
+}
+
+func (n *CommandNotifier) run(cmd *exec.Cmd) error {
 	output, err := cmd.CombinedOutput()
 	if len(output) > 0 {
 		log.Printf("%s", output)
@@ -129,9 +294,91 @@ func (n *PidfileNotifier) Notify(ctx context.Context) error {
 	return syscall.Kill(pid, n.signal)
 }
 
+// SerialNotifier ensures that only one notification runs at a time, if
+// notifications are requested while other one is running, they are coalesced
+// in a single pending notification that runs when the current one finishes.
+// Coalesced callers wait for the pending notification and get its result.
+type SerialNotifier struct {
+	notifier Notifier
+
+	mutex   sync.Mutex
+	running bool
+	pending *serialNotification
+}
+
+// serialNotification contains coalesced changes, done is closed once they
+// are notified
+type serialNotification struct {
+	ctx     context.Context
+	changes ClusterChanges
+	err     error
+	done    chan struct{}
+}
+
+func NewSerialNotifier(n Notifier) *SerialNotifier {
+	return &SerialNotifier{notifier: n}
+}
+
+func (n *SerialNotifier) Notify(ctx context.Context) error {
+	return n.NotifyChanges(ctx, ClusterChanges{})
+}
+
+func (n *SerialNotifier) NotifyChanges(ctx context.Context, changes ClusterChanges) error {
+	n.mutex.Lock()
+	if n.running {
+		if n.pending == nil {
+			n.pending = &serialNotification{changes: changes, done: make(chan struct{})}
+		} else {
+			n.pending.changes = mergeChanges(n.pending.changes, changes)
+		}
+		// Pending notification runs with the context of the last caller
+		n.pending.ctx = ctx
+		pending := n.pending
+		n.mutex.Unlock()
+
+		select {
+		case <-pending.done:
+			return pending.err
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	n.running = true
+	n.mutex.Unlock()
+
+	err := n.notify(ctx, changes)
+	for {
+		n.mutex.Lock()
+		pending := n.pending
+		n.pending = nil
+		if pending == nil {
+			n.running = false
+			n.mutex.Unlock()
+			return err
+		}
+		n.mutex.Unlock()
+
+		pending.err = n.notify(pending.ctx, pending.changes)
+		close(pending.done)
+	}
+}
+
+func (n *SerialNotifier) notify(ctx context.Context, changes ClusterChanges) error {
+	if cn, ok := n.notifier.(ChangesNotifier); ok {
+		return cn.NotifyChanges(ctx, changes)
+	}
+	return n.notifier.Notify(ctx)
+}
+
 type DebugNotifier struct{}
 
 func (n *DebugNotifier) Notify(ctx context.Context) error {
 	log.Printf("Notify")
 	return nil
 }
+
+func (n *DebugNotifier) NotifyChanges(ctx context.Context, changes ClusterChanges) error {
+	log.Printf("Notify, added: %v, removed: %v, modified: %v",
+		servicesKeys(changes.Added), servicesKeys(changes.Removed), servicesKeys(changes.Modified))
+	return nil
+}
@@ -16,7 +16,20 @@ limitations under the License.
 
 package main
 
-import "testing"
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
 
 var definitionCases = []struct {
 	Definition string
@@ -31,6 +44,9 @@ var definitionCases = []struct {
 	{"pid:SIGTERM:100", false},
 	{"pidfile:SIGTERM:test.pid", false},
 	{"command:echo", false},
+	{"command:echo {{ .ConfigPath", false},
+	{"command-template:echo {{ .ConfigPath }}", false},
+	{"command-template:echo {{ .ConfigPath", true},
 }
 
 func TestNotifierDefinitions(t *testing.T) {
@@ -44,3 +60,278 @@ func TestNotifierDefinitions(t *testing.T) {
 		}
 	}
 }
+
+func TestCommandNotifierChanges(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kube2lb-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	output := path.Join(dir, "changes")
+	n, _ := NewCommandNotifier(`echo "$KUBE2LB_ADDED_SERVICES|$KUBE2LB_REMOVED_SERVICES|$KUBE2LB_MODIFIED_SERVICES" > ` + output)
+	changes := ClusterChanges{
+		Added:    []ServiceInformation{{Name: "service1", Namespace: "test", Port: PortSpec{Port: 80}}, {Name: "service1", Namespace: "test", Port: PortSpec{Port: 443}}},
+		Modified: []ServiceInformation{{Name: "service2", Namespace: "test", Port: PortSpec{Port: 80}}},
+	}
+	if err := n.NotifyChanges(context.Background(), changes); err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := ioutil.ReadFile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "test/service1:80 test/service1:443||test/service2:80\n"
+	if string(d) != expected {
+		t.Fatalf("Unexpected changes in environment: %q, expected: %q", d, expected)
+	}
+}
+
+func TestCommandNotifierTemplate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kube2lb-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	configPath := path.Join(dir, "haproxy.cfg")
+	if err := ioutil.WriteFile(configPath, []byte("global\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	output := path.Join(dir, "output")
+	n, err := NewCommandTemplateNotifier(`echo "{{ .ConfigPath }} {{ .Hash }}" > ` + output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.SetConfigPath(configPath)
+	if err := n.Notify(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := ioutil.ReadFile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := configPath + " " + fmt.Sprintf("%x", sha256.Sum256([]byte("global\n"))) + "\n"
+	if string(d) != expected {
+		t.Fatalf("Unexpected rendered command output: %q, expected: %q", d, expected)
+	}
+
+	plain, err := NewCommandNotifier(`echo "{{ .ConfigPath }}" > ` + output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain.SetConfigPath(configPath)
+	if err := plain.Notify(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	d, err = ioutil.ReadFile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(d) != "{{ .ConfigPath }}\n" {
+		t.Fatalf("Commands shouldn't be rendered if they are not templates, found: %q", d)
+	}
+
+	n.SetConfigPath(path.Join(dir, "notexists.cfg"))
+	if err := n.Notify(context.Background()); err == nil {
+		t.Error("Error expected if the configuration cannot be read")
+	}
+}
+
+func TestMultiNotifierConfigPath(t *testing.T) {
+	command, _ := NewCommandNotifier("echo {{ .ConfigPath }}")
+	n := NewMultiNotifier(command, &fakeNotifier{})
+	n.SetConfigPath("/etc/haproxy/haproxy.cfg")
+	if command.configPath != "/etc/haproxy/haproxy.cfg" {
+		t.Errorf("Configuration path should be set in command notifiers, found %q", command.configPath)
+	}
+}
+
+type fakeNotifier struct {
+	err     error
+	count   int
+	changes []ClusterChanges
+}
+
+func (n *fakeNotifier) Notify(ctx context.Context) error {
+	n.count++
+	return n.err
+}
+
+func (n *fakeNotifier) NotifyChanges(ctx context.Context, changes ClusterChanges) error {
+	n.changes = append(n.changes, changes)
+	return n.Notify(ctx)
+}
+
+func TestMultiNotifier(t *testing.T) {
+	failing := &fakeNotifier{err: errors.New("process not found")}
+	working := &fakeNotifier{}
+	n := NewMultiNotifier(failing, working)
+
+	err := n.Notify(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "1 of 2") || !strings.Contains(err.Error(), "process not found") {
+		t.Errorf("Aggregated error expected, found: %v", err)
+	}
+	if failing.count != 1 || working.count != 1 {
+		t.Errorf("All notifiers should be notified, found %d and %d notifications", failing.count, working.count)
+	}
+
+	changes := ClusterChanges{Added: []ServiceInformation{{Name: "service1", Namespace: "test", Port: PortSpec{Port: 80}}}}
+	if err := n.NotifyChanges(context.Background(), changes); err == nil {
+		t.Error("Error expected when a notifier fails")
+	}
+	if len(working.changes) != 1 || len(failing.changes) != 1 {
+		t.Fatalf("Changes should be passed to all notifiers")
+	}
+	if keys := servicesKeys(working.changes[0].Added); len(keys) != 1 || keys[0] != "test/service1:80" {
+		t.Errorf("Unexpected changes: %v", keys)
+	}
+
+	failing.err = nil
+	if err := n.Notify(context.Background()); err != nil {
+		t.Errorf("No error expected when all notifiers succeed, found: %v", err)
+	}
+}
+
+func TestNotifiersDefinitions(t *testing.T) {
+	n, err := NewNotifiers([]string{"debug:"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := n.(*DebugNotifier); !ok {
+		t.Errorf("Single notifier expected for one definition, found %T", n)
+	}
+
+	n, err = NewNotifiers([]string{"debug:", "pid:SIGHUP:100"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if multi, ok := n.(*MultiNotifier); !ok || len(multi.notifiers) != 2 {
+		t.Errorf("Multiple notifier expected for several definitions, found %T", n)
+	}
+
+	if _, err := NewNotifiers([]string{"debug:", "notexists:foo"}); err == nil {
+		t.Error("Error expected with invalid definitions")
+	}
+
+	var definitions notifyDefinitions
+	definitions.Set("pid:SIGHUP:100")
+	definitions.Set("pid:SIGHUP:200")
+	if len(definitions) != 2 || definitions.String() != "pid:SIGHUP:100, pid:SIGHUP:200" {
+		t.Errorf("Repeated definitions expected, found %v", definitions)
+	}
+}
+
+// blockingNotifier blocks notifications till they are released
+type blockingNotifier struct {
+	sync.Mutex
+	running, maxRunning, count int
+
+	started chan struct{}
+	release chan struct{}
+	changes []ClusterChanges
+}
+
+func (n *blockingNotifier) Notify(ctx context.Context) error {
+	return n.NotifyChanges(ctx, ClusterChanges{})
+}
+
+func (n *blockingNotifier) NotifyChanges(ctx context.Context, changes ClusterChanges) error {
+	n.Lock()
+	n.running++
+	n.count++
+	if n.running > n.maxRunning {
+		n.maxRunning = n.running
+	}
+	n.changes = append(n.changes, changes)
+	n.Unlock()
+
+	n.started <- struct{}{}
+	<-n.release
+
+	n.Lock()
+	n.running--
+	n.Unlock()
+	return nil
+}
+
+func TestSerialNotifier(t *testing.T) {
+	blocking := &blockingNotifier{
+		started: make(chan struct{}, 10),
+		release: make(chan struct{}),
+	}
+	n := NewSerialNotifier(blocking)
+	service := func(name string) []ServiceInformation {
+		return []ServiceInformation{{Name: name, Namespace: "test", Port: PortSpec{Port: 80}}}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		n.NotifyChanges(context.Background(), ClusterChanges{Added: service("service1")})
+		close(done)
+	}()
+	<-blocking.started
+
+	// Overlapping notifications wait for the coalesced notification
+	coalesced := make(chan error, 2)
+	for _, name := range []string{"service2", "service3"} {
+		go func(name string) {
+			coalesced <- n.NotifyChanges(context.Background(), ClusterChanges{Added: service(name)})
+		}(name)
+	}
+	for pending := 0; pending < 2; {
+		time.Sleep(time.Millisecond)
+		n.mutex.Lock()
+		if n.pending != nil {
+			pending = len(n.pending.changes.Added)
+		}
+		n.mutex.Unlock()
+	}
+
+	blocking.release <- struct{}{}
+	<-blocking.started
+	select {
+	case <-coalesced:
+		t.Fatal("Coalesced notifications shouldn't return before running")
+	default:
+	}
+	blocking.release <- struct{}{}
+	<-done
+	for i := 0; i < 2; i++ {
+		if err := <-coalesced; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if blocking.maxRunning != 1 {
+		t.Errorf("Only one notification expected at a time, found %d", blocking.maxRunning)
+	}
+	if blocking.count != 2 {
+		t.Fatalf("Pending notifications should be coalesced, %d notifications found", blocking.count)
+	}
+	keys := servicesKeys(blocking.changes[1].Added)
+	sort.Strings(keys)
+	if len(keys) != 2 || keys[0] != "test/service2:80" || keys[1] != "test/service3:80" {
+		t.Errorf("Changes of coalesced notifications expected, found %v", keys)
+	}
+
+	// Coalesced callers stop waiting when their contexts are done
+	done = make(chan struct{})
+	go func() {
+		n.Notify(context.Background())
+		close(done)
+	}()
+	<-blocking.started
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := n.Notify(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Deadline exceeded expected, found %v", err)
+	}
+	blocking.release <- struct{}{}
+	<-blocking.started
+	blocking.release <- struct{}{}
+	<-done
+}
@@ -0,0 +1,205 @@
+/*
+Copyright 2016 Tuenti Technologies S.L. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const TraceExporterOTLP = "otlp"
+
+var otlpEndpoint = "http://localhost:4318/v1/traces"
+var otlpServiceName = "kube2lb"
+
+func init() {
+	flag.StringVar(&otlpEndpoint, "trace-otlp-endpoint", otlpEndpoint, "URL of the OTLP/HTTP traces endpoint of an OpenTelemetry collector, used with -trace-exporter=otlp")
+	flag.StringVar(&otlpServiceName, "trace-otlp-service-name", otlpServiceName, "Service name of the spans sent to OpenTelemetry collectors")
+}
+
+// otlpSpanExporter sends spans in batches to OpenTelemetry collectors, using
+// the JSON encoding of OTLP over HTTP, so no additional libraries are needed.
+// Spans are sent in background, and dropped if the collector cannot keep up.
+type otlpSpanExporter struct {
+	endpoint    string
+	serviceName string
+	client      *http.Client
+	spans       chan SpanData
+
+	// Replaced in tests
+	batchSize int
+	interval  time.Duration
+}
+
+func NewOTLPSpanExporter(endpoint, serviceName string) *otlpSpanExporter {
+	return &otlpSpanExporter{
+		endpoint:    endpoint,
+		serviceName: serviceName,
+		client:      &http.Client{Timeout: 10 * time.Second},
+		spans:       make(chan SpanData, 1000),
+		batchSize:   100,
+		interval:    5 * time.Second,
+	}
+}
+
+func (e *otlpSpanExporter) ExportSpan(span SpanData) {
+	select {
+	case e.spans <- span:
+	default:
+		log.Printf("Dropping span %s, OTLP exporter queue is full", span.Name)
+	}
+}
+
+// Run sends the exported spans when a batch is full or periodically, till the
+// context is done, pending spans are sent before returning
+func (e *otlpSpanExporter) Run(ctx context.Context) {
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+
+	var batch []SpanData
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := e.send(batch); err != nil {
+			log.Printf("Couldn't send %d spans to %s: %s", len(batch), e.endpoint, err)
+		}
+		batch = nil
+	}
+	for {
+		select {
+		case span := <-e.spans:
+			batch = append(batch, span)
+			if len(batch) >= e.batchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-ctx.Done():
+			for {
+				select {
+				case span := <-e.spans:
+					batch = append(batch, span)
+				default:
+					flush()
+					return
+				}
+			}
+		}
+	}
+}
+
+type otlpKeyValue struct {
+	Key   string `json:"key"`
+	Value struct {
+		StringValue string `json:"stringValue"`
+	} `json:"value"`
+}
+
+func otlpAttributes(attributes map[string]string) []otlpKeyValue {
+	keys := make([]string, 0, len(attributes))
+	for k := range attributes {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	values := make([]otlpKeyValue, 0, len(keys))
+	for _, k := range keys {
+		kv := otlpKeyValue{Key: k}
+		kv.Value.StringValue = attributes[k]
+		values = append(values, kv)
+	}
+	return values
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+}
+
+// otlpSpanKindInternal is the kind of spans of operations that are not
+// remote calls
+const otlpSpanKindInternal = 1
+
+type otlpScopeSpans struct {
+	Scope struct {
+		Name string `json:"name"`
+	} `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpResourceSpans struct {
+	Resource struct {
+		Attributes []otlpKeyValue `json:"attributes"`
+	} `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpTracesRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+// otlpRequest builds the request for a batch of spans, ids are hex-encoded
+// and times are strings with nanoseconds, as in the JSON encoding of OTLP
+func otlpRequest(serviceName string, spans []SpanData) otlpTracesRequest {
+	scope := otlpScopeSpans{}
+	scope.Scope.Name = "kube2lb"
+	for _, s := range spans {
+		scope.Spans = append(scope.Spans, otlpSpan{
+			TraceID:           s.TraceID,
+			SpanID:            s.SpanID,
+			ParentSpanID:      s.ParentID,
+			Name:              s.Name,
+			Kind:              otlpSpanKindInternal,
+			StartTimeUnixNano: strconv.FormatInt(s.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.End.UnixNano(), 10),
+			Attributes:        otlpAttributes(s.Attributes),
+		})
+	}
+	resource := otlpResourceSpans{ScopeSpans: []otlpScopeSpans{scope}}
+	resource.Resource.Attributes = otlpAttributes(map[string]string{"service.name": serviceName})
+	return otlpTracesRequest{ResourceSpans: []otlpResourceSpans{resource}}
+}
+
+func (e *otlpSpanExporter) send(spans []SpanData) error {
+	data, err := json.Marshal(otlpRequest(e.serviceName, spans))
+	if err != nil {
+		return err
+	}
+	resp, err := e.client.Post(e.endpoint, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("collector returned status %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+/*
+Copyright 2016 Tuenti Technologies S.L. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOTLPSpanExporter(t *testing.T) {
+	requests := make(chan otlpTracesRequest, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v1/traces", r.URL.Path)
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		var request otlpTracesRequest
+		if assert.NoError(t, json.NewDecoder(r.Body).Decode(&request)) {
+			requests <- request
+		}
+	}))
+	defer server.Close()
+
+	exporter := NewOTLPSpanExporter(server.URL+"/v1/traces", "kube2lb-test")
+	exporter.batchSize = 2
+	exporter.interval = time.Hour
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		exporter.Run(ctx)
+		close(done)
+	}()
+
+	tracer := NewTracer(exporter)
+	updateCtx, update := tracer.Start(context.Background(), "kube2lb.update")
+	_, render := tracer.Start(updateCtx, "kube2lb.render")
+	render.SetAttribute("services", 3)
+	render.End()
+	update.End()
+
+	// Full batches are sent without waiting for the interval
+	select {
+	case request := <-requests:
+		if assert.Equal(t, 1, len(request.ResourceSpans)) {
+			resource := request.ResourceSpans[0]
+			if assert.Equal(t, 1, len(resource.Resource.Attributes)) {
+				assert.Equal(t, "service.name", resource.Resource.Attributes[0].Key)
+				assert.Equal(t, "kube2lb-test", resource.Resource.Attributes[0].Value.StringValue)
+			}
+			if assert.Equal(t, 1, len(resource.ScopeSpans)) && assert.Equal(t, 2, len(resource.ScopeSpans[0].Spans)) {
+				spans := resource.ScopeSpans[0].Spans
+				assert.Equal(t, "kube2lb.render", spans[0].Name)
+				assert.Equal(t, "kube2lb.update", spans[1].Name)
+				assert.Equal(t, spans[1].TraceID, spans[0].TraceID)
+				assert.Equal(t, spans[1].SpanID, spans[0].ParentSpanID)
+				assert.Len(t, spans[0].TraceID, 32, "trace ids are hex-encoded 16 bytes")
+				assert.Len(t, spans[0].SpanID, 16, "span ids are hex-encoded 8 bytes")
+				assert.Empty(t, spans[1].ParentSpanID)
+				assert.Equal(t, otlpSpanKindInternal, spans[0].Kind)
+				assert.NotEmpty(t, spans[0].StartTimeUnixNano)
+				if assert.Equal(t, 1, len(spans[0].Attributes)) {
+					assert.Equal(t, "services", spans[0].Attributes[0].Key)
+					assert.Equal(t, "3", spans[0].Attributes[0].Value.StringValue)
+				}
+			}
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Spans should be sent when the batch is full")
+	}
+
+	// Pending spans are sent when finishing
+	_, event := tracer.Start(context.Background(), "kube2lb.event")
+	event.End()
+	cancel()
+	<-done
+	select {
+	case request := <-requests:
+		spans := request.ResourceSpans[0].ScopeSpans[0].Spans
+		if assert.Equal(t, 1, len(spans)) {
+			assert.Equal(t, "kube2lb.event", spans[0].Name)
+		}
+	default:
+		t.Error("Pending spans should be sent when finishing")
+	}
+}
+
+func TestOTLPSpanExporterErrors(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	exporter := NewOTLPSpanExporter(server.URL, "kube2lb")
+	assert.Error(t, exporter.send([]SpanData{{Name: "test"}}))
+
+	// Spans are dropped instead of blocking when the queue is full
+	exporter.spans = make(chan SpanData, 1)
+	exporter.ExportSpan(SpanData{Name: "first"})
+	exporter.ExportSpan(SpanData{Name: "second"})
+	assert.Equal(t, 1, len(exporter.spans))
+}
@@ -0,0 +1,133 @@
+/*
+Copyright 2016 Tuenti Technologies S.L. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+)
+
+// Pauser suspends updates during maintenance, updates requested while paused
+// are recorded and run once on resume
+type Pauser struct {
+	sync.Mutex
+
+	paused, pending bool
+	updaters        []Updater
+}
+
+func NewPauser() *Pauser {
+	return &Pauser{}
+}
+
+func (p *Pauser) Pause() {
+	p.Lock()
+	defer p.Unlock()
+	p.paused = true
+}
+
+func (p *Pauser) Resume() {
+	p.Lock()
+	pending := p.pending
+	p.paused, p.pending = false, false
+	updaters := append([]Updater(nil), p.updaters...)
+	p.Unlock()
+
+	if pending {
+		for _, updater := range updaters {
+			updater.Signal()
+		}
+	}
+}
+
+func (p *Pauser) Paused() bool {
+	p.Lock()
+	defer p.Unlock()
+	return p.paused
+}
+
+// skip returns true if the update has to be skipped, recording it to be
+// run on resume
+func (p *Pauser) skip() bool {
+	p.Lock()
+	defer p.Unlock()
+	if p.paused {
+		p.pending = true
+	}
+	return p.paused
+}
+
+func (p *Pauser) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	switch r.URL.Path {
+	case "/pause":
+		p.Pause()
+		log.Printf("Updates paused")
+	case "/resume":
+		p.Resume()
+		log.Printf("Updates resumed")
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	fmt.Fprintf(w, "paused: %t\n", p.Paused())
+}
+
+func NewPausableUpdaterBuilder(p *Pauser, builder UpdaterBuilder) UpdaterBuilder {
+	return func(f UpdaterFunc) Updater {
+		updater := builder(func(ctx context.Context) {
+			if p.skip() {
+				return
+			}
+			f(ctx)
+		})
+		p.Lock()
+		p.updaters = append(p.updaters, updater)
+		p.Unlock()
+		return updater
+	}
+}
+
+func (c *KubernetesClient) EnablePause(p *Pauser) {
+	c.updaterBuilder = NewPausableUpdaterBuilder(p, c.updaterBuilder)
+}
+
+// adminHandler handles the admin endpoints, POST /pause and POST /resume,
+// and profiling endpoints under /debug/pprof/ if enabled
+func adminHandler(p *Pauser, enablePprof bool) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/pause", p)
+	mux.Handle("/resume", p)
+	if enablePprof {
+		registerPprofHandlers(mux)
+	}
+	return mux
+}
+
+// ServeAdmin exposes the admin endpoints
+func ServeAdmin(address string, p *Pauser, enablePprof bool) {
+	log.Printf("Serving admin endpoints on %s", address)
+	if err := http.ListenAndServe(address, adminHandler(p, enablePprof)); err != nil {
+		log.Fatalf("Couldn't serve admin endpoints: %s", err)
+	}
+}
@@ -0,0 +1,105 @@
+/*
+Copyright 2016 Tuenti Technologies S.L. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// syncUpdater runs the update function on each signal
+type syncUpdater struct {
+	f UpdaterFunc
+}
+
+func (u *syncUpdater) Run(ctx context.Context) {}
+
+func (u *syncUpdater) Signal() {
+	u.f(context.Background())
+}
+
+func newSyncUpdater(f UpdaterFunc) Updater {
+	return &syncUpdater{f}
+}
+
+func TestPausableUpdater(t *testing.T) {
+	runs := 0
+	pauser := NewPauser()
+	updater := NewPausableUpdaterBuilder(pauser, newSyncUpdater)(func(context.Context) { runs++ })
+
+	updater.Signal()
+	assert.Equal(t, 1, runs, "update expected while not paused")
+
+	pauser.Pause()
+	updater.Signal()
+	updater.Signal()
+	assert.Equal(t, 1, runs, "no updates expected while paused")
+
+	pauser.Resume()
+	assert.Equal(t, 2, runs, "a single update expected on resume")
+
+	pauser.Pause()
+	pauser.Resume()
+	assert.Equal(t, 2, runs, "no update expected on resume if nothing changed")
+}
+
+func TestPauserHandler(t *testing.T) {
+	runs := 0
+	pauser := NewPauser()
+	updater := NewPausableUpdaterBuilder(pauser, newSyncUpdater)(func(context.Context) { runs++ })
+
+	request := func(method, path string) int {
+		w := httptest.NewRecorder()
+		pauser.ServeHTTP(w, httptest.NewRequest(method, path, nil))
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusMethodNotAllowed, request("GET", "/pause"))
+	assert.False(t, pauser.Paused())
+
+	assert.Equal(t, http.StatusOK, request("POST", "/pause"))
+	assert.True(t, pauser.Paused())
+	updater.Signal()
+	assert.Equal(t, 0, runs)
+
+	assert.Equal(t, http.StatusNotFound, request("POST", "/other"))
+
+	assert.Equal(t, http.StatusOK, request("POST", "/resume"))
+	assert.False(t, pauser.Paused())
+	assert.Equal(t, 1, runs)
+}
+
+func TestAdminPprof(t *testing.T) {
+	for _, enabled := range []bool{false, true} {
+		handler := adminHandler(NewPauser(), enabled)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", "/debug/pprof/", nil))
+		expected := http.StatusNotFound
+		if enabled {
+			expected = http.StatusOK
+		}
+		assert.Equal(t, expected, w.Code, "profiling endpoint with pprof enabled: %t", enabled)
+
+		w = httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("POST", "/pause", nil))
+		assert.Equal(t, http.StatusOK, w.Code, "pause endpoint with pprof enabled: %t", enabled)
+	}
+}
@@ -19,6 +19,8 @@ package main
 import (
 	"fmt"
 	"log"
+	"net/http"
+	httppprof "net/http/pprof"
 	"os"
 	"os/signal"
 	"path"
@@ -43,6 +45,15 @@ func init() {
 	}()
 }
 
+// registerPprofHandlers adds the profiling endpoints under /debug/pprof/
+func registerPprofHandlers(mux *http.ServeMux) {
+	mux.HandleFunc("/debug/pprof/", httppprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", httppprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", httppprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", httppprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", httppprof.Trace)
+}
+
 func dumpMemProfile() (string, error) {
 	timestamp := time.Now().Format(time.RFC3339)
 	profFileName := path.Join(os.TempDir(), fmt.Sprintf("kube2lb-memprof-%s", timestamp))
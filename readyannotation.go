@@ -0,0 +1,96 @@
+/*
+Copyright 2016 Tuenti Technologies S.L. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strconv"
+
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+var readyAnnotation string
+
+func init() {
+	flag.StringVar(&readyAnnotation, "ready-annotation", "", "Annotation of pods that must be true for their endpoints to be ready, for custom readiness gates (Optional)")
+}
+
+type PodStore struct {
+	*LocalStore
+}
+
+func (s PodStore) Equal(o runtime.Object, n runtime.Object) (bool, error) {
+	// Only the ready annotation is used
+	return EqualAnnotations(o, n, readyAnnotation)
+}
+
+// ReadyPods returns the "namespace/name" of the pods with the annotation set
+// to a true value
+func (s *PodStore) ReadyPods(annotation string) (map[string]bool, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	ready := make(map[string]bool)
+	for _, o := range s.Objects {
+		pod, ok := o.(*v1.Pod)
+		if !ok {
+			return nil, fmt.Errorf("couldn't convert pod")
+		}
+		if value, err := strconv.ParseBool(pod.Annotations[annotation]); err == nil && value {
+			ready[pod.Namespace+"/"+pod.Name] = true
+		}
+	}
+	return ready, nil
+}
+
+// readyGateEndpoints returns copies of the endpoints where the ready
+// addresses of pods not in readyPods are moved to not ready addresses.
+// Addresses not backed by pods are not modified.
+func readyGateEndpoints(endpoints []*v1.Endpoints, readyPods map[string]bool) []*v1.Endpoints {
+	gated := make([]*v1.Endpoints, 0, len(endpoints))
+	for _, e := range endpoints {
+		copied := *e
+		copied.Subsets = make([]v1.EndpointSubset, 0, len(e.Subsets))
+		for _, subset := range e.Subsets {
+			gatedSubset := v1.EndpointSubset{
+				Ports:             subset.Ports,
+				NotReadyAddresses: append([]v1.EndpointAddress(nil), subset.NotReadyAddresses...),
+			}
+			for _, address := range subset.Addresses {
+				ref := address.TargetRef
+				if ref == nil || (ref.Kind != "" && ref.Kind != "Pod") {
+					gatedSubset.Addresses = append(gatedSubset.Addresses, address)
+					continue
+				}
+				namespace := ref.Namespace
+				if namespace == "" {
+					namespace = e.Namespace
+				}
+				if readyPods[namespace+"/"+ref.Name] {
+					gatedSubset.Addresses = append(gatedSubset.Addresses, address)
+				} else {
+					gatedSubset.NotReadyAddresses = append(gatedSubset.NotReadyAddresses, address)
+				}
+			}
+			copied.Subsets = append(copied.Subsets, gatedSubset)
+		}
+		gated = append(gated, &copied)
+	}
+	return gated
+}
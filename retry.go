@@ -0,0 +1,133 @@
+/*
+Copyright 2016 Tuenti Technologies S.L. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"k8s.io/client-go/rest"
+)
+
+var kubeAPIRetries = 5
+var kubeAPIRetryMaxWait = 30 * time.Second
+
+func init() {
+	flag.IntVar(&kubeAPIRetries, "kube-api-retries", kubeAPIRetries, "Maximum number of retries of watch requests throttled by the Kubernetes API server, 0 to disable them")
+	flag.DurationVar(&kubeAPIRetryMaxWait, "kube-api-retry-max-wait", kubeAPIRetryMaxWait, "Maximum time to wait before retrying watch requests throttled by the Kubernetes API server")
+}
+
+// retryTransport retries watch requests throttled with 429 responses, waiting
+// the time indicated in their Retry-After header. Other requests are already
+// retried by client-go when they include this header, so they are not retried
+// here to avoid multiplying the number of attempts
+type retryTransport struct {
+	rt      http.RoundTripper
+	retries int
+	maxWait time.Duration
+
+	// Replaced in tests
+	after func(time.Duration) <-chan time.Time
+}
+
+func NewRetryTransport(rt http.RoundTripper, retries int, maxWait time.Duration) http.RoundTripper {
+	return &retryTransport{
+		rt:      rt,
+		retries: retries,
+		maxWait: maxWait,
+		after:   time.After,
+	}
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !isWatchRequest(req) {
+		return t.rt.RoundTrip(req)
+	}
+	for attempt := 0; ; attempt++ {
+		resp, err := t.rt.RoundTrip(req)
+		if err != nil || resp.StatusCode != http.StatusTooManyRequests || attempt >= t.retries {
+			return resp, err
+		}
+		wait, ok := t.wait(resp)
+		if !ok {
+			return resp, err
+		}
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+
+		log.Printf("Request to %s throttled by the API server, retrying in %s", req.URL.Path, wait)
+		select {
+		case <-t.after(wait):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+	}
+}
+
+// isWatchRequest returns true for requests that client-go doesn't retry
+func isWatchRequest(req *http.Request) bool {
+	if req.Method != http.MethodGet {
+		return false
+	}
+	switch req.URL.Query().Get("watch") {
+	case "true", "1":
+		return true
+	}
+	return strings.Contains(req.URL.Path, "/watch/")
+}
+
+// wait returns the time to wait before retrying a throttled request, and
+// false if the response doesn't indicate it
+func (t *retryTransport) wait(resp *http.Response) (time.Duration, bool) {
+	var wait time.Duration
+	h := resp.Header.Get("Retry-After")
+	if seconds, err := strconv.Atoi(h); err == nil && seconds >= 0 {
+		wait = time.Duration(seconds) * time.Second
+	} else if date, err := http.ParseTime(h); err == nil {
+		wait = time.Until(date)
+	} else {
+		return 0, false
+	}
+	if wait < 0 {
+		wait = 0
+	}
+	if wait > t.maxWait {
+		wait = t.maxWait
+	}
+	return wait, true
+}
+
+// wrapRetryTransport makes clients built with the configuration retry
+// throttled watch requests
+func wrapRetryTransport(config *rest.Config, retries int, maxWait time.Duration) {
+	if retries <= 0 {
+		return
+	}
+	wrap := config.WrapTransport
+	config.WrapTransport = func(rt http.RoundTripper) http.RoundTripper {
+		if wrap != nil {
+			rt = wrap(rt)
+		}
+		return NewRetryTransport(rt, retries, maxWait)
+	}
+}
@@ -0,0 +1,182 @@
+/*
+Copyright 2016 Tuenti Technologies S.L. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+type fakeTransport struct {
+	responses []*http.Response
+	bodies    []string
+}
+
+func (t *fakeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		body, _ := ioutil.ReadAll(req.Body)
+		t.bodies = append(t.bodies, string(body))
+	}
+	resp := t.responses[0]
+	if len(t.responses) > 1 {
+		t.responses = t.responses[1:]
+	}
+	return resp, nil
+}
+
+func newTestResponse(status int, retryAfter string) *http.Response {
+	resp := &http.Response{
+		StatusCode: status,
+		Header:     make(http.Header),
+		Body:       ioutil.NopCloser(strings.NewReader("")),
+	}
+	if retryAfter != "" {
+		resp.Header.Set("Retry-After", retryAfter)
+	}
+	return resp
+}
+
+func newTestRetryTransport(fake *fakeTransport, retries int) (*retryTransport, *[]time.Duration) {
+	var waits []time.Duration
+	t := NewRetryTransport(fake, retries, 30*time.Second).(*retryTransport)
+	t.after = func(d time.Duration) <-chan time.Time {
+		waits = append(waits, d)
+		c := make(chan time.Time, 1)
+		c <- time.Now()
+		return c
+	}
+	return t, &waits
+}
+
+func TestRetryTransport(t *testing.T) {
+	watchURL := "https://apiserver.kube2lb.test/api/v1/services?watch=true"
+	cases := []struct {
+		Title     string
+		URL       string
+		Responses []*http.Response
+		Retries   int
+		Status    int
+		Waits     []time.Duration
+	}{
+		{
+			"retry after throttled request",
+			watchURL,
+			[]*http.Response{newTestResponse(429, "2"), newTestResponse(200, "")},
+			5, 200, []time.Duration{2 * time.Second},
+		},
+		{
+			"old watch path",
+			"https://apiserver.kube2lb.test/api/v1/watch/services",
+			[]*http.Response{newTestResponse(429, "2"), newTestResponse(200, "")},
+			5, 200, []time.Duration{2 * time.Second},
+		},
+		{
+			"no retries without Retry-After",
+			watchURL,
+			[]*http.Response{newTestResponse(429, ""), newTestResponse(200, "")},
+			5, 429, nil,
+		},
+		{
+			"wait limited to the maximum",
+			watchURL,
+			[]*http.Response{newTestResponse(429, "3600"), newTestResponse(200, "")},
+			5, 200, []time.Duration{30 * time.Second},
+		},
+		{
+			"retries exhausted",
+			watchURL,
+			[]*http.Response{newTestResponse(429, "1")},
+			2, 429, []time.Duration{time.Second, time.Second},
+		},
+		{
+			"other errors are not retried",
+			watchURL,
+			[]*http.Response{newTestResponse(500, "1"), newTestResponse(200, "")},
+			5, 500, nil,
+		},
+		{
+			"requests retried by client-go are not retried",
+			"https://apiserver.kube2lb.test/api/v1/services",
+			[]*http.Response{newTestResponse(429, "1"), newTestResponse(200, "")},
+			5, 429, nil,
+		},
+	}
+
+	for _, c := range cases {
+		transport, waits := newTestRetryTransport(&fakeTransport{responses: c.Responses}, c.Retries)
+		req, _ := http.NewRequest("GET", c.URL, nil)
+		resp, err := transport.RoundTrip(req)
+		if assert.NoError(t, err, c.Title) {
+			assert.Equal(t, c.Status, resp.StatusCode, c.Title)
+			assert.Equal(t, c.Waits, *waits, c.Title)
+		}
+	}
+}
+
+func TestRetryTransportAttempts(t *testing.T) {
+	var attempts int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&attempts, 1)
+		w.Header().Set("Retry-After", "0")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+
+	config := &rest.Config{Host: server.URL, QPS: 1000, Burst: 1000}
+	wrapRetryTransport(config, 3, time.Second)
+	client, err := kubernetes.NewForConfig(config)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	_, err = client.CoreV1().Services("").List(meta_v1.ListOptions{})
+	assert.Error(t, err)
+	assert.Equal(t, int32(10), atomic.LoadInt32(&attempts), "only client-go should retry requests")
+
+	atomic.StoreInt32(&attempts, 0)
+	_, err = client.CoreV1().Services("").Watch(meta_v1.ListOptions{})
+	assert.Error(t, err)
+	assert.Equal(t, int32(4), atomic.LoadInt32(&attempts), "watch requests should be retried up to the limit")
+}
+
+func TestWrapRetryTransport(t *testing.T) {
+	fake := &fakeTransport{responses: []*http.Response{newTestResponse(429, "0"), newTestResponse(200, "")}}
+
+	config := &rest.Config{}
+	wrapRetryTransport(config, 0, time.Second)
+	assert.Nil(t, config.WrapTransport, "transport shouldn't be wrapped if retries are disabled")
+
+	wrapRetryTransport(config, 1, time.Second)
+	if assert.NotNil(t, config.WrapTransport) {
+		req, _ := http.NewRequest("GET", "https://apiserver.kube2lb.test/api/v1/services?watch=true", nil)
+		resp, err := config.WrapTransport(fake).RoundTrip(req)
+		if assert.NoError(t, err) {
+			assert.Equal(t, 200, resp.StatusCode)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+/*
+Copyright 2016 Tuenti Technologies S.L. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+
+	"github.com/ghodss/yaml"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+var serviceSettingsConfigMap string
+
+func init() {
+	flag.StringVar(&serviceSettingsConfigMap, "service-settings-config-map", "", "Config map with settings of services, as NAMESPACE/NAME, annotations of services override them (Optional)")
+}
+
+// ServiceSettingsStore contains the config map with the settings of services,
+// its keys are NAMESPACE.NAME, and its values are YAML or JSON objects with
+// the annotations to use for each service
+type ServiceSettingsStore struct {
+	*LocalStore
+}
+
+func serviceSettingsKey(namespace, name string) string {
+	return namespace + "." + name
+}
+
+// Settings returns the annotations to use for each service, by settings key,
+// invalid settings are ignored
+func (s *ServiceSettingsStore) Settings() (map[string]map[string]string, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	settings := make(map[string]map[string]string)
+	for _, o := range s.Objects {
+		configMap, ok := o.(*v1.ConfigMap)
+		if !ok {
+			return nil, fmt.Errorf("couldn't convert config map")
+		}
+		for key, data := range configMap.Data {
+			var annotations map[string]string
+			if err := yaml.Unmarshal([]byte(data), &annotations); err != nil {
+				log.Printf("Ignoring invalid settings for %s in config map %s/%s: %s", key, configMap.Namespace, configMap.Name, err)
+				continue
+			}
+			settings[key] = annotations
+		}
+	}
+	return settings, nil
+}
+
+// withSettings returns a copy of the service with its settings as
+// annotations, annotations of the service override them
+func withSettings(s *v1.Service, settings map[string]map[string]string) *v1.Service {
+	serviceSettings, found := settings[serviceSettingsKey(s.Namespace, s.Name)]
+	if !found || len(serviceSettings) == 0 {
+		return s
+	}
+	annotations := make(map[string]string, len(serviceSettings)+len(s.Annotations))
+	for k, v := range serviceSettings {
+		annotations[k] = v
+	}
+	for k, v := range s.Annotations {
+		annotations[k] = v
+	}
+	copied := *s
+	copied.Annotations = annotations
+	return &copied
+}
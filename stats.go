@@ -0,0 +1,73 @@
+/*
+Copyright 2017 Tuenti Technologies S.L. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+)
+
+var statsPort = 0
+var statsURI = "/stats"
+var statsAuth = ""
+
+func init() {
+	flag.IntVar(&statsPort, "stats-port", statsPort, "Port for the stats frontend of the load balancer, stats are disabled if not set")
+	flag.StringVar(&statsURI, "stats-uri", statsURI, "URI of the stats frontend of the load balancer")
+	flag.StringVar(&statsAuth, "stats-auth", statsAuth, "Credentials for the stats frontend of the load balancer, as USER:PASSWORD (Optional)")
+}
+
+// StatsInformation contains the configuration of the stats frontend of the
+// load balancer
+type StatsInformation struct {
+	Port     int
+	URI      string
+	User     string
+	Password string
+}
+
+// Auth returns the credentials as USER:PASSWORD, empty if not set
+func (s StatsInformation) Auth() string {
+	if s.User == "" {
+		return ""
+	}
+	return s.User + ":" + s.Password
+}
+
+// statsInformation returns the stats configuration from flags, nil if
+// stats are disabled
+func statsInformation() (*StatsInformation, error) {
+	if statsPort == 0 {
+		return nil, nil
+	}
+	if statsPort < 0 || statsPort > 65535 {
+		return nil, fmt.Errorf("invalid stats port %d", statsPort)
+	}
+	if !strings.HasPrefix(statsURI, "/") {
+		return nil, fmt.Errorf("invalid stats URI %s, it must start with /", statsURI)
+	}
+	stats := &StatsInformation{Port: statsPort, URI: statsURI}
+	if statsAuth != "" {
+		auth := strings.SplitN(statsAuth, ":", 2)
+		if len(auth) < 2 || auth[0] == "" {
+			return nil, fmt.Errorf("stats credentials expected as USER:PASSWORD")
+		}
+		stats.User, stats.Password = auth[0], auth[1]
+	}
+	return stats, nil
+}
@@ -0,0 +1,78 @@
+/*
+Copyright 2017 Tuenti Technologies S.L. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStatsInformation(t *testing.T) {
+	defer func(port int, uri, auth string) {
+		statsPort, statsURI, statsAuth = port, uri, auth
+	}(statsPort, statsURI, statsAuth)
+
+	cases := []struct {
+		Port     int
+		URI      string
+		Auth     string
+		Expected *StatsInformation
+		Error    bool
+	}{
+		{0, "/stats", "admin:secret", nil, false},
+		{8404, "/stats", "", &StatsInformation{Port: 8404, URI: "/stats"}, false},
+		{8404, "/haproxy?stats", "admin:secret:with:colons", &StatsInformation{Port: 8404, URI: "/haproxy?stats", User: "admin", Password: "secret:with:colons"}, false},
+		{70000, "/stats", "", nil, true},
+		{8404, "stats", "", nil, true},
+		{8404, "/stats", "admin", nil, true},
+		{8404, "/stats", ":secret", nil, true},
+	}
+
+	for _, c := range cases {
+		statsPort, statsURI, statsAuth = c.Port, c.URI, c.Auth
+		stats, err := statsInformation()
+		if c.Error {
+			assert.Error(t, err, "error expected for %+v", c)
+			continue
+		}
+		if assert.NoError(t, err) {
+			assert.Equal(t, c.Expected, stats)
+		}
+	}
+}
+
+func TestStatsInClusterInformation(t *testing.T) {
+	defer func(port int, auth string) { statsPort, statsAuth = port, auth }(statsPort, statsAuth)
+
+	service, endpoints := newTestService("service1", nil)
+	client := newTestStoresClient(service, endpoints)
+	template := &dummyTemplate{}
+	client.AddTemplate(template)
+
+	statsPort = 0
+	if assert.NoError(t, client.Update(context.Background())) {
+		assert.Nil(t, template.lastExecutedWith.Stats, "stats should be disabled by default")
+	}
+
+	statsPort, statsAuth = 8404, "admin:secret"
+	if assert.NoError(t, client.Update(context.Background())) && assert.NotNil(t, template.lastExecutedWith.Stats) {
+		assert.Equal(t, 8404, template.lastExecutedWith.Stats.Port)
+		assert.Equal(t, "admin:secret", template.lastExecutedWith.Stats.Auth())
+	}
+}
@@ -18,22 +18,67 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/hex"
 	"flag"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
 	"net"
 	"os"
 	"path"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"text/template"
+	"time"
+	"unicode"
+
+	"github.com/ghodss/yaml"
 )
 
 var defaultServerNameTemplate = "{{ .Service.Name }}.{{ .Service.Namespace }}.svc.{{ .Domain }}"
 var serverNameTemplatesArg string
 var serverNameTemplates []*template.Template
+var serverNameTemplatesFile string
+var namespaceServerNameTemplates map[string][]*template.Template
+var wildcardServerNames = false
+var strictServerNames = false
+var strictServerNameTemplates = false
+var lowercaseServerNames = false
+var templateLeftDelim = "{{"
+var templateRightDelim = "}}"
+var nowFormat = "RFC3339"
+var nowUTC = false
+var maxConfigSize = 0
+var serverLinesNodeComments = false
+var emitSourceComments = false
+var strictPortLabels = false
+var renderTimeout time.Duration
 
 func init() {
 	flag.StringVar(&serverNameTemplatesArg, "server-name-templates", defaultServerNameTemplate, "Comma-separated list of go templates to generate server names")
+	flag.StringVar(&serverNameTemplatesFile, "server-name-templates-file", "", "YAML or JSON file with lists of server name templates by namespace, overriding the global ones (Optional)")
+	flag.StringVar(&templateLeftDelim, "template-left-delim", templateLeftDelim, "Left delimiter of actions in configuration templates")
+	flag.StringVar(&templateRightDelim, "template-right-delim", templateRightDelim, "Right delimiter of actions in configuration templates")
+	flag.BoolVar(&strictServerNames, "strict-server-names", strictServerNames, "Fail to generate configuration if different services have the same server names")
+	flag.BoolVar(&strictServerNameTemplates, "strict-server-name-templates", strictServerNameTemplates, "Fail to generate configuration if a server name template cannot be executed, otherwise the name is skipped")
+	flag.BoolVar(&lowercaseServerNames, "lowercase-server-names", lowercaseServerNames, "Convert generated and external server names to lowercase, regular expressions are not modified")
+	flag.BoolVar(&wildcardServerNames, "wildcard-server-names", wildcardServerNames, "Also generate wildcard server names (*.name) for the names generated with server name templates")
+	flag.StringVar(&nowFormat, "now-format", nowFormat, "Default format for timestamps generated with Now in templates, a Go time layout or the name of a standard one (e.g. RFC3339)")
+	flag.BoolVar(&nowUTC, "now-utc", nowUTC, "Generate timestamps with Now in templates in UTC")
+	flag.BoolVar(&serverLinesNodeComments, "server-lines-node-comments", serverLinesNodeComments, "Add a comment with the node of the endpoint to lines generated with ServerLines")
+	flag.BoolVar(&strictPortLabels, "strict-port-labels", strictPortLabels, "Fail to generate configuration if different ports have the same label, otherwise they share frontends")
+	flag.BoolVar(&emitSourceComments, "emit-source-comments", emitSourceComments, "Make SourceComment return comments with the namespace, name and resource version of the source service of each backend")
+	flag.DurationVar(&renderTimeout, "render-timeout", renderTimeout, "Maximum time to execute a configuration template, current configurations are kept if exceeded, 0 for no limit")
+	flag.IntVar(&maxConfigSize, "max-config-size", maxConfigSize, "Maximum size in bytes of generated configurations, larger ones are not written and current ones are kept, 0 for no limit")
 }
 
 type serverName string
@@ -46,6 +91,51 @@ func (s serverName) Regexp() string {
 	return strings.TrimPrefix(string(s), "~")
 }
 
+// IsWildcard returns true for names matching any subdomain, as *.example.com
+func (s serverName) IsWildcard() bool {
+	return strings.HasPrefix(string(s), "*.")
+}
+
+// Suffix returns the domain matched by a wildcard name, including the
+// leading dot
+func (s serverName) Suffix() string {
+	return strings.TrimPrefix(string(s), "*")
+}
+
+var dnsLabelRegexp = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?$`)
+
+// validateServerName checks that a name is a valid DNS name, optionally
+// starting with "*." for wildcards, or a valid regular expression if it
+// starts with "~". Regular expressions cannot contain spaces or control
+// characters, as they are used as arguments in configurations.
+func validateServerName(name string) error {
+	n := serverName(name)
+	if n.IsRegexp() {
+		if n.Regexp() == "" {
+			return fmt.Errorf("empty regular expression")
+		}
+		for _, r := range n.Regexp() {
+			if unicode.IsSpace(r) || unicode.IsControl(r) {
+				return fmt.Errorf("regular expression contains spaces or control characters")
+			}
+		}
+		_, err := regexp.Compile(n.Regexp())
+		return err
+	}
+	if n.IsWildcard() {
+		name = strings.TrimPrefix(n.Suffix(), ".")
+	}
+	if len(name) == 0 || len(name) > 253 {
+		return fmt.Errorf("DNS names must have between 1 and 253 characters")
+	}
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if !dnsLabelRegexp.MatchString(label) {
+			return fmt.Errorf("invalid DNS label '%s'", label)
+		}
+	}
+	return nil
+}
+
 func parseServerNameTemplatesArg(templatesArg string) ([]*template.Template, error) {
 	if len(templatesArg) == 0 {
 		templatesArg = defaultServerNameTemplate
@@ -62,19 +152,91 @@ func parseServerNameTemplatesArg(templatesArg string) ([]*template.Template, err
 	return templates, nil
 }
 
+// parseNamespaceServerNameTemplates parses a YAML or JSON document with
+// lists of server name templates by namespace
+func parseNamespaceServerNameTemplates(data []byte) (map[string][]*template.Template, error) {
+	var definitions map[string][]string
+	if err := yaml.Unmarshal(data, &definitions); err != nil {
+		return nil, err
+	}
+	namespaceTemplates := make(map[string][]*template.Template)
+	for namespace, templateStrings := range definitions {
+		if len(templateStrings) == 0 {
+			return nil, fmt.Errorf("no server name templates for namespace %s", namespace)
+		}
+		templates := make([]*template.Template, len(templateStrings))
+		for i, templateString := range templateStrings {
+			t, err := template.New("server_name").Parse(templateString)
+			if err != nil {
+				return nil, fmt.Errorf("namespace %s: %v", namespace, err)
+			}
+			templates[i] = t
+		}
+		namespaceTemplates[namespace] = templates
+	}
+	return namespaceTemplates, nil
+}
+
 func initServerNameTemplates() (err error) {
 	if len(serverNameTemplates) > 0 {
 		return nil
 	}
 	serverNameTemplates, err = parseServerNameTemplatesArg(serverNameTemplatesArg)
+	if err != nil || serverNameTemplatesFile == "" {
+		return err
+	}
+	data, err := ioutil.ReadFile(serverNameTemplatesFile)
+	if err != nil {
+		return err
+	}
+	namespaceServerNameTemplates, err = parseNamespaceServerNameTemplates(data)
 	return err
 }
 
+// serverNameTemplatesFor returns the server name templates for a namespace
+func serverNameTemplatesFor(namespace string) []*template.Template {
+	if templates, found := namespaceServerNameTemplates[namespace]; found {
+		return templates
+	}
+	return serverNameTemplates
+}
+
 type PortSpec struct {
 	IP       net.IP
 	Port     int32
 	Mode     string
 	Protocol string
+
+	// Socket is the path of the unix socket to bind instead of IP and port,
+	// empty to bind on IP and port
+	Socket string
+}
+
+// Address returns the address to bind, the path of the unix socket if any,
+// or the IP and port
+func (s PortSpec) Address() string {
+	if s.Socket != "" {
+		return s.Socket
+	}
+	var ip string
+	if s.IP != nil {
+		ip = s.IP.String()
+	}
+	return net.JoinHostPort(ip, strconv.Itoa(int(s.Port)))
+}
+
+// labelEscaper escapes the separator used in labels, so fields can contain it
+// without colliding with other labels, escaped fields never contain "_"
+var labelEscaper = strings.NewReplacer(".", ".d", "_", ".u")
+var labelUnescaper = strings.NewReplacer(".d", ".", ".u", "_")
+
+// label joins escaped fields with underscores
+func label(fields ...string) string {
+	escaped := make([]string, len(fields))
+	for i, f := range fields {
+		escaped[i] = labelEscaper.Replace(f)
+	}
+	return strings.Join(escaped, "_")
 }
 
 // String representation of a PortSpec, intended to be used as config label
@@ -86,23 +248,295 @@ func (s PortSpec) String() string {
 	} else {
 		encodedIP = hex.EncodeToString(s.IP)
 	}
-	return fmt.Sprintf("%s_%d_%s_%s", encodedIP, s.Port, s.Protocol, s.Mode)
+	if s.Socket != "" {
+		// Socket paths are hex-encoded as they can contain any character
+		return label(encodedIP, strconv.Itoa(int(s.Port)), s.Protocol, s.Mode, hex.EncodeToString([]byte(s.Socket)))
+	}
+	return label(encodedIP, strconv.Itoa(int(s.Port)), s.Protocol, s.Mode)
+}
+
+// frontendName returns an identifier for the frontend of a port, that only
+// contains ASCII alphanumeric characters, dashes, dots and underscores
+func frontendName(s PortSpec) string {
+	var b bytes.Buffer
+	b.WriteString("fe_")
+	for _, c := range []byte(s.String()) {
+		if (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || c == '-' || c == '_' || c == '.' {
+			b.WriteByte(c)
+			continue
+		}
+		// Other characters are hex-escaped, as dots and underscores in labels
+		fmt.Fprintf(&b, ".x%02x", c)
+	}
+	return b.String()
+}
+
+// haproxyEscaper escapes the characters interpreted by HAProxy in double
+// quoted arguments, control characters would break the configuration line
+var haproxyEscaper = strings.NewReplacer(
+	`\`, `\\`,
+	`"`, `\"`,
+	`$`, `\$`,
+	"\n", `\n`,
+	"\r", `\r`,
+	"\t", `\t`,
+)
+
+// haproxyEscape returns the value as a double quoted argument that HAProxy
+// reads verbatim
+func haproxyEscape(value string) string {
+	return `"` + haproxyEscaper.Replace(value) + `"`
+}
+
+// ParsePortSpec reconstructs a PortSpec from its string representation
+func ParsePortSpec(label string) (PortSpec, error) {
+	fields := strings.Split(label, "_")
+	if len(fields) != 4 && len(fields) != 5 {
+		return PortSpec{}, fmt.Errorf("port spec label expected as IP_PORT_PROTOCOL_MODE[_SOCKET], found '%s'", label)
+	}
+	for i := range fields {
+		fields[i] = labelUnescaper.Replace(fields[i])
+	}
+
+	var ip net.IP
+	decodedIP, err := hex.DecodeString(fields[0])
+	if err != nil {
+		return PortSpec{}, fmt.Errorf("invalid IP in port spec label '%s': %v", label, err)
+	}
+	switch len(decodedIP) {
+	case 0:
+	case net.IPv4len:
+		ip = net.IPv4(decodedIP[0], decodedIP[1], decodedIP[2], decodedIP[3])
+	case net.IPv6len:
+		ip = net.IP(decodedIP)
+	default:
+		return PortSpec{}, fmt.Errorf("invalid IP length in port spec label '%s'", label)
+	}
+
+	port, err := strconv.ParseInt(fields[1], 10, 32)
+	if err != nil {
+		return PortSpec{}, fmt.Errorf("invalid port in port spec label '%s': %v", label, err)
+	}
+
+	var socket string
+	if len(fields) == 5 {
+		decodedSocket, err := hex.DecodeString(fields[4])
+		if err == nil && len(decodedSocket) == 0 {
+			err = fmt.Errorf("empty path")
+		}
+		if err != nil {
+			return PortSpec{}, fmt.Errorf("invalid socket in port spec label '%s': %v", label, err)
+		}
+		socket = string(decodedSocket)
+	}
+
+	return PortSpec{
+		IP:       ip,
+		Port:     int32(port),
+		Protocol: fields[2],
+		Mode:     fields[3],
+		Socket:   socket,
+	}, nil
 }
 
 type ServiceInformation struct {
-	Name      string
-	Namespace string
-	Port      PortSpec
-	Endpoints []ServiceEndpoint
-	NodePort  int32
-	External  []string
-	Timeout   int
+	Cluster        string
+	Name           string
+	Namespace      string
+	Port           PortSpec
+	Endpoints      []ServiceEndpoint
+	NotReady       []ServiceEndpoint
+	BackendPort    int32
+	NodePort       int32
+	External       []string
+	Timeout        int
+	Timeouts       Timeouts
+	AllowedCIDRs   []string
+	BackendOptions []string
+	BindOptions    []string
+	SNIHosts       []string
+	Balance        string
+	DrainTimeout   time.Duration
+	Cookie         *CookieSpec
+	BackendTLS     BackendTLS
+	HTTP2          bool
+	ALPN           []string
+	HealthCheck    *HealthCheck
+	DefaultServer  *DefaultServer
+	AgentCheck     *AgentCheck
+	Redirect       *Redirect
+	RateLimit      int
+	Weight         int
+	Weighted       bool
+	Retries        int
+	MinEndpoints   int
+	Annotations    map[string]string
+
+	// ResourceVersion of the service, only set with -emit-source-comments,
+	// so other changes in the service don't modify the information
+	ResourceVersion string
+
+	// LocalTraffic is set for services with Local external traffic policy,
+	// LocalNodes contains the nodes with ready endpoints in that case
+	LocalTraffic bool
+	LocalNodes   []string
+}
+
+// Timeouts of a service port in milliseconds, zero if not set
+type Timeouts struct {
+	Connect int `json:"connect"`
+	Client  int `json:"client"`
+	Server  int `json:"server"`
+	Queue   int `json:"queue"`
+}
+
+// CookieSpec describes the cookie used for stickiness, nil if not used
+type CookieSpec struct {
+	Name string
+	Mode string
+}
+
+// HealthCheck describes the health checks of a backend, nil if not configured
+type HealthCheck struct {
+	// ExpectStatus is the expected status code, or range of codes as MIN-MAX
+	ExpectStatus string
+}
+
+// DefaultServer contains options applied to all the servers of a backend,
+// nil if not configured. Inter is the interval between health checks in
+// milliseconds, options are not set if zero.
+type DefaultServer struct {
+	Inter int `json:"inter"`
+	Rise  int `json:"rise"`
+	Fall  int `json:"fall"`
+}
+
+// Options returns the options for default-server lines
+func (d DefaultServer) Options() string {
+	var options []string
+	if d.Inter > 0 {
+		options = append(options, fmt.Sprintf("inter %d", d.Inter))
+	}
+	if d.Rise > 0 {
+		options = append(options, fmt.Sprintf("rise %d", d.Rise))
+	}
+	if d.Fall > 0 {
+		options = append(options, fmt.Sprintf("fall %d", d.Fall))
+	}
+	return strings.Join(options, " ")
+}
+
+// AgentCheck describes the agent checks of the servers of a backend, done in
+// a side port, nil if not configured
+type AgentCheck struct {
+	Port     int32 `json:"port"`
+	Interval int   `json:"interval"`
+}
+
+// Options returns the options for server lines
+func (a AgentCheck) Options() string {
+	options := fmt.Sprintf("agent-check agent-port %d", a.Port)
+	if a.Interval > 0 {
+		options += fmt.Sprintf(" agent-inter %d", a.Interval)
+	}
+	return options
+}
+
+const (
+	RedirectScheme   = "scheme"
+	RedirectLocation = "location"
+	RedirectPrefix   = "prefix"
+)
+
+// Redirect describes an HTTP redirection for the requests to a service, nil
+// if requests are not redirected
+type Redirect struct {
+	Type   string
+	Target string
+	Code   int
+}
+
+// Rule returns the redirect rule, to be used in http-request directives
+func (r Redirect) Rule() string {
+	return fmt.Sprintf("redirect %s %s code %d", r.Type, r.Target, r.Code)
+}
+
+const (
+	BackendTLSVerifyNone     = "none"
+	BackendTLSVerifyRequired = "required"
+)
+
+// BackendTLS describes how to connect with backends serving TLS
+type BackendTLS struct {
+	Enabled bool
+	Verify  string
+	CAFile  string
+}
+
+// ServerOptions returns the ssl options for the servers of the backend,
+// empty if TLS is not enabled
+func (t BackendTLS) ServerOptions() string {
+	if !t.Enabled {
+		return ""
+	}
+	options := "ssl verify " + t.Verify
+	if t.Verify == BackendTLSVerifyRequired && t.CAFile != "" {
+		options += " ca-file " + t.CAFile
+	}
+	return options
+}
+
+// NodePortNodes returns the nodes that can receive traffic on the node port
+// of the service, only the nodes with ready endpoints are returned for
+// services with Local external traffic policy
+func (s ServiceInformation) NodePortNodes(nodes []string) []string {
+	if !s.LocalTraffic {
+		return nodes
+	}
+	local := make(map[string]bool)
+	for _, n := range s.LocalNodes {
+		local[n] = true
+	}
+	var nodePortNodes []string
+	for _, n := range nodes {
+		if local[n] {
+			nodePortNodes = append(nodePortNodes, n)
+		}
+	}
+	return nodePortNodes
+}
+
+// ReadyCount is the number of endpoints ready to receive traffic
+func (s ServiceInformation) ReadyCount() int {
+	return len(s.Endpoints)
+}
+
+// TotalCount is the number of endpoints of the service, ready or not
+func (s ServiceInformation) TotalCount() int {
+	return len(s.Endpoints) + len(s.NotReady)
+}
+
+// ALPNOption returns the alpn option with the protocols of the service, empty
+// if no protocols are set
+func (s ServiceInformation) ALPNOption() string {
+	if len(s.ALPN) == 0 {
+		return ""
+	}
+	return "alpn " + strings.Join(s.ALPN, ",")
+}
+
+// SourceComment returns a comment with the source service, empty if
+// -emit-source-comments is not set
+func (s ServiceInformation) SourceComment() string {
+	if !emitSourceComments {
+		return ""
+	}
+	return fmt.Sprintf("# source: service %s/%s resourceVersion=%s", s.Namespace, s.Name, s.ResourceVersion)
 }
 
 // String representation of a Service, intended to be used as config label
 func (s ServiceInformation) String() string {
-	return fmt.Sprintf("%s_%s_%d_%s_%s",
-		s.Name, s.Namespace, s.Port.Port, s.Port.Protocol, s.Port.Mode)
+	return label(s.Name, s.Namespace, strconv.Itoa(int(s.Port.Port)), s.Port.Protocol, s.Port.Mode)
 }
 
 type ClusterInformation struct {
@@ -110,53 +544,341 @@ type ClusterInformation struct {
 	Ports    []PortSpec
 	Nodes    []string
 	Domain   string
+	Domains  []string
+	Stats    *StatsInformation
+
+	// Maintenance is the maintenance backend, nil if disabled
+	Maintenance *MaintenanceInformation
+}
+
+// PortBindOptions returns the bind options of the services using a port,
+// without duplicates
+func (c *ClusterInformation) PortBindOptions(port PortSpec) []string {
+	var options []string
+	seen := make(map[string]bool)
+	for _, service := range c.Services {
+		if service.Port.String() != port.String() {
+			continue
+		}
+		for _, option := range service.BindOptions {
+			if !seen[option] {
+				seen[option] = true
+				options = append(options, option)
+			}
+		}
+	}
+	return options
+}
+
+// ProtocolServices contains the services and ports of a protocol
+type ProtocolServices struct {
+	Protocol string
+	Services []ServiceInformation
+	Ports    []PortSpec
+}
+
+// portProtocol returns the protocol of a port as used to group services, the
+// mode for TCP ports, and the transport protocol otherwise
+func portProtocol(port PortSpec) string {
+	if port.Protocol == "" || port.Protocol == "tcp" {
+		return port.Mode
+	}
+	return port.Protocol
+}
+
+// ServicesByProtocol groups the services and ports by protocol, so each one
+// can have its own sections. Groups are sorted by protocol, services and ports
+// keep their order.
+func (c *ClusterInformation) ServicesByProtocol() []ProtocolServices {
+	groups := make(map[string]*ProtocolServices)
+	group := func(protocol string) *ProtocolServices {
+		g, found := groups[protocol]
+		if !found {
+			g = &ProtocolServices{Protocol: protocol}
+			groups[protocol] = g
+		}
+		return g
+	}
+	for _, service := range c.Services {
+		g := group(portProtocol(service.Port))
+		g.Services = append(g.Services, service)
+	}
+	for _, port := range c.Ports {
+		g := group(portProtocol(port))
+		g.Ports = append(g.Ports, port)
+	}
+
+	protocols := make([]string, 0, len(groups))
+	for protocol := range groups {
+		protocols = append(protocols, protocol)
+	}
+	sort.Strings(protocols)
+	result := make([]ProtocolServices, 0, len(protocols))
+	for _, protocol := range protocols {
+		result = append(result, *groups[protocol])
+	}
+	return result
+}
+
+func servicesPorts(services []ServiceInformation) []PortSpec {
+	portsMap := make(map[string]PortSpec)
+	for _, service := range services {
+		portsMap[service.Port.String()] = service.Port
+	}
+	ports := make([]PortSpec, 0, len(portsMap))
+	for _, port := range portsMap {
+		ports = append(ports, port)
+	}
+	// Ports are sorted so generated configurations are stable
+	sort.Slice(ports, func(i, j int) bool {
+		return ports[i].String() < ports[j].String()
+	})
+	return ports
+}
+
+// sortServices sorts the services by namespace, name and port, so generated
+// configurations are stable
+func sortServices(services []ServiceInformation) {
+	sort.SliceStable(services, func(i, j int) bool {
+		a, b := services[i], services[j]
+		if a.Namespace != b.Namespace {
+			return a.Namespace < b.Namespace
+		}
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+		if a.Port.Port != b.Port.Port {
+			return a.Port.Port < b.Port.Port
+		}
+		return a.Port.String() < b.Port.String()
+	})
 }
 
 type Template interface {
-	Execute(info *ClusterInformation) error
+	// Execute generates the output for the cluster information, it
+	// returns true if the output has changed since last execution
+	Execute(info *ClusterInformation) (bool, error)
+}
+
+// sizedTemplate is implemented by templates that report the size of the
+// configuration rendered in their last execution
+type sizedTemplate interface {
+	Template
+	renderedSize() (target string, size int)
+}
+
+// orderedTemplate is implemented by templates that must be executed after the
+// templates added before them, as the ones reading their output
+type orderedTemplate interface {
+	Template
+	executeAfterPrevious()
+}
+
+// Content between lines containing these markers is not considered when
+// checking if a configuration has changed
+const (
+	IgnoreChangesBeginMarker = "kube2lb:ignore-changes-begin"
+	IgnoreChangesEndMarker   = "kube2lb:ignore-changes-end"
+)
+
+// withoutIgnoredRegions removes the lines between ignore changes markers,
+// markers included
+func withoutIgnoredRegions(content []byte) []byte {
+	var result bytes.Buffer
+	ignoring := false
+	for _, line := range bytes.SplitAfter(content, []byte("\n")) {
+		switch {
+		case !ignoring && bytes.Contains(line, []byte(IgnoreChangesBeginMarker)):
+			ignoring = true
+		case ignoring && bytes.Contains(line, []byte(IgnoreChangesEndMarker)):
+			ignoring = false
+		case !ignoring:
+			result.Write(line)
+		}
+	}
+	return result.Bytes()
+}
+
+// equalConfigs compares configurations ignoring the regions between markers
+func equalConfigs(a, b []byte) bool {
+	return bytes.Equal(withoutIgnoredRegions(a), withoutIgnoredRegions(b))
+}
+
+// checkConfigSize returns an error if the data to write exceeds the maximum
+// configuration size
+func checkConfigSize(target string, data []byte) error {
+	if maxConfigSize <= 0 || len(data) <= maxConfigSize {
+		return nil
+	}
+	configSizeOverflows.Add(1)
+	return fmt.Errorf("configuration for %s has %d bytes, more than the maximum of %d, keeping the current one", target, len(data), maxConfigSize)
 }
 
 type templateFile struct {
-	Source, Path string
+	Source, Path, Partials string
+
+	// Set if the last execution changed the file, with its previous
+	// content, nil if it didn't exist, for rollbacks
+	changed  bool
+	previous []byte
+
+	// Size of the last rendered configuration
+	size int
 }
 
-func NewTemplate(source, path string) Template {
+// NewTemplate creates a template that writes into path, partials is an
+// optional directory with additional .tmpl files that can be included
+// from source
+func NewTemplate(source, path, partials string) Template {
 	return &templateFile{
-		Source: source,
-		Path:   path,
+		Source:   source,
+		Path:     path,
+		Partials: partials,
 	}
 }
 
+// removeDuplicated returns the names without duplicates, keeping the order of
+// their first occurrence so generated configurations are stable
 func removeDuplicated(names []string) []string {
-	seen := make(map[string]interface{})
+	seen := make(map[string]bool)
+	uniq := make([]string, 0, len(names))
 	for _, name := range names {
-		seen[name] = nil
-	}
-	uniq := make([]string, 0, len(seen))
-	for k := range seen {
-		uniq = append(uniq, k)
+		if !seen[name] {
+			seen[name] = true
+			uniq = append(uniq, name)
+		}
 	}
 	return uniq
 }
 
-func generateServerNames(s ServiceInformation, domain string) []serverName {
-	serverNames := make([]string, len(serverNameTemplates))
-	for i, t := range serverNameTemplates {
-		data := struct {
-			Service ServiceInformation
-			Domain  string
-		}{s, domain}
-		var serverName bytes.Buffer
-		t.Execute(&serverName, data)
-		serverNames[i] = serverName.String()
+// serverNameDomains returns the domains to generate server names for, the
+// requested one and the rest of cluster domains
+func serverNameDomains(info *ClusterInformation, domain string) []string {
+	domains := []string{domain}
+	for _, d := range info.Domains {
+		if d != domain {
+			domains = append(domains, d)
+		}
 	}
-	return func() []serverName {
-		var sns []serverName
-		for _, n := range append(removeDuplicated(serverNames), s.External...) {
-			sns = append(sns, serverName(n))
+	return domains
+}
+
+// serverNameData is the information available in server name templates
+type serverNameData struct {
+	Service ServiceInformation
+	Port    PortSpec
+	Domain  string
+	Nodes   []string
+}
+
+func generateServerNames(s ServiceInformation, domains []string, nodes []string) ([]serverName, error) {
+	var serverNames []string
+	for _, t := range serverNameTemplatesFor(s.Namespace) {
+		for _, domain := range domains {
+			data := serverNameData{
+				Service: s,
+				Port:    s.Port,
+				Domain:  domain,
+				Nodes:   nodes,
+			}
+			var serverName bytes.Buffer
+			if err := t.Execute(&serverName, data); err != nil {
+				if strictServerNameTemplates {
+					return nil, fmt.Errorf("couldn't generate server name for %s/%s: %v", s.Namespace, s.Name, err)
+				}
+				log.Printf("Skipping server name for %s/%s: %v", s.Namespace, s.Name, err)
+				continue
+			}
+			serverNames = append(serverNames, serverName.String())
 		}
-		return sns
-	}()
+	}
+	if wildcardServerNames {
+		for _, n := range serverNames {
+			if !serverName(n).IsRegexp() && !serverName(n).IsWildcard() {
+				serverNames = append(serverNames, "*."+n)
+			}
+		}
+	}
+	names := append(removeDuplicated(serverNames), s.External...)
+	if lowercaseServerNames {
+		for i, n := range names {
+			if !serverName(n).IsRegexp() {
+				names[i] = strings.ToLower(n)
+			}
+		}
+		names = removeDuplicated(names)
+	}
+	var sns []serverName
+	for _, n := range names {
+		sns = append(sns, serverName(n))
+	}
+	return sns, nil
+}
+
+// equalPortSpecs checks if two ports are the same, regardless of the
+// representation of their IPs
+func equalPortSpecs(a, b PortSpec) bool {
+	return a.IP.Equal(b.IP) && a.Port == b.Port && a.Mode == b.Mode && a.Protocol == b.Protocol && a.Socket == b.Socket
+}
+
+// checkPortLabelCollisions looks for different ports of the services with the
+// same label, they would be merged in the same frontend
+func checkPortLabelCollisions(services []ServiceInformation, label func(PortSpec) string) error {
+	ports := make(map[string]PortSpec)
+	var collisions []string
+	for _, s := range services {
+		l := label(s.Port)
+		port, found := ports[l]
+		if !found {
+			ports[l] = s.Port
+			continue
+		}
+		if !equalPortSpecs(port, s.Port) {
+			log.Printf("Port label %s used by ports %s:%d/%s/%s and %s:%d/%s/%s", l,
+				port.IP, port.Port, port.Protocol, port.Mode,
+				s.Port.IP, s.Port.Port, s.Port.Protocol, s.Port.Mode)
+			collisions = append(collisions, l)
+		}
+	}
+	portLabelCollisions.Set(int64(len(removeDuplicated(collisions))))
+	if strictPortLabels && len(collisions) > 0 {
+		return fmt.Errorf("port labels used by different ports: %s", strings.Join(removeDuplicated(collisions), ", "))
+	}
+	return nil
+}
+
+// checkServerNameCollisions looks for server names generated for more than one
+// service, ports of the same service can share server names
+func checkServerNameCollisions(info *ClusterInformation) error {
+	owners := make(map[serverName]string)
+	weighted := make(map[string]bool)
+	var collisions []string
+	for _, s := range info.Services {
+		service := s.Namespace + "/" + s.Name
+		if s.Weighted {
+			weighted[service] = true
+		}
+		names, err := generateServerNames(s, serverNameDomains(info, info.Domain), info.Nodes)
+		if err != nil {
+			return err
+		}
+		for _, n := range names {
+			owner, found := owners[n]
+			if !found {
+				owners[n] = service
+				continue
+			}
+			if owner != service && !(weighted[owner] && s.Weighted) {
+				log.Printf("Server name %s used by services %s and %s", n, owner, service)
+				collisions = append(collisions, string(n))
+			}
+		}
+	}
+	serverNameCollisions.Set(int64(len(removeDuplicated(collisions))))
+	if strictServerNames && len(collisions) > 0 {
+		return fmt.Errorf("server names used by more than one service: %s", strings.Join(removeDuplicated(collisions), ", "))
+	}
+	return nil
 }
 
 var nodeNameReplacer = strings.NewReplacer(".", "_", ":", "_")
@@ -180,29 +902,506 @@ func opAdd(ns ...int) int {
 	return r
 }
 
-func (t *templateFile) Execute(info *ClusterInformation) error {
+// inCIDR checks if an IP is contained in a CIDR, invalid IPs or CIDRs
+// are never considered to be contained
+func inCIDR(ip, cidr string) bool {
+	parsedIP := net.ParseIP(ip)
+	if parsedIP == nil {
+		return false
+	}
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return false
+	}
+	return network.Contains(parsedIP)
+}
+
+// sliceElement returns the element of a slice or array in the given index,
+// or the zero value of its elements if it is empty
+func sliceElement(items interface{}, index func(length int) int) (interface{}, error) {
+	v := reflect.ValueOf(items)
+	switch v.Kind() {
+	case reflect.Slice, reflect.Array:
+	default:
+		return nil, fmt.Errorf("expected slice or array, found %s", v.Kind())
+	}
+	if v.Len() == 0 {
+		return reflect.Zero(v.Type().Elem()).Interface(), nil
+	}
+	return v.Index(index(v.Len())).Interface(), nil
+}
+
+func first(items interface{}) (interface{}, error) {
+	return sliceElement(items, func(int) int { return 0 })
+}
+
+func last(items interface{}) (interface{}, error) {
+	return sliceElement(items, func(length int) int { return length - 1 })
+}
+
+// coalesce returns the first value that is not empty, as considered by if
+// actions in templates, or the last one if all of them are empty
+func coalesce(values ...interface{}) interface{} {
+	for _, v := range values {
+		if truth, ok := template.IsTrue(v); ok && truth {
+			return v
+		}
+	}
+	if len(values) == 0 {
+		return nil
+	}
+	return values[len(values)-1]
+}
+
+// list returns a list with the values, to be used in templates
+func list(values ...interface{}) []interface{} {
+	return values
+}
+
+// in checks if the value is an element of the list, it's false if the list is
+// not a slice or an array. Numbers are compared by value, so ports can be
+// compared with the integers of templates.
+func in(value interface{}, list interface{}) bool {
+	l := reflect.ValueOf(list)
+	if l.Kind() != reflect.Slice && l.Kind() != reflect.Array {
+		return false
+	}
+	for i := 0; i < l.Len(); i++ {
+		if equalValues(l.Index(i).Interface(), value) {
+			return true
+		}
+	}
+	return false
+}
+
+// equalValues compares numbers of any type by value, integers as int64 and
+// other numbers as float64, other values are compared as they are
+func equalValues(a, b interface{}) bool {
+	x, y := reflect.ValueOf(a), reflect.ValueOf(b)
+	if xi, ok := intValue(x); ok {
+		if yi, ok := intValue(y); ok {
+			return xi == yi
+		}
+	}
+	if xf, ok := floatValue(x); ok {
+		yf, ok := floatValue(y)
+		return ok && xf == yf
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+func intValue(v reflect.Value) (int64, bool) {
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int(), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if v.Uint() > math.MaxInt64 {
+			return 0, false
+		}
+		return int64(v.Uint()), true
+	}
+	return 0, false
+}
+
+func floatValue(v reflect.Value) (float64, bool) {
+	if i, ok := intValue(v); ok {
+		return float64(i), true
+	}
+	switch v.Kind() {
+	case reflect.Uint, reflect.Uint64:
+		return float64(v.Uint()), true
+	case reflect.Float32, reflect.Float64:
+		return v.Float(), true
+	}
+	return 0, false
+}
+
+// join concatenates the elements of a list with the separator, elements are
+// formatted as with Printf "%v", it's empty if the list is not a slice or an
+// array
+func join(list interface{}, separator string) string {
+	l := reflect.ValueOf(list)
+	if l.Kind() != reflect.Slice && l.Kind() != reflect.Array {
+		return ""
+	}
+	elements := make([]string, l.Len())
+	for i := range elements {
+		elements[i] = fmt.Sprintf("%v", l.Index(i).Interface())
+	}
+	return strings.Join(elements, separator)
+}
+
+// slug converts a string to a lowercase identifier that only contains ASCII
+// alphanumeric characters and dashes
+func slug(s string) string {
+	var b bytes.Buffer
+	dash := false
+	for _, r := range strings.ToLower(s) {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			if dash && b.Len() > 0 {
+				b.WriteRune('-')
+			}
+			b.WriteRune(r)
+			dash = false
+			continue
+		}
+		dash = true
+	}
+	return b.String()
+}
+
+// serverLines generates a server line for each endpoint of the service, with
+// the additional options, endpoints not ready are added as disabled, and
+// draining endpoints with weight 0. Lines can include a comment with the node
+// of the endpoint.
+func serverLines(s ServiceInformation, options ...string) []string {
+	var lines []string
+	for _, endpoints := range [][]ServiceEndpoint{s.Endpoints, s.NotReady} {
+		for _, e := range endpoints {
+			fields := []string{"server", e.ServerName(), net.JoinHostPort(e.IP, strconv.Itoa(int(e.Port)))}
+			fields = append(fields, options...)
+			if !e.Ready {
+				fields = append(fields, "disabled")
+			} else if e.Draining {
+				fields = append(fields, "weight", "0")
+			}
+			if serverLinesNodeComments && e.NodeName != "" {
+				fields = append(fields, "#", "node="+e.NodeName)
+			}
+			lines = append(lines, strings.Join(fields, " "))
+		}
+	}
+	return lines
+}
+
+var timeLayouts = map[string]string{
+	"ANSIC":       time.ANSIC,
+	"UnixDate":    time.UnixDate,
+	"RubyDate":    time.RubyDate,
+	"RFC822":      time.RFC822,
+	"RFC822Z":     time.RFC822Z,
+	"RFC850":      time.RFC850,
+	"RFC1123":     time.RFC1123,
+	"RFC1123Z":    time.RFC1123Z,
+	"RFC3339":     time.RFC3339,
+	"RFC3339Nano": time.RFC3339Nano,
+	"Kitchen":     time.Kitchen,
+}
+
+// Replaced in tests
+var timeNow = time.Now
+
+// now formats current time with the given format, or with the default one
+// if none is passed, formats can be time layouts or names of standard ones
+func now(format ...string) string {
+	layout := nowFormat
+	if len(format) > 0 {
+		layout = format[0]
+	}
+	if named, found := timeLayouts[layout]; found {
+		layout = named
+	}
+	t := timeNow()
+	if nowUTC {
+		t = t.UTC()
+	}
+	return t.Format(layout)
+}
+
+// annotation returns the value of an annotation of the service, or the
+// default value if it is not set
+func annotation(s ServiceInformation, key, def string) string {
+	if value, found := s.Annotations[key]; found {
+		return value
+	}
+	return def
+}
+
+// serviceIndex returns the position of the service in the list, sorted by
+// its string representation so it doesn't depend on the order of the list,
+// or -1 if the service is not in the list
+func serviceIndex(s ServiceInformation, services []ServiceInformation) int {
+	labels := make([]string, 0, len(services))
+	seen := make(map[string]bool)
+	for _, service := range services {
+		label := service.String()
+		if !seen[label] {
+			seen[label] = true
+			labels = append(labels, label)
+		}
+	}
+	sort.Strings(labels)
+	label := s.String()
+	i := sort.SearchStrings(labels, label)
+	if i == len(labels) || labels[i] != label {
+		return -1
+	}
+	return i
+}
+
+var customTemplateFuncs = struct {
+	sync.RWMutex
+	funcs template.FuncMap
+}{funcs: make(template.FuncMap)}
+
+// RegisterTemplateFunc adds a function to the ones available in configuration
+// templates, it can replace built-in functions. It panics if fn is not a
+// function valid for templates.
+func RegisterTemplateFunc(name string, fn interface{}) {
+	// Validates the function as text/template does
+	template.New(name).Funcs(template.FuncMap{name: fn})
+
+	customTemplateFuncs.Lock()
+	defer customTemplateFuncs.Unlock()
+	customTemplateFuncs.funcs[name] = fn
+}
+
+// renderTemplate executes the source template, with optional partials, and
+// returns the generated content
+func renderTemplate(source, partials string, info *ClusterInformation) ([]byte, error) {
+	// Server names can use information of the whole cluster
+	serverNames := func(s ServiceInformation, domain string) ([]serverName, error) {
+		return generateServerNames(s, serverNameDomains(info, domain), info.Nodes)
+	}
+	mapEntries := func(domain string, ports ...PortSpec) ([]MapEntry, error) {
+		return mapEntries(info, domain, ports...)
+	}
+	weightedServerNames := func(domain string, ports ...PortSpec) ([]WeightedServerName, error) {
+		return weightedServerNames(info, domain, ports...)
+	}
 	funcMap := template.FuncMap{
-		"EscapeNode":  nodeNameReplacer.Replace,
-		"IntRange":    intRange,
-		"ServerNames": generateServerNames,
-		"ToLower":     strings.ToLower,
-		"ToUpper":     strings.ToUpper,
-		"Add":         opAdd,
+		"EscapeNode":    nodeNameReplacer.Replace,
+		"IntRange":      intRange,
+		"ServerNames":   serverNames,
+		"ToLower":       strings.ToLower,
+		"ToUpper":       strings.ToUpper,
+		"Add":           opAdd,
+		"InCIDR":        inCIDR,
+		"First":         first,
+		"Last":          last,
+		"Coalesce":      coalesce,
+		"List":          list,
+		"In":            in,
+		"Join":          join,
+		"Printf":        fmt.Sprintf,
+		"Slug":          slug,
+		"Now":           now,
+		"Annotation":    annotation,
+		"ServerLines":   serverLines,
+		"FrontendName":  frontendName,
+		"HAProxyEscape": haproxyEscape,
+		"MapEntries":    mapEntries,
+		"Weighted":      weightedServerNames,
+		"Index":         serviceIndex,
 	}
+	customTemplateFuncs.RLock()
+	for name, fn := range customTemplateFuncs.funcs {
+		funcMap[name] = fn
+	}
+	customTemplateFuncs.RUnlock()
 
-	// template.Execute will use the base name of t.Source
-	s, err := template.New(path.Base(t.Source)).Funcs(funcMap).ParseFiles(t.Source)
+	if err := checkPortLabelCollisions(info.Services, PortSpec.String); err != nil {
+		return nil, err
+	}
+	if err := checkServerNameCollisions(info); err != nil {
+		return nil, err
+	}
+
+	// template.Execute will use the base name of source
+	s, err := template.New(path.Base(source)).Delims(templateLeftDelim, templateRightDelim).Funcs(funcMap).ParseFiles(source)
 	if err != nil {
+		return nil, err
+	}
+	if partials != "" {
+		partialFiles, err := filepath.Glob(filepath.Join(partials, "*.tmpl"))
+		if err != nil {
+			return nil, err
+		}
+		if len(partialFiles) > 0 {
+			if s, err = s.ParseFiles(partialFiles...); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	var b bytes.Buffer
+	if err = executeWithTimeout(s, &b, info, renderTimeout); err != nil {
+		if err == errRenderTimeout {
+			// Executing the template for each service could take even longer
+			return nil, fmt.Errorf("couldn't execute template in %s", renderTimeout)
+		}
+		log.Printf("Couldn't execute template, looking for failing services: %s", err)
+		b.Reset()
+		isolated := isolateFailingServices(s, info)
+		if len(isolated.Services) == 0 && len(info.Services) > 0 {
+			// Failure is not caused by specific services
+			return nil, err
+		}
+		if err = executeWithTimeout(s, &b, isolated, renderTimeout); err != nil {
+			return nil, err
+		}
+	}
+	return b.Bytes(), nil
+}
+
+var errRenderTimeout = fmt.Errorf("template execution timed out")
+
+// timeoutWriter fails writes once its context is done, so executions
+// producing output stop as soon as possible
+type timeoutWriter struct {
+	ctx context.Context
+	w   io.Writer
+}
+
+func (w *timeoutWriter) Write(p []byte) (int, error) {
+	if err := w.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return w.w.Write(p)
+}
+
+// executeWithTimeout executes the template into w, it returns
+// errRenderTimeout if execution takes longer than timeout, 0 for no timeout.
+// Templates cannot be interrupted, so on timeout executions keep running in
+// background, and nothing is written.
+func executeWithTimeout(s *template.Template, w io.Writer, data interface{}, timeout time.Duration) error {
+	if timeout <= 0 {
+		return s.Execute(w, data)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var b bytes.Buffer
+	done := make(chan error, 1)
+	go func() {
+		done <- s.Execute(&timeoutWriter{ctx, &b}, data)
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil && ctx.Err() != nil {
+			return errRenderTimeout
+		}
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(b.Bytes())
 		return err
+	case <-ctx.Done():
+		return errRenderTimeout
 	}
-	f, err := os.OpenFile(t.Path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+}
+
+func (t *templateFile) Execute(info *ClusterInformation) (bool, error) {
+	content, err := renderTemplate(t.Source, t.Partials, info)
 	if err != nil {
+		return false, err
+	}
+	t.size = len(content)
+	previous, readErr := ioutil.ReadFile(t.Path)
+	if readErr != nil {
+		previous = nil
+	}
+	changed, err := writeConfigFile(t.Path, content)
+	t.changed, t.previous = changed, previous
+	return changed, err
+}
+
+func (t *templateFile) renderedSize() (string, int) {
+	return t.Path, t.size
+}
+
+// Rollback restores the content the file had before the last execution, if
+// it was changed
+func (t *templateFile) Rollback() error {
+	if !t.changed {
+		return nil
+	}
+	if t.previous == nil {
+		return fmt.Errorf("no previous configuration for %s", t.Path)
+	}
+	if err := ioutil.WriteFile(t.Path, t.previous, 0644); err != nil {
 		return err
 	}
-	defer f.Close()
+	t.changed, t.previous = false, nil
+	return nil
+}
+
+// writeConfigFile writes the content into path, it returns true if the
+// content has changed
+func writeConfigFile(path string, content []byte) (bool, error) {
+	if current, err := ioutil.ReadFile(path); err == nil && equalConfigs(current, content) {
+		return false, nil
+	}
+
+	if err := checkConfigSize(path, content); err != nil {
+		return false, err
+	}
+	if err := writeFileAtomic(path, content, 0644); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// renameFile is replaced in tests
+var renameFile = os.Rename
+
+// writeFileAtomic writes the data into a temporary file in the same directory
+// and renames it, so readers never see partially written files. Existing files
+// keep their mode and, if possible, their owner. If the file cannot be
+// replaced, as with single-file bind mounts, it is written in place.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	info, statErr := os.Stat(path)
+	if statErr == nil {
+		perm = info.Mode().Perm()
+	}
 
-	if err = s.Execute(f, info); err != nil {
+	f, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
 		return err
 	}
+	if err := os.Chmod(f.Name(), perm); err != nil {
+		return err
+	}
+	if statErr == nil {
+		if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+			// Only possible with enough privileges
+			os.Chown(f.Name(), int(stat.Uid), int(stat.Gid))
+		}
+	}
+	if err := renameFile(f.Name(), path); err != nil {
+		log.Printf("Couldn't replace %s (%s), writing it in place", path, err)
+		return ioutil.WriteFile(path, data, perm)
+	}
 	return nil
 }
+
+// isolateFailingServices returns a copy of the cluster information without
+// the services that make the template fail when executed on their own
+func isolateFailingServices(s *template.Template, info *ClusterInformation) *ClusterInformation {
+	services := make([]ServiceInformation, 0, len(info.Services))
+	for _, service := range info.Services {
+		serviceInfo := *info
+		serviceInfo.Services = []ServiceInformation{service}
+		serviceInfo.Ports = servicesPorts(serviceInfo.Services)
+		if err := executeWithTimeout(s, ioutil.Discard, &serviceInfo, renderTimeout); err != nil {
+			log.Printf("Skipping service %s in %s, template execution failed: %s", service.Name, service.Namespace, err)
+			continue
+		}
+		services = append(services, service)
+	}
+
+	isolated := *info
+	isolated.Services = services
+	isolated.Ports = servicesPorts(services)
+	return &isolated
+}
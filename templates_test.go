@@ -0,0 +1,1448 @@
+/*
+Copyright 2017 Tuenti Technologies S.L. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"text/template"
+	"time"
+)
+
+var inCIDRCases = []struct {
+	IP       string
+	CIDR     string
+	Expected bool
+}{
+	{"10.0.0.1", "10.0.0.0/8", true},
+	{"10.255.255.255", "10.0.0.0/8", true},
+	{"192.168.1.1", "10.0.0.0/8", false},
+	{"2001:db8::1", "2001:db8::/32", true},
+	{"2001:db9::1", "2001:db8::/32", false},
+	{"10.0.0.1", "10.0.0.0", false},
+	{"10.0.0.1", "", false},
+	{"notanip", "10.0.0.0/8", false},
+	{"", "10.0.0.0/8", false},
+}
+
+func TestInCIDR(t *testing.T) {
+	for _, c := range inCIDRCases {
+		if r := inCIDR(c.IP, c.CIDR); r != c.Expected {
+			t.Errorf("InCIDR(%q, %q) = %v, expected %v", c.IP, c.CIDR, r, c.Expected)
+		}
+	}
+}
+
+func executeTestTemplate(t *testing.T, source string, info *ClusterInformation) (string, error) {
+	dir, err := ioutil.TempDir("", "kube2lb-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sourcePath := path.Join(dir, "test.tpl")
+	configPath := path.Join(dir, "test.cfg")
+	if err := ioutil.WriteFile(sourcePath, []byte(source), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := NewTemplate(sourcePath, configPath, "").Execute(info); err != nil {
+		return "", err
+	}
+
+	config, err := ioutil.ReadFile(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(config), nil
+}
+
+func TestTemplateFailingServicesIsolation(t *testing.T) {
+	source := "{{ range .Services }}{{ .Name }} {{ index .External 0 }}\n{{ end }}"
+	info := &ClusterInformation{
+		Services: []ServiceInformation{
+			{Name: "service1", External: []string{"service1.example.com"}},
+			{Name: "service2"},
+			{Name: "service3", External: []string{"service3.example.com"}},
+		},
+	}
+
+	config, err := executeTestTemplate(t, source, info)
+	if err != nil {
+		t.Fatalf("Template execution failed: %s", err)
+	}
+	expected := "service1 service1.example.com\nservice3 service3.example.com\n"
+	if config != expected {
+		t.Fatalf("Unexpected configuration: %q, expected: %q", config, expected)
+	}
+	if len(info.Services) != 3 {
+		t.Fatalf("Original cluster information shouldn't be modified")
+	}
+}
+
+func TestTemplateFailingNotIsolated(t *testing.T) {
+	source := "{{ range .Services }}{{ .Name }}\n{{ end }}{{ index .Nodes 0 }}"
+	info := &ClusterInformation{
+		Services: []ServiceInformation{{Name: "service1"}},
+	}
+
+	if _, err := executeTestTemplate(t, source, info); err == nil {
+		t.Fatalf("Template execution should fail if errors are not caused by services")
+	}
+}
+
+func TestFirstAndLast(t *testing.T) {
+	endpoints := []ServiceEndpoint{{Name: "a"}, {Name: "b"}, {Name: "c"}}
+	cases := []struct {
+		Items interface{}
+		First interface{}
+		Last  interface{}
+	}{
+		{endpoints, endpoints[0], endpoints[2]},
+		{endpoints[:1], endpoints[0], endpoints[0]},
+		{[]ServiceEndpoint{}, ServiceEndpoint{}, ServiceEndpoint{}},
+		{[]string(nil), "", ""},
+		{[2]int{4, 2}, 4, 2},
+	}
+
+	for _, c := range cases {
+		if r, err := first(c.Items); err != nil || r != c.First {
+			t.Errorf("First(%v) = %v (error: %v), expected %v", c.Items, r, err, c.First)
+		}
+		if r, err := last(c.Items); err != nil || r != c.Last {
+			t.Errorf("Last(%v) = %v (error: %v), expected %v", c.Items, r, err, c.Last)
+		}
+	}
+
+	if _, err := first("foo"); err == nil {
+		t.Errorf("First should fail with values that are not slices")
+	}
+	if _, err := last(nil); err == nil {
+		t.Errorf("Last should fail with values that are not slices")
+	}
+}
+
+func TestCoalesce(t *testing.T) {
+	cases := []struct {
+		Values   []interface{}
+		Expected interface{}
+	}{
+		{nil, nil},
+		{[]interface{}{""}, ""},
+		{[]interface{}{"", "", ""}, ""},
+		{[]interface{}{0, 0}, 0},
+		{[]interface{}{"", "default"}, "default"},
+		{[]interface{}{"value", "default"}, "value"},
+		{[]interface{}{"", "", "fallback"}, "fallback"},
+		{[]interface{}{0, 8080}, 8080},
+		{[]interface{}{nil, []string{}, "x"}, "x"},
+		{[]interface{}{false, true}, true},
+	}
+
+	for _, c := range cases {
+		if r := coalesce(c.Values...); !reflect.DeepEqual(r, c.Expected) {
+			t.Errorf("Coalesce(%v) = %v, expected %v", c.Values, r, c.Expected)
+		}
+	}
+
+	info := &ClusterInformation{
+		Services: []ServiceInformation{
+			{Name: "service1", Annotations: map[string]string{"balance": "leastconn"}},
+			{Name: "service2", Balance: "source"},
+			{Name: "service3"},
+		},
+	}
+	content, err := executeTestTemplate(t, `{{ range .Services }}{{ Coalesce (Annotation . "balance" "") .Balance "roundrobin" }} {{ end }}`, info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "leastconn source roundrobin "; content != expected {
+		t.Errorf("Expected %q, found %q", expected, content)
+	}
+}
+
+func TestListAndIn(t *testing.T) {
+	cases := []struct {
+		Value    interface{}
+		List     interface{}
+		Expected bool
+	}{
+		{"web", list("web", "api"), true},
+		{"admin", list("web", "api"), false},
+		{"web", list(), false},
+		{"web", []string{"api", "web"}, true},
+		{8080, list(80, 8080), true},
+		{int32(443), list(80, 443), true},
+		{int32(8080), list(80, 443), false},
+		{443, []int32{80, 443}, true},
+		{80.0, list(80), true},
+		{"80", list(80), false},
+		{"web", "web", false},
+		{"web", nil, false},
+	}
+
+	for _, c := range cases {
+		if r := in(c.Value, c.List); r != c.Expected {
+			t.Errorf("In(%v, %v) = %v, expected %v", c.Value, c.List, r, c.Expected)
+		}
+	}
+
+	info := &ClusterInformation{
+		Services: []ServiceInformation{{Name: "web"}, {Name: "admin"}, {Name: "api"}},
+	}
+	content, err := executeTestTemplate(t, `{{ range .Services }}{{ if In .Name (List "web" "api") }}{{ .Name }} {{ end }}{{ end }}`, info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if content != "web api " {
+		t.Errorf("Unexpected content: %q", content)
+	}
+
+	info = &ClusterInformation{
+		Services: []ServiceInformation{
+			{Name: "web", Port: PortSpec{Port: 443}},
+			{Name: "admin", Port: PortSpec{Port: 9000}},
+		},
+	}
+	content, err = executeTestTemplate(t, `{{ range .Services }}{{ if In .Port.Port (List 80 443) }}{{ .Name }}{{ end }}{{ end }}`, info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if content != "web" {
+		t.Errorf("Ports should be found in lists of integers, found: %q", content)
+	}
+}
+
+func TestJoin(t *testing.T) {
+	cases := []struct {
+		List     interface{}
+		Expected string
+	}{
+		{list("h2", "http/1.1"), "h2,http/1.1"},
+		{list(), ""},
+		{list("web", 80, true), "web,80,true"},
+		{[]string{"example.com", "example.org"}, "example.com,example.org"},
+		{"h2", ""},
+		{nil, ""},
+	}
+
+	for _, c := range cases {
+		if r := join(c.List, ","); r != c.Expected {
+			t.Errorf("Join(%v) = %q, expected %q", c.List, r, c.Expected)
+		}
+	}
+
+	info := &ClusterInformation{Domains: []string{"example.com", "example.org"}}
+	content, err := executeTestTemplate(t, `{{ Join (List "h2" "http/1.1") "," }} {{ Join .Domains " " }}`, info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if content != "h2,http/1.1 example.com example.org" {
+		t.Errorf("Unexpected content: %q", content)
+	}
+}
+
+func TestPrintf(t *testing.T) {
+	info := &ClusterInformation{
+		Services: []ServiceInformation{
+			{Name: "service1", Namespace: "test", Port: PortSpec{Port: 80}, Timeout: 1500},
+			{Name: "longer-service", Namespace: "test", Port: PortSpec{Port: 8080}},
+		},
+	}
+	cases := []struct {
+		Source   string
+		Expected string
+	}{
+		{`{{ range .Services }}{{ Printf "%-16s|" .Name }}{{ end }}`, "service1        |longer-service  |"},
+		{`{{ range .Services }}{{ Printf "%6d|" .Port.Port }}{{ end }}`, "    80|  8080|"},
+		{`{{ range .Services }}{{ Printf "%05d " .Timeout }}{{ end }}`, "01500 00000 "},
+		{`{{ range .Services }}{{ Printf "%s/%s:%v " .Namespace .Name .Port.Port }}{{ end }}`, "test/service1:80 test/longer-service:8080 "},
+		{`{{ Printf "%x %q %.2f" 255 "a" 1.5 }}`, `ff "a" 1.50`},
+	}
+	for _, c := range cases {
+		content, err := executeTestTemplate(t, c.Source, info)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if content != c.Expected {
+			t.Errorf("Template %s: %q, expected %q", c.Source, content, c.Expected)
+		}
+	}
+}
+
+var slugCases = []struct {
+	Name     string
+	Expected string
+}{
+	{"service1", "service1"},
+	{"My.Service_Name", "my-service-name"},
+	{"--foo--bar--", "foo-bar"},
+	{"foo!@#$%^&*()bar", "foo-bar"},
+	{"  spaced out  ", "spaced-out"},
+	{"ñandú-café", "and-caf"},
+	{"服务", ""},
+	{"", ""},
+}
+
+func TestSlug(t *testing.T) {
+	for _, c := range slugCases {
+		if r := slug(c.Name); r != c.Expected {
+			t.Errorf("Slug(%q) = %q, expected %q", c.Name, r, c.Expected)
+		}
+	}
+}
+
+func TestTemplatePartials(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kube2lb-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	partialsDir := path.Join(dir, "partials")
+	if err := os.Mkdir(partialsDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		path.Join(dir, "main.tpl"):             `{{ range .Services }}{{ template "backend" . }}{{ end }}`,
+		path.Join(partialsDir, "backend.tmpl"): `{{ define "backend" }}backend {{ .Name | ToUpper }}{{ template "servers" . }}{{ end }}`,
+		path.Join(partialsDir, "servers.tmpl"): `{{ define "servers" }}{{ range .Endpoints }} {{ .IP }}{{ end }}` + "\n" + `{{ end }}`,
+		path.Join(partialsDir, "ignored.txt"):  `{{ define "servers" }}ignored{{ end }}`,
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(name, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	info := &ClusterInformation{
+		Services: []ServiceInformation{
+			{Name: "service1", Endpoints: []ServiceEndpoint{{IP: "10.0.0.1"}, {IP: "10.0.0.2"}}},
+			{Name: "service2", Endpoints: []ServiceEndpoint{{IP: "10.0.0.3"}}},
+		},
+	}
+	configPath := path.Join(dir, "test.cfg")
+	if _, err := NewTemplate(path.Join(dir, "main.tpl"), configPath, partialsDir).Execute(info); err != nil {
+		t.Fatalf("Template execution failed: %s", err)
+	}
+
+	config, err := ioutil.ReadFile(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "backend SERVICE1 10.0.0.1 10.0.0.2\nbackend SERVICE2 10.0.0.3\n"
+	if string(config) != expected {
+		t.Fatalf("Unexpected configuration: %q, expected: %q", config, expected)
+	}
+
+	// Partials are not found in other directories
+	if _, err := NewTemplate(path.Join(dir, "main.tpl"), configPath, dir).Execute(info); err == nil {
+		t.Fatalf("Template execution should fail if partials are not found")
+	}
+}
+
+func TestNow(t *testing.T) {
+	defer func(f func() time.Time) { timeNow = f }(timeNow)
+	defer func(format string, utc bool) { nowFormat, nowUTC = format, utc }(nowFormat, nowUTC)
+
+	zone := time.FixedZone("TEST", 2*3600)
+	timeNow = func() time.Time {
+		return time.Date(2017, 3, 14, 15, 9, 26, 0, zone)
+	}
+
+	cases := []struct {
+		DefaultFormat string
+		UTC           bool
+		Format        []string
+		Expected      string
+	}{
+		{"RFC3339", false, nil, "2017-03-14T15:09:26+02:00"},
+		{"RFC3339", true, nil, "2017-03-14T13:09:26Z"},
+		{"2006-01-02", false, nil, "2017-03-14"},
+		{"RFC3339", false, []string{"RFC1123"}, "Tue, 14 Mar 2017 15:09:26 TEST"},
+		{"RFC3339", true, []string{"RFC1123"}, "Tue, 14 Mar 2017 13:09:26 UTC"},
+		{"RFC3339", false, []string{"15:04"}, "15:09"},
+	}
+
+	for _, c := range cases {
+		nowFormat, nowUTC = c.DefaultFormat, c.UTC
+		if r := now(c.Format...); r != c.Expected {
+			t.Errorf("Now(%v) with default format %q (UTC: %v) = %q, expected %q", c.Format, c.DefaultFormat, c.UTC, r, c.Expected)
+		}
+	}
+}
+
+func TestTemplateChanges(t *testing.T) {
+	defer func(f func() time.Time) { timeNow = f }(timeNow)
+
+	dir, err := ioutil.TempDir("", "kube2lb-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	source := `# kube2lb:ignore-changes-begin
+# Generated at {{ Now }}
+# kube2lb:ignore-changes-end
+{{ range .Services }}{{ .Name }}
+{{ end }}`
+	sourcePath := path.Join(dir, "test.tpl")
+	configPath := path.Join(dir, "test.cfg")
+	if err := ioutil.WriteFile(sourcePath, []byte(source), 0644); err != nil {
+		t.Fatal(err)
+	}
+	template := NewTemplate(sourcePath, configPath, "")
+	info := &ClusterInformation{Services: []ServiceInformation{{Name: "service1"}}}
+
+	timeNow = func() time.Time { return time.Unix(0, 0) }
+	if changed, err := template.Execute(info); err != nil || !changed {
+		t.Fatalf("First execution should change configuration (changed: %v, error: %v)", changed, err)
+	}
+
+	timeNow = func() time.Time { return time.Unix(3600, 0) }
+	if changed, err := template.Execute(info); err != nil || changed {
+		t.Fatalf("Changes in ignored regions shouldn't be considered (changed: %v, error: %v)", changed, err)
+	}
+
+	info.Services = append(info.Services, ServiceInformation{Name: "service2"})
+	if changed, err := template.Execute(info); err != nil || !changed {
+		t.Fatalf("Changes out of ignored regions should be considered (changed: %v, error: %v)", changed, err)
+	}
+	config, _ := ioutil.ReadFile(configPath)
+	if !strings.Contains(string(config), time.Unix(3600, 0).Format(time.RFC3339)) {
+		t.Fatalf("Configuration should be written with latest timestamp when changed: %s", config)
+	}
+}
+
+func TestMaxConfigSize(t *testing.T) {
+	defer func(size int) { maxConfigSize = size }(maxConfigSize)
+
+	dir, err := ioutil.TempDir("", "kube2lb-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sourcePath := path.Join(dir, "test.tpl")
+	configPath := path.Join(dir, "test.cfg")
+	if err := ioutil.WriteFile(sourcePath, []byte("{{ range .Services }}{{ .Name }}\n{{ end }}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	template := NewTemplate(sourcePath, configPath, "")
+	client := newFakeConfigMapClient()
+	configMapTemplate := NewConfigMapTemplate(client, sourcePath, "", "lb", "haproxy.cfg")
+
+	maxConfigSize = len("service1\nservice2\n")
+	info := &ClusterInformation{Services: []ServiceInformation{{Name: "service1"}, {Name: "service2"}}}
+	for _, template := range []Template{template, configMapTemplate} {
+		if changed, err := template.Execute(info); err != nil || !changed {
+			t.Fatalf("Configuration under the limit should be written (changed: %v, error: %v)", changed, err)
+		}
+	}
+
+	overflows := configSizeOverflows.Value()
+	info.Services = append(info.Services, ServiceInformation{Name: "service3"})
+	for _, template := range []Template{template, configMapTemplate} {
+		if changed, err := template.Execute(info); err == nil || changed {
+			t.Fatalf("Configuration over the limit shouldn't be written (changed: %v, error: %v)", changed, err)
+		}
+	}
+	if config, _ := ioutil.ReadFile(configPath); string(config) != "service1\nservice2\n" {
+		t.Errorf("Current configuration should be kept, found: %q", config)
+	}
+	if config := client.configMaps["lb"].Data["haproxy.cfg"]; config != "service1\nservice2\n" {
+		t.Errorf("Current config map should be kept, found: %q", config)
+	}
+	if found := configSizeOverflows.Value() - overflows; found != 2 {
+		t.Errorf("Expected 2 overflows, found %d", found)
+	}
+}
+
+func TestRenderTimeout(t *testing.T) {
+	defer func(timeout time.Duration) { renderTimeout = timeout }(renderTimeout)
+	renderTimeout = 50 * time.Millisecond
+
+	unblock := make(chan struct{})
+	defer close(unblock)
+	defer func() { delete(customTemplateFuncs.funcs, "Block") }()
+	RegisterTemplateFunc("Block", func() string {
+		<-unblock
+		return ""
+	})
+
+	dir, err := ioutil.TempDir("", "kube2lb-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sourcePath := path.Join(dir, "test.tpl")
+	configPath := path.Join(dir, "test.cfg")
+	source := `{{ range .Services }}{{ if eq .Name "slow" }}{{ Block }}{{ end }}{{ .Name }}` + "\n{{ end }}"
+	if err := ioutil.WriteFile(sourcePath, []byte(source), 0644); err != nil {
+		t.Fatal(err)
+	}
+	template := NewTemplate(sourcePath, configPath, "")
+
+	info := &ClusterInformation{Services: []ServiceInformation{{Name: "service1"}}}
+	if _, err := template.Execute(info); err != nil {
+		t.Fatalf("Template execution failed: %s", err)
+	}
+
+	info.Services = append(info.Services, ServiceInformation{Name: "slow"})
+	start := time.Now()
+	if changed, err := template.Execute(info); err == nil || changed {
+		t.Fatalf("Slow template execution should fail (changed: %v, error: %v)", changed, err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Slow template execution should be aborted after %s, it took %s", renderTimeout, elapsed)
+	}
+	if config, _ := ioutil.ReadFile(configPath); string(config) != "service1\n" {
+		t.Errorf("Current configuration should be kept, found: %q", config)
+	}
+
+	// Output of slow templates is not written
+	source = `{{ range IntRange 100000000 0 1 }}{{ . }}{{ end }}`
+	if err := ioutil.WriteFile(sourcePath, []byte(source), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := template.Execute(info); err == nil {
+		t.Fatal("Slow template execution should fail")
+	}
+	if config, _ := ioutil.ReadFile(configPath); string(config) != "service1\n" {
+		t.Errorf("Current configuration should be kept, found: %q", config)
+	}
+}
+
+func TestEqualConfigs(t *testing.T) {
+	cases := []struct {
+		A, B  string
+		Equal bool
+	}{
+		{"a\nb\n", "a\nb\n", true},
+		{"a\nb\n", "a\nc\n", false},
+		{"a\n# kube2lb:ignore-changes-begin\nfoo\n# kube2lb:ignore-changes-end\nb\n", "a\n# kube2lb:ignore-changes-begin\nbar\nbaz\n# kube2lb:ignore-changes-end\nb\n", true},
+		{"a\n# kube2lb:ignore-changes-begin\nfoo\n# kube2lb:ignore-changes-end\nb\n", "a\n# kube2lb:ignore-changes-begin\nfoo\n# kube2lb:ignore-changes-end\nc\n", false},
+		{"a\n# kube2lb:ignore-changes-begin\nfoo\n", "a\n# kube2lb:ignore-changes-begin\nbar\n", true},
+		{"a\n", "# kube2lb:ignore-changes-begin\nfoo\n# kube2lb:ignore-changes-end\na\n", true},
+	}
+
+	for _, c := range cases {
+		if r := equalConfigs([]byte(c.A), []byte(c.B)); r != c.Equal {
+			t.Errorf("equalConfigs(%q, %q) = %v, expected %v", c.A, c.B, r, c.Equal)
+		}
+	}
+}
+
+func TestServerNamesContext(t *testing.T) {
+	defer func(templates []*template.Template) { serverNameTemplates = templates }(serverNameTemplates)
+
+	var err error
+	serverNameTemplates, err = parseServerNameTemplatesArg("{{ .Service.Name }}.{{ .Service.Namespace }}.svc.{{ .Domain }},{{ .Port.Protocol }}-{{ .Port.Port }}.{{ .Service.Name }}.{{ .Domain }},{{ len .Nodes }}-nodes.{{ .Domain }}")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	service := ServiceInformation{
+		Name:      "service1",
+		Namespace: "test",
+		Port:      PortSpec{Port: 8080, Protocol: "tcp"},
+	}
+	names, err := generateServerNames(service, []string{"cluster.local"}, []string{"node1", "node2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := make(map[serverName]bool)
+	for _, n := range names {
+		found[n] = true
+	}
+	for _, expected := range []serverName{"service1.test.svc.cluster.local", "tcp-8080.service1.cluster.local", "2-nodes.cluster.local"} {
+		if !found[expected] {
+			t.Errorf("server name %s expected in %v", expected, names)
+		}
+	}
+}
+
+func TestWildcardServerNames(t *testing.T) {
+	defer func(templates []*template.Template) { serverNameTemplates = templates }(serverNameTemplates)
+	defer func(wildcard bool) { wildcardServerNames = wildcard }(wildcardServerNames)
+
+	var err error
+	serverNameTemplates, err = parseServerNameTemplatesArg("{{ .Service.Name }}.{{ .Service.Namespace }}.svc.{{ .Domain }},*.{{ .Service.Namespace }}.svc.{{ .Domain }}")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		Wildcard bool
+		Expected []serverName
+	}{
+		{false, []serverName{"service1.test.svc.cluster.local", "*.test.svc.cluster.local"}},
+		{true, []serverName{"service1.test.svc.cluster.local", "*.service1.test.svc.cluster.local", "*.test.svc.cluster.local"}},
+	}
+
+	service := ServiceInformation{Name: "service1", Namespace: "test"}
+	for _, c := range cases {
+		wildcardServerNames = c.Wildcard
+		names, err := generateServerNames(service, []string{"cluster.local"}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(names) != len(c.Expected) {
+			t.Errorf("%d server names expected, found %v", len(c.Expected), names)
+		}
+		found := make(map[serverName]bool)
+		for _, n := range names {
+			found[n] = true
+			if n.IsRegexp() {
+				t.Errorf("server name %s shouldn't be a regexp", n)
+			}
+		}
+		for _, expected := range c.Expected {
+			if !found[expected] {
+				t.Errorf("server name %s expected in %v", expected, names)
+			}
+		}
+	}
+
+	n := serverName("*.test.svc.cluster.local")
+	if !n.IsWildcard() || n.Suffix() != ".test.svc.cluster.local" {
+		t.Errorf("%s should be a wildcard for .test.svc.cluster.local, found %s", n, n.Suffix())
+	}
+}
+
+func TestLowercaseServerNames(t *testing.T) {
+	defer func(templates []*template.Template) { serverNameTemplates = templates }(serverNameTemplates)
+	defer func(lowercase bool) { lowercaseServerNames = lowercase }(lowercaseServerNames)
+
+	var err error
+	serverNameTemplates, err = parseServerNameTemplatesArg("{{ .Service.Name }}.{{ .Service.Namespace }}.svc.{{ .Domain }}")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	service := ServiceInformation{
+		Name:      "MyService",
+		Namespace: "test",
+		External:  []string{"WWW.Example.com", "myservice.test.svc.cluster.local", `~^API\d+\.Example\.com$`},
+	}
+	cases := []struct {
+		Lowercase bool
+		Expected  []serverName
+	}{
+		{false, []serverName{"MyService.test.svc.Cluster.Local", "WWW.Example.com", "myservice.test.svc.cluster.local", `~^API\d+\.Example\.com$`}},
+		{true, []serverName{"myservice.test.svc.cluster.local", "www.example.com", `~^API\d+\.Example\.com$`}},
+	}
+	for _, c := range cases {
+		lowercaseServerNames = c.Lowercase
+		names, err := generateServerNames(service, []string{"Cluster.Local"}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sort.Slice(names, func(i, j int) bool { return names[i] < names[j] })
+		sort.Slice(c.Expected, func(i, j int) bool { return c.Expected[i] < c.Expected[j] })
+		if !reflect.DeepEqual(names, c.Expected) {
+			t.Errorf("Server names with lowercase %v: %v, expected %v", c.Lowercase, names, c.Expected)
+		}
+	}
+}
+
+func TestServerNameCollisions(t *testing.T) {
+	defer func(strict bool) { strictServerNames = strict }(strictServerNames)
+
+	source := "{{ range .Services }}{{ .Name }}\n{{ end }}"
+	info := &ClusterInformation{
+		Services: []ServiceInformation{
+			{Name: "service1", Namespace: "test", Port: PortSpec{Port: 80}, External: []string{"service1.example.com"}},
+			{Name: "service1", Namespace: "test", Port: PortSpec{Port: 443}, External: []string{"service1.example.com"}},
+			{Name: "service2", Namespace: "test", External: []string{"service2.example.com"}},
+		},
+	}
+
+	strictServerNames = true
+	if _, err := executeTestTemplate(t, source, info); err != nil {
+		t.Fatalf("Ports of the same service should be able to share server names: %s", err)
+	}
+	if v := serverNameCollisions.Value(); v != 0 {
+		t.Errorf("No collisions expected, found %d", v)
+	}
+
+	info.Services = append(info.Services, ServiceInformation{Name: "service3", Namespace: "other", External: []string{"service1.example.com"}})
+	strictServerNames = false
+	if _, err := executeTestTemplate(t, source, info); err != nil {
+		t.Fatalf("Collisions shouldn't fail without strict server names: %s", err)
+	}
+	if v := serverNameCollisions.Value(); v != 1 {
+		t.Errorf("One collision expected, found %d", v)
+	}
+
+	strictServerNames = true
+	_, err := executeTestTemplate(t, source, info)
+	if err == nil || !strings.Contains(err.Error(), "service1.example.com") {
+		t.Errorf("Collision on service1.example.com expected with strict server names, found: %v", err)
+	}
+}
+
+func TestPortLabelCollisions(t *testing.T) {
+	defer func(strict bool) { strictPortLabels = strict }(strictPortLabels)
+
+	services := []ServiceInformation{
+		{Name: "service1", Namespace: "test", Port: PortSpec{IP: net.ParseIP("10.0.0.1").To4(), Port: 80, Protocol: "tcp", Mode: "http"}},
+		{Name: "service2", Namespace: "test", Port: PortSpec{IP: net.ParseIP("10.0.0.1"), Port: 80, Protocol: "tcp", Mode: "http"}},
+		{Name: "service3", Namespace: "test", Port: PortSpec{IP: net.ParseIP("10.0.0.1"), Port: 80, Protocol: "tcp", Mode: "tcp"}},
+	}
+
+	strictPortLabels = true
+	if err := checkPortLabelCollisions(services, PortSpec.String); err != nil {
+		t.Fatalf("No collisions expected with different ports: %s", err)
+	}
+	if v := portLabelCollisions.Value(); v != 0 {
+		t.Errorf("No collisions expected, found %d", v)
+	}
+
+	// Labels without the mode make ports with different modes collide
+	withoutMode := func(p PortSpec) string {
+		return label(p.IP.String(), strconv.Itoa(int(p.Port)), p.Protocol)
+	}
+	strictPortLabels = false
+	if err := checkPortLabelCollisions(services, withoutMode); err != nil {
+		t.Fatalf("Collisions shouldn't fail without strict port labels: %s", err)
+	}
+	if v := portLabelCollisions.Value(); v != 1 {
+		t.Errorf("One collision expected, found %d", v)
+	}
+
+	strictPortLabels = true
+	if err := checkPortLabelCollisions(services, withoutMode); err == nil || !strings.Contains(err.Error(), withoutMode(services[0].Port)) {
+		t.Errorf("Collision expected with strict port labels, found: %v", err)
+	}
+
+	if _, err := executeTestTemplate(t, "{{ range .Ports }}{{ . }}\n{{ end }}", &ClusterInformation{Services: services}); err != nil {
+		t.Errorf("Template expected to be rendered without collisions: %s", err)
+	}
+}
+
+func TestAnnotation(t *testing.T) {
+	source := `{{ range .Services }}{{ Annotation . "example.com/weight" "1" }}{{ Annotation . "example.com/empty" "default" }}{{ "\n" }}{{ end }}`
+	info := &ClusterInformation{
+		Services: []ServiceInformation{
+			{Name: "service1", Annotations: map[string]string{"example.com/weight": "10", "example.com/empty": ""}},
+			{Name: "service2", Annotations: map[string]string{"example.com/other": "foo"}},
+			{Name: "service3"},
+		},
+	}
+
+	config, err := executeTestTemplate(t, source, info)
+	if err != nil {
+		t.Fatalf("Template execution failed: %s", err)
+	}
+	expected := "10\n1default\n1default\n"
+	if config != expected {
+		t.Fatalf("Unexpected configuration: %q, expected: %q", config, expected)
+	}
+}
+
+func TestServerLines(t *testing.T) {
+	source := `{{ range .Services }}{{ range ServerLines . "check" }}{{ . }}{{ "\n" }}{{ end }}{{ end }}`
+	info := &ClusterInformation{
+		Services: []ServiceInformation{
+			{
+				Name: "service1",
+				Endpoints: []ServiceEndpoint{
+					{Name: "service1-abc", IP: "10.0.0.1", Port: 8080, Ready: true},
+					{Name: "2001:db8::1", IP: "2001:db8::1", Port: 8080, Ready: true},
+					{Name: "service1-ghi", IP: "10.0.0.3", Port: 8080, Ready: true, Draining: true},
+				},
+				NotReady: []ServiceEndpoint{
+					{Name: "service1-def", IP: "10.0.0.2", Port: 8080, Ready: false},
+				},
+			},
+		},
+	}
+
+	config, err := executeTestTemplate(t, source, info)
+	if err != nil {
+		t.Fatalf("Template execution failed: %s", err)
+	}
+	expected := "server service1-abc 10.0.0.1:8080 check\n" +
+		"server 2001-0db8-0000-0000-0000-0000-0000-0001 [2001:db8::1]:8080 check\n" +
+		"server service1-ghi 10.0.0.3:8080 check weight 0\n" +
+		"server service1-def 10.0.0.2:8080 check disabled\n"
+	if config != expected {
+		t.Fatalf("Unexpected configuration: %q, expected: %q", config, expected)
+	}
+
+	if lines := serverLines(ServiceInformation{Name: "service2"}); len(lines) != 0 {
+		t.Errorf("No lines expected for services without endpoints, found %v", lines)
+	}
+}
+
+func TestServerNameFormat(t *testing.T) {
+	defer func(format string) { serverNameFormat = format }(serverNameFormat)
+
+	endpoints := []ServiceEndpoint{
+		{Name: "web-0", IP: "10.0.0.1", Port: 8080, Ready: true, Hostname: "web-0"},
+		{Name: "api-7d9f-x2x", IP: "2001:db8::1", Port: 8080, Ready: true},
+		{Name: "10.0.0.3", IP: "10.0.0.3", Port: 8443, Ready: true},
+	}
+	cases := []struct {
+		Format   string
+		Expected []string
+	}{
+		{ServerNameFormatName, []string{"web-0", "api-7d9f-x2x", "10-0-0-3"}},
+		{ServerNameFormatIP, []string{"10-0-0-1-8080", "2001-0db8-0000-0000-0000-0000-0000-0001-8080", "10-0-0-3-8443"}},
+		{ServerNameFormatHostname, []string{"web-0", "api-7d9f-x2x", "10-0-0-3"}},
+	}
+	for _, c := range cases {
+		serverNameFormat = c.Format
+		var names []string
+		for _, e := range endpoints {
+			names = append(names, e.ServerName())
+		}
+		if !reflect.DeepEqual(names, c.Expected) {
+			t.Errorf("Server names with format %s: %v, expected %v", c.Format, names, c.Expected)
+		}
+
+		// Names don't depend on the order of endpoints
+		reordered := []ServiceEndpoint{endpoints[2], endpoints[0], endpoints[1]}
+		lines := serverLines(ServiceInformation{Endpoints: reordered})
+		for i, e := range reordered {
+			if !strings.HasPrefix(lines[i], "server "+e.ServerName()+" ") {
+				t.Errorf("Server line %q should use the name %s", lines[i], e.ServerName())
+			}
+		}
+	}
+
+	serverNameFormat = "index"
+	service, endpointsObject := newTestService("service1", nil)
+	client := newTestStoresClient(service, endpointsObject)
+	if err := client.Update(context.Background()); err == nil {
+		t.Error("Update should fail with invalid server name format")
+	}
+}
+
+func TestUniqueServerNames(t *testing.T) {
+	defer func(format string) { serverNameFormat = format }(serverNameFormat)
+
+	// Compressed IPv6 addresses that would have the same slug
+	serverNameFormat = ServerNameFormatIP
+	a := ServiceEndpoint{Name: "fd00::1", IP: "fd00::1", Port: 80}
+	b := ServiceEndpoint{Name: "fd00:1::", IP: "fd00:1::", Port: 80}
+	if a.ServerName() == b.ServerName() {
+		t.Errorf("Different addresses have the same server name %s", a.ServerName())
+	}
+	serverNameFormat = ServerNameFormatName
+	if a.ServerName() == b.ServerName() {
+		t.Errorf("Endpoints named after different addresses have the same server name %s", a.ServerName())
+	}
+
+	// Pods with several addresses, and hostnames used by several pods
+	cases := []struct {
+		Format    string
+		Endpoints []ServiceEndpoint
+		NotReady  []ServiceEndpoint
+		Expected  []string
+	}{
+		{
+			ServerNameFormatName,
+			[]ServiceEndpoint{
+				{Name: "web-0", IP: "10.0.0.1", Port: 80},
+				{Name: "web-0", IP: "fd00::1", Port: 80},
+				{Name: "web-1", IP: "10.0.0.2", Port: 80},
+			},
+			nil,
+			[]string{"web-0-10-0-0-1-80", "web-0-fd00-0000-0000-0000-0000-0000-0000-0001-80", "web-1"},
+		},
+		{
+			ServerNameFormatHostname,
+			[]ServiceEndpoint{{Name: "web-0", Hostname: "web", IP: "10.0.0.1", Port: 80}},
+			[]ServiceEndpoint{{Name: "web-1", Hostname: "web", IP: "10.0.0.2", Port: 80}},
+			[]string{"web-10-0-0-1-80", "web-10-0-0-2-80"},
+		},
+	}
+	for _, c := range cases {
+		serverNameFormat = c.Format
+		uniqueServerNames(c.Endpoints, c.NotReady)
+		var names []string
+		for _, e := range append(c.Endpoints, c.NotReady...) {
+			names = append(names, e.ServerName())
+		}
+		if !reflect.DeepEqual(names, c.Expected) {
+			t.Errorf("Server names with format %s: %v, expected %v", c.Format, names, c.Expected)
+		}
+	}
+}
+
+func TestServerLinesNodeComments(t *testing.T) {
+	defer func(comments bool) { serverLinesNodeComments = comments }(serverLinesNodeComments)
+
+	service := ServiceInformation{
+		Name: "service1",
+		Endpoints: []ServiceEndpoint{
+			{Name: "service1-abc", IP: "10.0.0.1", Port: 8080, Ready: true, NodeName: "node-1"},
+			{Name: "service1-def", IP: "10.0.0.2", Port: 8080, Ready: true},
+		},
+		NotReady: []ServiceEndpoint{
+			{Name: "service1-ghi", IP: "10.0.0.3", Port: 8080, NodeName: "node-2.example.com"},
+		},
+	}
+
+	serverLinesNodeComments = false
+	if lines := serverLines(service, "check"); lines[0] != "server service1-abc 10.0.0.1:8080 check" {
+		t.Errorf("Node comments not expected by default, found %q", lines[0])
+	}
+
+	serverLinesNodeComments = true
+	expected := []string{
+		"server service1-abc 10.0.0.1:8080 check # node=node-1",
+		"server service1-def 10.0.0.2:8080 check",
+		"server service1-ghi 10.0.0.3:8080 check disabled # node=node-2.example.com",
+	}
+	if lines := serverLines(service, "check"); !reflect.DeepEqual(lines, expected) {
+		t.Errorf("Unexpected lines: %q, expected: %q", lines, expected)
+	}
+
+	info := &ClusterInformation{Services: []ServiceInformation{service}}
+	content, err := executeTestTemplate(t, `{{ range .Services }}{{ range .Endpoints }}{{ .IP }}={{ .NodeName }} {{ end }}{{ end }}`, info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if content != "10.0.0.1=node-1 10.0.0.2= " {
+		t.Errorf("Unexpected node names in template: %q", content)
+	}
+}
+
+func TestMultipleDomains(t *testing.T) {
+	defer func(templates []*template.Template) { serverNameTemplates = templates }(serverNameTemplates)
+
+	var err error
+	serverNameTemplates, err = parseServerNameTemplatesArg("{{ .Service.Name }}.{{ .Service.Namespace }}.svc.{{ .Domain }},{{ .Service.Name }}.{{ .Domain }}")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	source := "{{ $domain := .Domain }}{{ range .Services }}{{ range ServerNames . $domain }}{{ . }}\n{{ end }}{{ end }}"
+	info := &ClusterInformation{
+		Services: []ServiceInformation{{Name: "service1", Namespace: "test"}},
+		Domain:   "cluster.local",
+		Domains:  []string{"cluster.local", "example.com"},
+	}
+	config, err := executeTestTemplate(t, source, info)
+	if err != nil {
+		t.Fatalf("Template execution failed: %s", err)
+	}
+
+	expected := []string{
+		"service1.example.com",
+		"service1.cluster.local",
+		"service1.test.svc.cluster.local",
+		"service1.test.svc.example.com",
+	}
+	names := strings.Split(strings.TrimSpace(config), "\n")
+	sort.Strings(names)
+	sort.Strings(expected)
+	if strings.Join(names, ",") != strings.Join(expected, ",") {
+		t.Fatalf("Unexpected server names: %v, expected: %v", names, expected)
+	}
+}
+
+func TestLabelsWithUnderscores(t *testing.T) {
+	services := []ServiceInformation{
+		{Name: "a_b", Namespace: "c", Port: PortSpec{Port: 80, Protocol: "tcp", Mode: "http"}},
+		{Name: "a", Namespace: "b_c", Port: PortSpec{Port: 80, Protocol: "tcp", Mode: "http"}},
+		{Name: "a.u", Namespace: "c", Port: PortSpec{Port: 80, Protocol: "tcp", Mode: "http"}},
+		{Name: "a", Namespace: "b", Port: PortSpec{Port: 80, Protocol: "tcp", Mode: "http"}},
+		{Name: "a", Namespace: "b", Port: PortSpec{Port: 80, Protocol: "tcp_http", Mode: ""}},
+	}
+	seen := make(map[string]ServiceInformation)
+	for _, s := range services {
+		l := s.String()
+		if other, found := seen[l]; found {
+			t.Errorf("Services %+v and %+v have the same label %s", s, other, l)
+		}
+		seen[l] = s
+	}
+
+	if l := services[3].String(); l != "a_b_80_tcp_http" {
+		t.Errorf("Labels without underscores shouldn't be escaped, found %s", l)
+	}
+
+	ports := []PortSpec{
+		{IP: net.IPv4zero, Port: 80, Protocol: "tcp_http", Mode: ""},
+		{IP: net.IPv4zero, Port: 80, Protocol: "tcp", Mode: "http"},
+	}
+	if ports[0].String() == ports[1].String() {
+		t.Errorf("Ports %+v and %+v have the same label %s", ports[0], ports[1], ports[0].String())
+	}
+}
+
+func TestParsePortSpec(t *testing.T) {
+	specs := []PortSpec{
+		{IP: net.ParseIP("0.0.0.0"), Port: 80, Protocol: "tcp", Mode: "http"},
+		{IP: net.ParseIP("192.168.1.10"), Port: 443, Protocol: "tcp", Mode: "tcp"},
+		{IP: net.ParseIP("2001:db8::1"), Port: 8080, Protocol: "tcp", Mode: "http"},
+		{IP: net.ParseIP("::"), Port: 53, Protocol: "udp", Mode: "custom_mode.v2"},
+		{IP: net.ParseIP("0.0.0.0"), Port: 80, Protocol: "tcp", Mode: "http", Socket: "/var/run/haproxy/web_1.sock"},
+	}
+	for _, spec := range specs {
+		parsed, err := ParsePortSpec(spec.String())
+		if err != nil {
+			t.Errorf("Couldn't parse %s: %s", spec, err)
+			continue
+		}
+		if !equalPortSpecs(parsed, spec) {
+			t.Errorf("Parsed port spec %+v, expected %+v", parsed, spec)
+		}
+		if parsed.String() != spec.String() {
+			t.Errorf("Round trip label %s, expected %s", parsed, spec)
+		}
+	}
+
+	for _, label := range []string{"", "00000000_80_tcp", "zz_80_tcp_http", "000000_80_tcp_http", "00000000_http_tcp_http", "00000000_80_tcp_http_extra", "00000000_80_tcp_http_", "00000000_80_tcp_http_2f_extra"} {
+		if _, err := ParsePortSpec(label); err == nil {
+			t.Errorf("Parsing %q should fail", label)
+		}
+	}
+}
+
+func TestPortSpecAddress(t *testing.T) {
+	cases := []struct {
+		Port     PortSpec
+		Expected string
+	}{
+		{PortSpec{IP: net.ParseIP("0.0.0.0"), Port: 80}, "0.0.0.0:80"},
+		{PortSpec{IP: net.ParseIP("2001:db8::1"), Port: 443}, "[2001:db8::1]:443"},
+		{PortSpec{Port: 8080}, ":8080"},
+		{PortSpec{IP: net.ParseIP("0.0.0.0"), Port: 80, Socket: "/var/run/haproxy/web.sock"}, "/var/run/haproxy/web.sock"},
+	}
+	for _, c := range cases {
+		if address := c.Port.Address(); address != c.Expected {
+			t.Errorf("Address of %+v: %s, expected %s", c.Port, address, c.Expected)
+		}
+	}
+
+	tcp := PortSpec{IP: net.ParseIP("0.0.0.0"), Port: 80, Protocol: "tcp", Mode: "http"}
+	socket := tcp
+	socket.Socket = "/var/run/haproxy/web.sock"
+	if tcp.String() == socket.String() || equalPortSpecs(tcp, socket) {
+		t.Errorf("Socket bind %+v shouldn't be the same port as %+v", socket, tcp)
+	}
+
+	source := `{{ range .Ports }}bind {{ .Address }}{{ end }}`
+	output, err := executeTestTemplate(t, source, &ClusterInformation{Ports: []PortSpec{socket}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "bind /var/run/haproxy/web.sock"; output != expected {
+		t.Errorf("Found %q, expected %q", output, expected)
+	}
+}
+
+func TestFrontendName(t *testing.T) {
+	cases := []struct {
+		Port     PortSpec
+		Expected string
+	}{
+		{PortSpec{IP: net.ParseIP("0.0.0.0"), Port: 80, Protocol: "tcp", Mode: "http"}, "fe_00000000_80_tcp_http"},
+		{PortSpec{IP: net.ParseIP("10.0.0.1"), Port: 443, Protocol: "tcp", Mode: "tcp"}, "fe_0a000001_443_tcp_tcp"},
+		{PortSpec{IP: net.ParseIP("2001:db8::1"), Port: 80, Protocol: "tcp", Mode: "http"}, "fe_20010db8000000000000000000000001_80_tcp_http"},
+		{PortSpec{IP: net.ParseIP("0.0.0.0"), Port: 80, Protocol: "tcp", Mode: "my_mode"}, "fe_00000000_80_tcp_my.umode"},
+		{PortSpec{IP: net.ParseIP("0.0.0.0"), Port: 80, Protocol: "tcp", Mode: "my mode/2"}, "fe_00000000_80_tcp_my.x20mode.x2f2"},
+	}
+
+	seen := make(map[string]bool)
+	for _, c := range cases {
+		name := frontendName(c.Port)
+		if name != c.Expected {
+			t.Errorf("Frontend name for %+v: %s, expected %s", c.Port, name, c.Expected)
+		}
+		if seen[name] {
+			t.Errorf("Duplicated frontend name %s", name)
+		}
+		seen[name] = true
+	}
+}
+
+func TestHAProxyEscape(t *testing.T) {
+	cases := []struct {
+		Value    string
+		Expected string
+	}{
+		{"", `""`},
+		{"example.com", `"example.com"`},
+		{"/my path", `"/my path"`},
+		{`say "hi"`, `"say \"hi\""`},
+		{`C:\dir\`, `"C:\\dir\\"`},
+		{"${HOME}", `"\${HOME}"`},
+		{"a\nb\tc", `"a\nb\tc"`},
+		{`x" if TRUE #`, `"x\" if TRUE #"`},
+	}
+	for _, c := range cases {
+		if escaped := haproxyEscape(c.Value); escaped != c.Expected {
+			t.Errorf("Escaped %q: %s, expected %s", c.Value, escaped, c.Expected)
+		}
+	}
+
+	info := &ClusterInformation{
+		Services: []ServiceInformation{{Name: "service1", Annotations: map[string]string{"path": `/a b"c`}}},
+	}
+	content, err := executeTestTemplate(t, `{{ range .Services }}acl p path_beg {{ HAProxyEscape (Annotation . "path" "/") }}{{ end }}`, info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := `acl p path_beg "/a b\"c"`; content != expected {
+		t.Errorf("Expected %s, found %s", expected, content)
+	}
+}
+
+func TestServiceIndex(t *testing.T) {
+	services := []ServiceInformation{
+		{Name: "service2", Namespace: "test", Port: PortSpec{Port: 80, Mode: "http"}},
+		{Name: "service1", Namespace: "test", Port: PortSpec{Port: 443, Mode: "tcp"}},
+		{Name: "service1", Namespace: "test", Port: PortSpec{Port: 80, Mode: "http"}},
+		{Name: "service1", Namespace: "other", Port: PortSpec{Port: 80, Mode: "http"}},
+	}
+	reversed := make([]ServiceInformation, len(services))
+	for i, s := range services {
+		reversed[len(services)-1-i] = s
+	}
+
+	seen := make(map[int]bool)
+	for _, s := range services {
+		index := serviceIndex(s, services)
+		if index < 0 || index >= len(services) {
+			t.Errorf("Index of %s out of range: %d", s, index)
+		}
+		if seen[index] {
+			t.Errorf("Duplicated index %d for %s", index, s)
+		}
+		seen[index] = true
+		if other := serviceIndex(s, reversed); other != index {
+			t.Errorf("Index of %s changed with list order: %d, expected %d", s, other, index)
+		}
+	}
+
+	unknown := ServiceInformation{Name: "unknown", Namespace: "test", Port: PortSpec{Port: 80, Mode: "http"}}
+	if index := serviceIndex(unknown, services); index != -1 {
+		t.Errorf("Index of unknown service: %d, expected -1", index)
+	}
+
+	source := `{{ range .Services }}{{ .Name }}.{{ .Namespace }}:{{ .Port.Port }}={{ Index . $.Services }} {{ end }}`
+	expected := "service2.test:80=3 service1.test:443=1 service1.test:80=2 service1.other:80=0 "
+	for _, list := range [][]ServiceInformation{services, reversed} {
+		content, err := executeTestTemplate(t, source, &ClusterInformation{Services: list})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, field := range strings.Fields(expected) {
+			if !strings.Contains(content, field) {
+				t.Errorf("Expected %s in %s", field, content)
+			}
+		}
+	}
+}
+
+func TestTemplateDelimiters(t *testing.T) {
+	defer func(left, right string) {
+		templateLeftDelim, templateRightDelim = left, right
+	}(templateLeftDelim, templateRightDelim)
+
+	templateLeftDelim, templateRightDelim = "[[", "]]"
+	source := "[[ range .Services ]]{{ [[ .Name ]] }}\n[[ end ]]"
+	info := &ClusterInformation{
+		Services: []ServiceInformation{{Name: "service1"}, {Name: "service2"}},
+	}
+
+	config, err := executeTestTemplate(t, source, info)
+	if err != nil {
+		t.Fatalf("Template execution failed: %s", err)
+	}
+	expected := "{{ service1 }}\n{{ service2 }}\n"
+	if config != expected {
+		t.Fatalf("Unexpected configuration: %q, expected: %q", config, expected)
+	}
+}
+
+func TestRegisterTemplateFunc(t *testing.T) {
+	defer func() {
+		delete(customTemplateFuncs.funcs, "Repeat")
+		delete(customTemplateFuncs.funcs, "ToUpper")
+	}()
+
+	RegisterTemplateFunc("Repeat", strings.Repeat)
+	RegisterTemplateFunc("ToUpper", func(s string) string { return "upper:" + s })
+
+	source := "{{ range .Services }}{{ Repeat .Name 2 }} {{ ToUpper .Name }}\n{{ end }}"
+	info := &ClusterInformation{Services: []ServiceInformation{{Name: "service1"}}}
+	config, err := executeTestTemplate(t, source, info)
+	if err != nil {
+		t.Fatalf("Template execution failed: %s", err)
+	}
+	expected := "service1service1 upper:service1\n"
+	if config != expected {
+		t.Fatalf("Unexpected configuration: %q, expected: %q", config, expected)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("Registering a value that is not a function should panic")
+		}
+	}()
+	RegisterTemplateFunc("NotAFunction", 42)
+}
+
+func TestNamespaceServerNameTemplates(t *testing.T) {
+	defer func(templates []*template.Template, namespaceTemplates map[string][]*template.Template) {
+		serverNameTemplates, namespaceServerNameTemplates = templates, namespaceTemplates
+	}(serverNameTemplates, namespaceServerNameTemplates)
+
+	var err error
+	serverNameTemplates, err = parseServerNameTemplatesArg("{{ .Service.Name }}.{{ .Service.Namespace }}.svc.{{ .Domain }}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	namespaceServerNameTemplates, err = parseNamespaceServerNameTemplates([]byte(`
+public:
+- "{{ .Service.Name }}.example.com"
+- "{{ .Service.Name }}.example.net"
+internal:
+- "{{ .Service.Name }}.internal.{{ .Domain }}"
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		Namespace string
+		Expected  []string
+	}{
+		{"public", []string{"service1.example.com", "service1.example.net"}},
+		{"internal", []string{"service1.internal.cluster.local"}},
+		{"other", []string{"service1.other.svc.cluster.local"}},
+	}
+	for _, c := range cases {
+		service := ServiceInformation{Name: "service1", Namespace: c.Namespace}
+		generated, err := generateServerNames(service, []string{"cluster.local"}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, n := range generated {
+			names = append(names, string(n))
+		}
+		sort.Strings(names)
+		if strings.Join(names, ",") != strings.Join(c.Expected, ",") {
+			t.Errorf("Server names for namespace %s: %v, expected %v", c.Namespace, names, c.Expected)
+		}
+	}
+
+	for _, invalid := range []string{"public: []", "public:\n- \"{{ .Service.Name \"", "- foo"} {
+		if _, err := parseNamespaceServerNameTemplates([]byte(invalid)); err == nil {
+			t.Errorf("Parsing %q should fail", invalid)
+		}
+	}
+}
+
+func TestStrictServerNameTemplates(t *testing.T) {
+	defer func(templates []*template.Template, strict bool) {
+		serverNameTemplates, strictServerNameTemplates = templates, strict
+	}(serverNameTemplates, strictServerNameTemplates)
+
+	var err error
+	serverNameTemplates, err = parseServerNameTemplatesArg("{{ .Service.Name }}.example.com,{{ .Service.Unknown }}.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	source := "{{ range $s := .Services }}{{ range ServerNames $s $.Domain }}{{ . }}\n{{ end }}{{ end }}"
+	info := &ClusterInformation{
+		Services: []ServiceInformation{{Name: "service1", Namespace: "test"}},
+	}
+
+	strictServerNameTemplates = false
+	content, err := executeTestTemplate(t, source, info)
+	if err != nil {
+		t.Fatalf("Broken server name templates shouldn't fail without strict mode: %s", err)
+	}
+	if content != "service1.example.com\n" {
+		t.Errorf("Only valid server names expected, found %q", content)
+	}
+
+	strictServerNameTemplates = true
+	if _, err := executeTestTemplate(t, source, info); err == nil {
+		t.Errorf("Broken server name templates should fail in strict mode")
+	}
+}
+
+func TestPortBindOptions(t *testing.T) {
+	source := "{{ range .Ports }}bind :{{ .Port }}{{ range $.PortBindOptions . }} {{ . }}{{ end }}\n{{ end }}"
+	http := PortSpec{Port: 80, Mode: "http", Protocol: "tcp"}
+	https := PortSpec{Port: 443, Mode: "tcp", Protocol: "tcp"}
+	info := &ClusterInformation{
+		Services: []ServiceInformation{
+			{Name: "service1", Port: http},
+			{Name: "service2", Port: https, BindOptions: []string{"accept-proxy", "tfo"}},
+			{Name: "service3", Port: https, BindOptions: []string{"tfo", "alpn h2"}},
+		},
+	}
+	info.Ports = []PortSpec{http, https}
+
+	content, err := executeTestTemplate(t, source, info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "bind :80\nbind :443 accept-proxy tfo alpn h2\n"
+	if content != expected {
+		t.Errorf("Expected %q, found %q", expected, content)
+	}
+}
+
+func TestServicesByProtocol(t *testing.T) {
+	http := PortSpec{Port: 80, Mode: "http", Protocol: "tcp"}
+	https := PortSpec{Port: 443, Mode: "tcp", Protocol: "tcp"}
+	dns := PortSpec{Port: 53, Mode: "tcp", Protocol: "udp"}
+	info := &ClusterInformation{
+		Services: []ServiceInformation{
+			{Name: "service1", Port: https},
+			{Name: "service2", Port: dns},
+			{Name: "service3", Port: http},
+			{Name: "service4", Port: https},
+			{Name: "service5", Port: http},
+		},
+		Ports: []PortSpec{https, dns, http},
+	}
+
+	source := `{{ range .ServicesByProtocol }}{{ .Protocol }}:{{ range .Ports }} {{ .Port }}{{ end }} -{{ range .Services }} {{ .Name }}{{ end }}` + "\n{{ end }}"
+	content, err := executeTestTemplate(t, source, info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "http: 80 - service3 service5\ntcp: 443 - service1 service4\nudp: 53 - service2\n"
+	if content != expected {
+		t.Errorf("Expected %q, found %q", expected, content)
+	}
+
+	if groups := (&ClusterInformation{}).ServicesByProtocol(); len(groups) != 0 {
+		t.Errorf("No groups expected without services, found %+v", groups)
+	}
+}
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kube2lb-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			p := path.Join(dir, fmt.Sprintf("fragment%d.cfg", i))
+			if err := writeFileAtomic(p, []byte(fmt.Sprintf("backend %d\n", i)), 0644); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 10 {
+		t.Fatalf("10 files expected, found %d, temporary files shouldn't be kept", len(files))
+	}
+	for _, f := range files {
+		if f.Mode().Perm() != 0644 {
+			t.Errorf("Unexpected permissions for %s: %s", f.Name(), f.Mode())
+		}
+	}
+	content, err := ioutil.ReadFile(path.Join(dir, "fragment3.cfg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "backend 3\n" {
+		t.Errorf("Unexpected content: %q", content)
+	}
+
+	// Mode of existing files is kept
+	p := path.Join(dir, "fragment0.cfg")
+	if err := os.Chmod(p, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeFileAtomic(p, []byte("backend 0\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(p); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("Mode of existing file should be kept, found %v (%v)", info.Mode(), err)
+	}
+}
+
+func TestWriteFileAtomicInPlace(t *testing.T) {
+	defer func(rename func(string, string) error) { renameFile = rename }(renameFile)
+	renameFile = func(string, string) error {
+		return syscall.EBUSY
+	}
+
+	dir, err := ioutil.TempDir("", "kube2lb-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	p := path.Join(dir, "haproxy.cfg")
+	if err := ioutil.WriteFile(p, []byte("old\n"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	before, err := os.Stat(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writeFileAtomic(p, []byte("new\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	after, err := os.Stat(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !os.SameFile(before, after) {
+		t.Error("File should be written in place if it cannot be replaced")
+	}
+	if after.Mode().Perm() != 0640 {
+		t.Errorf("Mode of existing file should be kept, found %v", after.Mode())
+	}
+	if content, _ := ioutil.ReadFile(p); string(content) != "new\n" {
+		t.Errorf("Unexpected content: %q", content)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 1 {
+		t.Errorf("Temporary files shouldn't be kept, found %d files", len(files))
+	}
+}
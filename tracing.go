@@ -0,0 +1,143 @@
+/*
+Copyright 2016 Tuenti Technologies S.L. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	TraceExporterNone = "none"
+	TraceExporterLog  = "log"
+)
+
+var traceExporter = TraceExporterNone
+
+func init() {
+	flag.StringVar(&traceExporter, "trace-exporter", traceExporter, "Exporter for traces of the update pipeline, none, log or otlp")
+}
+
+// SpanData is the information of a finished span, spans of the same update
+// share the trace id
+type SpanData struct {
+	Name       string
+	TraceID    string
+	SpanID     string
+	ParentID   string
+	Start, End time.Time
+	Attributes map[string]string
+}
+
+// SpanExporter receives finished spans
+type SpanExporter interface {
+	ExportSpan(SpanData)
+}
+
+// Tracer creates spans exported by its exporter, a nil tracer creates spans
+// that are not exported
+type Tracer struct {
+	exporter SpanExporter
+}
+
+func NewTracer(exporter SpanExporter) *Tracer {
+	return &Tracer{exporter: exporter}
+}
+
+// NewTracerFromFlags creates the tracer configured with -trace-exporter,
+// nil if tracing is disabled
+func NewTracerFromFlags() (*Tracer, error) {
+	switch traceExporter {
+	case TraceExporterNone, "":
+		return nil, nil
+	case TraceExporterLog:
+		return NewTracer(logSpanExporter{}), nil
+	case TraceExporterOTLP:
+		exporter := NewOTLPSpanExporter(otlpEndpoint, otlpServiceName)
+		go exporter.Run(context.Background())
+		return NewTracer(exporter), nil
+	}
+	return nil, fmt.Errorf("unknown trace exporter %s", traceExporter)
+}
+
+type spanContextKey struct{}
+
+// Span measures an operation, it must be ended with End
+type Span struct {
+	tracer *Tracer
+	data   SpanData
+}
+
+// Start starts a span, child of the span in the context if any
+func (t *Tracer) Start(ctx context.Context, name string) (context.Context, *Span) {
+	span := &Span{tracer: t}
+	if t == nil {
+		return ctx, span
+	}
+	span.data = SpanData{
+		Name:       name,
+		SpanID:     randomID(8),
+		Start:      time.Now(),
+		Attributes: make(map[string]string),
+	}
+	if parent, ok := ctx.Value(spanContextKey{}).(*Span); ok && parent.tracer != nil {
+		span.data.TraceID = parent.data.TraceID
+		span.data.ParentID = parent.data.SpanID
+	} else {
+		span.data.TraceID = randomID(16)
+	}
+	return context.WithValue(ctx, spanContextKey{}, span), span
+}
+
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s.tracer == nil {
+		return
+	}
+	s.data.Attributes[key] = fmt.Sprint(value)
+}
+
+func (s *Span) End() {
+	if s.tracer == nil {
+		return
+	}
+	s.data.End = time.Now()
+	s.tracer.exporter.ExportSpan(s.data)
+}
+
+func randomID(size int) string {
+	id := make([]byte, size)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+type logSpanExporter struct{}
+
+func (logSpanExporter) ExportSpan(span SpanData) {
+	var attributes []string
+	for k, v := range span.Attributes {
+		attributes = append(attributes, k+"="+v)
+	}
+	sort.Strings(attributes)
+	log.Printf("Span %s trace=%s span=%s parent=%s duration=%s %s", span.Name, span.TraceID, span.SpanID, span.ParentID, span.End.Sub(span.Start), strings.Join(attributes, " "))
+}
@@ -0,0 +1,91 @@
+/*
+Copyright 2016 Tuenti Technologies S.L. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// MemorySpanExporter keeps exported spans in memory
+type MemorySpanExporter struct {
+	sync.Mutex
+	spans []SpanData
+}
+
+func (e *MemorySpanExporter) ExportSpan(span SpanData) {
+	e.Lock()
+	defer e.Unlock()
+	e.spans = append(e.spans, span)
+}
+
+func (e *MemorySpanExporter) Spans() []SpanData {
+	e.Lock()
+	defer e.Unlock()
+	return append([]SpanData(nil), e.spans...)
+}
+
+func TestUpdateTracing(t *testing.T) {
+	exporter := &MemorySpanExporter{}
+	service, endpoints := newTestService("service1", nil)
+	client := newTestStoresClient(service, endpoints)
+	client.SetTracer(NewTracer(exporter))
+	client.AddTemplate(&dummyTemplate{})
+	client.AddNotifier(newTestNotifier())
+
+	if !assert.NoError(t, client.Update(context.Background())) {
+		return
+	}
+
+	spans := make(map[string]SpanData)
+	var names []string
+	for _, span := range exporter.Spans() {
+		spans[span.Name] = span
+		names = append(names, span.Name)
+	}
+	assert.Equal(t, []string{"kube2lb.render", "kube2lb.notify", "kube2lb.update"}, names, "spans are exported when they end")
+
+	update := spans["kube2lb.update"]
+	assert.Empty(t, update.ParentID)
+	for _, name := range []string{"kube2lb.render", "kube2lb.notify"} {
+		assert.Equal(t, update.TraceID, spans[name].TraceID, "%s should be in the trace of the update", name)
+		assert.Equal(t, update.SpanID, spans[name].ParentID, "%s should be child of the update", name)
+	}
+	assert.Equal(t, "true", spans["kube2lb.render"].Attributes["changed"])
+	assert.Equal(t, "1", spans["kube2lb.render"].Attributes["services"])
+	assert.False(t, update.End.Before(update.Start))
+
+	defer func(ip string) { defaultLBIP = ip }(defaultLBIP)
+	defaultLBIP = "invalid"
+	assert.Error(t, client.Update(context.Background()))
+	if exported := exporter.Spans(); assert.Equal(t, 4, len(exported)) {
+		failed := exported[3]
+		assert.Equal(t, "kube2lb.update", failed.Name)
+		assert.Contains(t, failed.Attributes["error"], "invalid default lb IP")
+	}
+}
+
+func TestNilTracer(t *testing.T) {
+	var tracer *Tracer
+	ctx, span := tracer.Start(context.Background(), "test")
+	span.SetAttribute("key", "value")
+	span.End()
+	assert.Nil(t, ctx.Value(spanContextKey{}))
+}
@@ -24,9 +24,11 @@ import (
 )
 
 var updateTimeout float64
+var renderDelay time.Duration
 
 func init() {
 	flag.Float64Var(&updateTimeout, "update-timeout", 10, "Update timeout in seconds")
+	flag.DurationVar(&renderDelay, "render-delay", 0, "Fixed delay between detecting the need of an update and running it, to let changes settle")
 }
 
 type Updater interface {
@@ -42,25 +44,39 @@ type antiBurstUpdater struct {
 	updateNeeded  atomic.Value
 	signal, burst chan struct{}
 	f             UpdaterFunc
+
+	// stopped is closed when the updater stops reading signals
+	stopped chan struct{}
+
+	// Fixed delay before running updates, independent of the anti-burst
+	// window, changes signaled during the delay trigger another update
+	renderDelay time.Duration
 }
 
 func NewUpdater(f UpdaterFunc) Updater {
 	u := antiBurstUpdater{
-		signal: make(chan struct{}),
-		burst:  make(chan struct{}),
-		f:      f,
+		signal:      make(chan struct{}),
+		burst:       make(chan struct{}),
+		stopped:     make(chan struct{}),
+		f:           f,
+		renderDelay: renderDelay,
 	}
 	u.updateNeeded.Store(0)
 	return &u
 }
 
 func (u *antiBurstUpdater) antiBurst(ctx context.Context) {
+	defer close(u.stopped)
 	for {
 		select {
 		case <-u.burst:
 		case <-time.After(time.Second):
 			if u.updateNeeded.Load().(int) == 1 {
-				u.signal <- struct{}{}
+				select {
+				case u.signal <- struct{}{}:
+				case <-ctx.Done():
+					return
+				}
 			}
 		case <-ctx.Done():
 			return
@@ -79,14 +95,30 @@ func (u *antiBurstUpdater) Run(ctx context.Context) {
 
 		u.updateNeeded.Store(0)
 
-		timeout := time.Duration(updateTimeout) * time.Second
-		timeoutCtx, cancel := context.WithTimeout(ctx, timeout)
+		if u.renderDelay > 0 {
+			select {
+			case <-time.After(u.renderDelay):
+			case <-ctx.Done():
+				return
+			}
+		}
+
+		timeoutCtx, cancel := context.WithTimeout(ctx, updateTimeoutDuration())
 		u.f(timeoutCtx)
 		cancel()
 	}
 }
 
+// updateTimeoutDuration returns the maximum duration of updates
+func updateTimeoutDuration() time.Duration {
+	return time.Duration(updateTimeout) * time.Second
+}
+
+// Signal requests an update, it doesn't block once the updater has stopped
 func (u *antiBurstUpdater) Signal() {
 	u.updateNeeded.Store(1)
-	u.burst <- struct{}{}
+	select {
+	case u.burst <- struct{}{}:
+	case <-u.stopped:
+	}
 }
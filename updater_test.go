@@ -0,0 +1,94 @@
+/*
+Copyright 2016 Tuenti Technologies S.L. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRenderDelay(t *testing.T) {
+	updated := make(chan time.Time, 1)
+	u := NewUpdater(func(context.Context) { updated <- time.Now() }).(*antiBurstUpdater)
+	u.renderDelay = 200 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go u.Run(ctx)
+
+	start := time.Now()
+	u.signal <- struct{}{}
+	select {
+	case at := <-updated:
+		if elapsed := at.Sub(start); elapsed < u.renderDelay {
+			t.Errorf("Update run after %s, before the delay of %s", elapsed, u.renderDelay)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Update not run")
+	}
+}
+
+func TestSignalStoppedUpdater(t *testing.T) {
+	u := NewUpdater(func(context.Context) {})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		u.Run(ctx)
+		close(done)
+	}()
+	u.Signal()
+	cancel()
+	<-done
+
+	signaled := make(chan struct{})
+	go func() {
+		u.Signal()
+		close(signaled)
+	}()
+	select {
+	case <-signaled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Signal blocked on stopped updater")
+	}
+}
+
+func TestRenderDelayCancelled(t *testing.T) {
+	updated := make(chan time.Time, 1)
+	u := NewUpdater(func(context.Context) { updated <- time.Now() }).(*antiBurstUpdater)
+	u.renderDelay = time.Hour
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		u.Run(ctx)
+		close(done)
+	}()
+
+	u.signal <- struct{}{}
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Updater not stopped during the delay")
+	}
+	select {
+	case <-updated:
+		t.Error("Update run after cancellation")
+	default:
+	}
+}
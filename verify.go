@@ -0,0 +1,125 @@
+/*
+Copyright 2016 Tuenti Technologies S.L. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+var verifyURL string
+var verifyTimeout = 5 * time.Second
+var verifyInterval = time.Second
+
+func init() {
+	flag.StringVar(&verifyURL, "verify-url", "", "URL to check after notifications, if it doesn't return a 2xx status the previous configuration is restored (Optional)")
+	flag.DurationVar(&verifyTimeout, "verify-timeout", verifyTimeout, "Time to wait for the verification URL to succeed after notifications, it must be lower than the update timeout")
+}
+
+// validateVerifyTimeout checks that verifications leave time in updates to
+// notify rolled back configurations
+func validateVerifyTimeout(verifyTimeout, updateTimeout time.Duration) error {
+	if verifyTimeout <= 0 {
+		return fmt.Errorf("verify timeout must be positive")
+	}
+	if verifyTimeout >= updateTimeout {
+		return fmt.Errorf("verify timeout (%s) must be lower than update timeout (%s)", verifyTimeout, updateTimeout)
+	}
+	return nil
+}
+
+// RollbackTemplate is implemented by templates that can restore the output
+// they had before their last execution
+type RollbackTemplate interface {
+	Template
+	Rollback() error
+}
+
+// verifyConfig requests the URL till it returns a 2xx status or the timeout
+// expires, load balancers may need some time to apply new configurations
+func verifyConfig(ctx context.Context, url string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	for {
+		err := verifyRequest(ctx, url)
+		if err == nil {
+			return nil
+		}
+		select {
+		case <-time.After(verifyInterval):
+		case <-ctx.Done():
+			return err
+		}
+	}
+}
+
+func verifyRequest(ctx context.Context, url string) error {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s returned status %d", url, resp.StatusCode)
+	}
+	return nil
+}
+
+// rollbackTemplates restores the previous output of the templates that
+// support it
+func (c *KubernetesClient) rollbackTemplates() error {
+	for _, t := range c.templates {
+		if rt, ok := t.(RollbackTemplate); ok {
+			if err := rt.Rollback(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// verifyOrRollback verifies the configuration after a notification, if the
+// verification fails the previous configuration is restored and notified
+func (c *KubernetesClient) verifyOrRollback(ctx context.Context, info *ClusterInformation) error {
+	err := verifyConfig(ctx, verifyURL, verifyTimeout)
+	if err == nil {
+		return nil
+	}
+	log.Printf("Verification of new configuration failed, rolling back: %s", err)
+	if rerr := c.rollbackTemplates(); rerr != nil {
+		return fmt.Errorf("verification failed: %v, couldn't roll back: %v", err, rerr)
+	}
+	var changes ClusterChanges
+	if c.lastNotifiedInfo != nil {
+		changes = DiffClusterInformation(info, c.lastNotifiedInfo)
+	}
+	// Verification can consume the whole update context, the rolled back
+	// configuration is notified with its own timeout
+	rollbackCtx, cancel := context.WithTimeout(context.Background(), updateTimeoutDuration())
+	defer cancel()
+	c.Notify(rollbackCtx, changes)
+	return fmt.Errorf("verification failed, previous configuration restored: %v", err)
+}
@@ -0,0 +1,181 @@
+/*
+Copyright 2016 Tuenti Technologies S.L. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVerifyConfig(t *testing.T) {
+	defer func(interval time.Duration) { verifyInterval = interval }(verifyInterval)
+	verifyInterval = 10 * time.Millisecond
+
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Load balancer takes some time to apply the configuration
+		if atomic.AddInt32(&requests, 1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+	assert.NoError(t, verifyConfig(context.Background(), server.URL, time.Second))
+	assert.Equal(t, int32(3), atomic.LoadInt32(&requests))
+
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+	err := verifyConfig(context.Background(), failing.URL, 50*time.Millisecond)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "returned status 500")
+	}
+}
+
+func TestVerifyRollback(t *testing.T) {
+	defer func(url string, timeout, interval time.Duration) {
+		verifyURL, verifyTimeout, verifyInterval = url, timeout, interval
+	}(verifyURL, verifyTimeout, verifyInterval)
+	verifyTimeout = 50 * time.Millisecond
+	verifyInterval = 10 * time.Millisecond
+
+	var healthy atomic.Value
+	healthy.Store(true)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !healthy.Load().(bool) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+	verifyURL = server.URL
+
+	dir, err := ioutil.TempDir("", "kube2lb-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sourcePath := path.Join(dir, "test.tpl")
+	configPath := path.Join(dir, "test.cfg")
+	if err := ioutil.WriteFile(sourcePath, []byte("{{ range .Services }}{{ .Name }}\n{{ end }}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	service1, endpoints1 := newTestService("service1", nil)
+	client := newTestStoresClient(service1, endpoints1)
+	client.AddTemplate(NewTemplate(sourcePath, configPath, ""))
+	notifier := &fakeNotifier{}
+	client.AddNotifier(notifier)
+
+	// Passing verification keeps the configuration
+	if assert.NoError(t, client.Update(context.Background())) {
+		config, _ := ioutil.ReadFile(configPath)
+		assert.Equal(t, "service1\n", string(config))
+		assert.Equal(t, 1, notifier.count)
+	}
+
+	// Failing verification restores and notifies the previous configuration
+	healthy.Store(false)
+	service2, endpoints2 := newTestService("service2", nil)
+	client.serviceStore.Update(service2)
+	client.endpointsStore.Update(endpoints2)
+	if assert.Error(t, client.Update(context.Background())) {
+		config, _ := ioutil.ReadFile(configPath)
+		assert.Equal(t, "service1\n", string(config), "previous configuration should be restored")
+		assert.Equal(t, 3, notifier.count, "rolled back configuration should be notified")
+		if assert.Equal(t, 3, len(notifier.changes)) {
+			assert.Equal(t, []string{"test/service2:80"}, servicesKeys(notifier.changes[2].Removed))
+		}
+	}
+
+	// New configuration is tried again on next update
+	healthy.Store(true)
+	if assert.NoError(t, client.Update(context.Background())) {
+		config, _ := ioutil.ReadFile(configPath)
+		assert.Contains(t, string(config), "service1\n")
+		assert.Contains(t, string(config), "service2\n")
+	}
+}
+
+// contextNotifier records the errors of the contexts of notifications
+type contextNotifier struct {
+	errs []error
+}
+
+func (n *contextNotifier) Notify(ctx context.Context) error {
+	n.errs = append(n.errs, ctx.Err())
+	return nil
+}
+
+func TestVerifyRollbackAfterDeadline(t *testing.T) {
+	defer func(url string, timeout, interval time.Duration) {
+		verifyURL, verifyTimeout, verifyInterval = url, timeout, interval
+	}(verifyURL, verifyTimeout, verifyInterval)
+	verifyTimeout = time.Second
+	verifyInterval = 10 * time.Millisecond
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+	verifyURL = server.URL
+
+	dir, err := ioutil.TempDir("", "kube2lb-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sourcePath := path.Join(dir, "test.tpl")
+	configPath := path.Join(dir, "test.cfg")
+	if err := ioutil.WriteFile(sourcePath, []byte("{{ range .Services }}{{ .Name }}\n{{ end }}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(configPath, []byte("previous\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	service1, endpoints1 := newTestService("service1", nil)
+	client := newTestStoresClient(service1, endpoints1)
+	client.AddTemplate(NewTemplate(sourcePath, configPath, ""))
+	notifier := &contextNotifier{}
+	client.AddNotifier(notifier)
+
+	// Verification times out with the update context
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if assert.Error(t, client.Update(ctx)) {
+		config, _ := ioutil.ReadFile(configPath)
+		assert.Equal(t, "previous\n", string(config), "previous configuration should be restored")
+		if assert.Equal(t, 2, len(notifier.errs)) {
+			assert.NoError(t, notifier.errs[1], "rolled back configuration should be notified with a live context")
+		}
+	}
+}
+
+func TestValidateVerifyTimeout(t *testing.T) {
+	assert.NoError(t, validateVerifyTimeout(5*time.Second, 10*time.Second))
+	assert.Error(t, validateVerifyTimeout(10*time.Second, 10*time.Second))
+	assert.Error(t, validateVerifyTimeout(0, 10*time.Second))
+}
@@ -0,0 +1,88 @@
+/*
+Copyright 2016 Tuenti Technologies S.L. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"sort"
+)
+
+// WeightedBackend is a backend receiving a share of the requests for a server
+// name, requests go to the first backend whose Threshold is greater than a
+// random number between 0 and the total weight of the server name
+type WeightedBackend struct {
+	Backend   string
+	Weight    int
+	Threshold int
+}
+
+// WeightedServerName is a server name shared by several services with
+// weights, as in blue/green deployments
+type WeightedServerName struct {
+	Name     string
+	Total    int
+	Backends []WeightedBackend
+}
+
+// weightedServerNames returns the server names shared by more than one
+// service with weight, sorted by name. If ports are given only services on
+// these ports are included.
+func weightedServerNames(info *ClusterInformation, domain string, ports ...PortSpec) ([]WeightedServerName, error) {
+	backends := make(map[serverName][]WeightedBackend)
+	seen := make(map[serverName]map[string]bool)
+	for _, s := range info.Services {
+		if !s.Weighted || !onPorts(s, ports) {
+			continue
+		}
+		names, err := generateServerNames(s, serverNameDomains(info, domain), info.Nodes)
+		if err != nil {
+			return nil, err
+		}
+		for _, n := range names {
+			if seen[n] == nil {
+				seen[n] = make(map[string]bool)
+			}
+			if seen[n][s.String()] {
+				continue
+			}
+			seen[n][s.String()] = true
+			backends[n] = append(backends[n], WeightedBackend{Backend: s.String(), Weight: s.Weight})
+		}
+	}
+
+	var weighted []WeightedServerName
+	for n, bs := range backends {
+		if len(bs) < 2 {
+			continue
+		}
+		sort.Slice(bs, func(i, j int) bool {
+			return bs[i].Backend < bs[j].Backend
+		})
+		total := 0
+		for i := range bs {
+			total += bs[i].Weight
+			bs[i].Threshold = total
+		}
+		if total == 0 {
+			continue
+		}
+		weighted = append(weighted, WeightedServerName{Name: string(n), Total: total, Backends: bs})
+	}
+	sort.Slice(weighted, func(i, j int) bool {
+		return weighted[i].Name < weighted[j].Name
+	})
+	return weighted, nil
+}
@@ -0,0 +1,73 @@
+/*
+Copyright 2016 Tuenti Technologies S.L. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"testing"
+	"text/template"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWeightedServerNames(t *testing.T) {
+	defer func(templates []*template.Template) { serverNameTemplates = templates }(serverNameTemplates)
+	defer func(strict bool) { strictServerNames = strict }(strictServerNames)
+	var err error
+	serverNameTemplates, err = parseServerNameTemplatesArg("{{ .Service.Name }}.{{ .Domain }}")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	http := PortSpec{Port: 80, Mode: "http", Protocol: "tcp"}
+	info := &ClusterInformation{
+		Services: []ServiceInformation{
+			{Name: "web-blue", Namespace: "test", Port: http, External: []string{"www.example.com"}, Weight: 80, Weighted: true},
+			{Name: "web-green", Namespace: "test", Port: http, External: []string{"www.example.com"}, Weight: 20, Weighted: true},
+			{Name: "api", Namespace: "test", Port: http, Weight: 1},
+		},
+		Domain:  "example.com",
+		Domains: []string{"example.com"},
+	}
+
+	strictServerNames = true
+	assert.NoError(t, checkServerNameCollisions(info), "services with weights can share server names")
+
+	source := `{{- range Weighted .Domain }}
+  http-request set-var(txn.weight) rand({{ .Total }}) if { hdr(host) -i {{ .Name }} }
+{{- range .Backends }}
+  use_backend {{ .Backend }} if { var(txn.weight) -m int lt {{ .Threshold }} }
+{{- end }}
+{{- end }}
+`
+	expected := `
+  http-request set-var(txn.weight) rand(100) if { hdr(host) -i www.example.com }
+  use_backend web-blue_test_80_tcp_http if { var(txn.weight) -m int lt 80 }
+  use_backend web-green_test_80_tcp_http if { var(txn.weight) -m int lt 100 }
+`
+	content, err := executeTestTemplate(t, source, info)
+	if assert.NoError(t, err) {
+		assert.Equal(t, expected, content)
+	}
+
+	// Server names shared with services without weights are collisions
+	info.Services[1].Weighted = false
+	assert.Error(t, checkServerNameCollisions(info))
+	weighted, err := weightedServerNames(info, info.Domain)
+	if assert.NoError(t, err) {
+		assert.Empty(t, weighted, "server names with a single weighted service are not grouped")
+	}
+}